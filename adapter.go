@@ -0,0 +1,315 @@
+package iot
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAdapterPollInterval = 30 * time.Second
+	defaultAdapterTimeout      = 5 * time.Second
+)
+
+// 南向协议适配器，负责网关与现场设备之间的协议转换，设备使用节点ID（如Modbus从站地址）标识
+type SouthboundAdapter interface {
+	// 适配器名称
+	Name() string
+
+	// 发现适配器管理的设备，返回的设备信息至少包含节点ID和产品ID
+	Discover(ctx context.Context) ([]DeviceInfo, error)
+
+	// 读取设备属性
+	ReadProperties(ctx context.Context, nodeId string) ([]DevicePropertyEntry, error)
+
+	// 设置设备属性
+	WriteProperties(ctx context.Context, nodeId string, services []DevicePropertyDownRequestEntry) error
+
+	// 执行平台下发的命令，返回命令响应参数
+	ExecuteCommand(ctx context.Context, nodeId string, command Command) (interface{}, error)
+}
+
+// 适配器可以实现该接口为每个设备指定读取属性的间隔，间隔小于等于0时使用运行时的PollInterval
+type SouthboundPollScheduler interface {
+	PollInterval(nodeId string) time.Duration
+}
+
+type AdapterRuntimeConfig struct {
+	PollInterval     time.Duration      // 读取设备属性并上报的间隔，默认30秒
+	DiscoverInterval time.Duration      // 重新发现设备的间隔，默认只在启动时发现设备
+	Timeout          time.Duration      // 适配器单次操作的超时时间，默认5秒
+	Registry         *SubDeviceRegistry // 网关本地子设备列表，用于查找已经添加过的子设备
+}
+
+// 适配器设备与平台子设备的绑定关系
+type adapterBinding struct {
+	adapter  SouthboundAdapter
+	nodeId   string
+	deviceId string
+	interval time.Duration
+	nextPoll time.Time // 下次读取属性的时间，新绑定的设备立即读取
+}
+
+// 适配器运行时，将适配器发现的设备添加为网关子设备，定期读取设备属性批量上报，
+// 并将平台下发给子设备的命令、属性设置和属性查询转换为适配器操作
+type AdapterRuntime struct {
+	device Device
+	config AdapterRuntimeConfig
+
+	lock     sync.Mutex
+	adapters []SouthboundAdapter
+	bindings map[string]*adapterBinding // 节点ID -> 绑定关系
+	running  bool
+	stop     chan struct{}
+}
+
+func NewAdapterRuntime(device Device, config AdapterRuntimeConfig) *AdapterRuntime {
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultAdapterPollInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultAdapterTimeout
+	}
+
+	return &AdapterRuntime{
+		device:   device,
+		config:   config,
+		bindings: map[string]*adapterBinding{},
+	}
+}
+
+// 添加适配器，在Start之前调用
+func (runtime *AdapterRuntime) AddAdapter(adapter SouthboundAdapter) {
+	if adapter == nil {
+		return
+	}
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+	runtime.adapters = append(runtime.adapters, adapter)
+}
+
+// 节点对应的平台子设备ID
+func (runtime *AdapterRuntime) DeviceId(nodeId string) (string, bool) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+	if binding, ok := runtime.bindings[nodeId]; ok {
+		return binding.deviceId, true
+	}
+	return "", false
+}
+
+// 发现设备后按照PollInterval间隔上报设备属性
+func (runtime *AdapterRuntime) Start() {
+	runtime.lock.Lock()
+	if runtime.running {
+		runtime.lock.Unlock()
+		return
+	}
+	runtime.running = true
+	runtime.stop = make(chan struct{})
+	stop := runtime.stop
+	runtime.lock.Unlock()
+
+	go func() {
+		runtime.discover()
+
+		var discover <-chan time.Time
+		if runtime.config.DiscoverInterval > 0 {
+			discoverTicker := time.NewTicker(runtime.config.DiscoverInterval)
+			defer discoverTicker.Stop()
+			discover = discoverTicker.C
+		}
+
+		for {
+			timer := time.NewTimer(runtime.nextPollDelay(time.Now()))
+			select {
+			case now := <-timer.C:
+				runtime.poll(now)
+			case <-discover:
+				timer.Stop()
+				runtime.discover()
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (runtime *AdapterRuntime) Stop() {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+	if !runtime.running {
+		return
+	}
+	runtime.running = false
+	close(runtime.stop)
+}
+
+// 发现全部适配器的设备，新设备添加为网关子设备并绑定平台请求handler
+func (runtime *AdapterRuntime) discover() {
+	runtime.lock.Lock()
+	adapters := runtime.adapters
+	runtime.lock.Unlock()
+
+	for _, adapter := range adapters {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.config.Timeout)
+		devices, err := adapter.Discover(ctx)
+		cancel()
+		if err != nil {
+			glog.Warningf("adapter %s discover devices failed %v", adapter.Name(), err)
+			continue
+		}
+
+		var unknown []DeviceInfo
+		for _, info := range devices {
+			if _, ok := runtime.DeviceId(info.NodeId); ok {
+				continue
+			}
+			if runtime.config.Registry != nil {
+				if registered, ok := runtime.config.Registry.FindByNodeId(info.NodeId); ok {
+					runtime.bind(adapter, info.NodeId, registered.DeviceId)
+					continue
+				}
+			}
+			unknown = append(unknown, info)
+		}
+		if len(unknown) == 0 {
+			continue
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), runtime.config.Timeout)
+		result, err := runtime.device.AddSubDevicesWithResult(ctx, unknown)
+		cancel()
+		if err != nil {
+			glog.Warningf("adapter %s add sub devices failed %v", adapter.Name(), err)
+			continue
+		}
+		for _, info := range result.SuccessfulDevices {
+			runtime.bind(adapter, info.NodeId, info.DeviceId)
+		}
+		for _, failed := range result.FailedDevices {
+			glog.Warningf("adapter %s add sub device %s failed,error code %s", adapter.Name(), failed.NodeId, failed.ErrorCode)
+		}
+	}
+}
+
+func (runtime *AdapterRuntime) bind(adapter SouthboundAdapter, nodeId, deviceId string) {
+	runtime.lock.Lock()
+	if binding, ok := runtime.bindings[nodeId]; ok {
+		runtime.lock.Unlock()
+		if binding.adapter != adapter {
+			glog.Warningf("node %s is managed by adapter %s,ignore adapter %s", nodeId, binding.adapter.Name(), adapter.Name())
+		}
+		return
+	}
+	binding := &adapterBinding{
+		adapter:  adapter,
+		nodeId:   nodeId,
+		deviceId: deviceId,
+		interval: runtime.config.PollInterval,
+	}
+	if scheduler, ok := adapter.(SouthboundPollScheduler); ok && scheduler.PollInterval(nodeId) > 0 {
+		binding.interval = scheduler.PollInterval(nodeId)
+	}
+	runtime.bindings[nodeId] = binding
+	runtime.lock.Unlock()
+
+	subDevice := runtime.device.SubDevice(deviceId)
+	subDevice.AddCommandHandler(func(command Command) (bool, interface{}) {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.config.Timeout)
+		defer cancel()
+		response, err := adapter.ExecuteCommand(ctx, nodeId, command)
+		if err != nil {
+			glog.Warningf("adapter %s execute command %s failed %v", adapter.Name(), command.CommandName, err)
+			return false, err.Error()
+		}
+		return true, response
+	})
+	subDevice.AddPropertiesSetHandler(func(request DevicePropertyDownRequest) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.config.Timeout)
+		defer cancel()
+		if err := adapter.WriteProperties(ctx, nodeId, request.Services); err != nil {
+			glog.Warningf("adapter %s write properties of node %s failed %v", adapter.Name(), nodeId, err)
+			return false
+		}
+		return true
+	})
+	subDevice.SetPropertyQueryHandler(func(query DevicePropertyQueryRequest) DevicePropertyEntry {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.config.Timeout)
+		defer cancel()
+		services, err := adapter.ReadProperties(ctx, nodeId)
+		if err != nil {
+			glog.Warningf("adapter %s read properties of node %s failed %v", adapter.Name(), nodeId, err)
+			return DevicePropertyEntry{ServiceId: query.ServiceId}
+		}
+		for _, service := range services {
+			if len(query.ServiceId) == 0 || service.ServiceId == query.ServiceId {
+				return service
+			}
+		}
+		return DevicePropertyEntry{ServiceId: query.ServiceId}
+	})
+
+	glog.Infof("adapter %s bind node %s to sub device %s", adapter.Name(), nodeId, deviceId)
+}
+
+// 距离下次读取设备属性的时间
+func (runtime *AdapterRuntime) nextPollDelay(now time.Time) time.Duration {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+	delay := runtime.config.PollInterval
+	for _, binding := range runtime.bindings {
+		if d := binding.nextPoll.Sub(now); d < delay {
+			delay = d
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// 读取到期设备的属性并批量上报
+func (runtime *AdapterRuntime) poll(now time.Time) {
+	runtime.lock.Lock()
+	var bindings []*adapterBinding
+	for _, binding := range runtime.bindings {
+		if binding.nextPoll.After(now) {
+			continue
+		}
+		binding.nextPoll = now.Add(binding.interval)
+		bindings = append(bindings, binding)
+	}
+	runtime.lock.Unlock()
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].deviceId < bindings[j].deviceId
+	})
+
+	var devices []DeviceService
+	for _, binding := range bindings {
+		ctx, cancel := context.WithTimeout(context.Background(), runtime.config.Timeout)
+		services, err := binding.adapter.ReadProperties(ctx, binding.nodeId)
+		cancel()
+		if err != nil {
+			glog.Warningf("adapter %s read properties of node %s failed %v", binding.adapter.Name(), binding.nodeId, err)
+			continue
+		}
+		if len(services) == 0 {
+			continue
+		}
+		devices = append(devices, DeviceService{
+			DeviceId: binding.deviceId,
+			Services: services,
+		})
+	}
+
+	if len(devices) == 0 {
+		return
+	}
+	if !runtime.device.BatchReportSubDevicesProperties(DevicesService{Devices: devices}) {
+		glog.Warningf("report properties of %d adapter devices failed", len(devices))
+	}
+}
@@ -0,0 +1,145 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 内存中的南向适配器，设备属性保存在map中
+type memoryAdapter struct {
+	lock       sync.Mutex
+	devices    []DeviceInfo
+	properties map[string]map[string]interface{} // 节点ID -> 属性
+	commands   []Command
+}
+
+func newMemoryAdapter(nodeIds ...string) *memoryAdapter {
+	adapter := &memoryAdapter{
+		properties: map[string]map[string]interface{}{},
+	}
+	for _, nodeId := range nodeIds {
+		adapter.devices = append(adapter.devices, DeviceInfo{NodeId: nodeId, ProductId: "meter"})
+		adapter.properties[nodeId] = map[string]interface{}{"value": 0}
+	}
+	return adapter
+}
+
+func (adapter *memoryAdapter) Name() string {
+	return "memory"
+}
+
+func (adapter *memoryAdapter) Discover(ctx context.Context) ([]DeviceInfo, error) {
+	return adapter.devices, nil
+}
+
+func (adapter *memoryAdapter) ReadProperties(ctx context.Context, nodeId string) ([]DevicePropertyEntry, error) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	properties, ok := adapter.properties[nodeId]
+	if !ok {
+		return nil, errors.New("unknown node " + nodeId)
+	}
+	copied := map[string]interface{}{}
+	for name, value := range properties {
+		copied[name] = value
+	}
+	return []DevicePropertyEntry{{ServiceId: "sensor", Properties: copied}}, nil
+}
+
+func (adapter *memoryAdapter) WriteProperties(ctx context.Context, nodeId string, services []DevicePropertyDownRequestEntry) error {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	for _, service := range services {
+		for name, value := range service.Properties.(map[string]interface{}) {
+			adapter.properties[nodeId][name] = value
+		}
+	}
+	return nil
+}
+
+func (adapter *memoryAdapter) ExecuteCommand(ctx context.Context, nodeId string, command Command) (interface{}, error) {
+	adapter.lock.Lock()
+	defer adapter.lock.Unlock()
+	adapter.commands = append(adapter.commands, command)
+	return nodeId, nil
+}
+
+func TestAdapterRuntime_DiscoverAndPoll(t *testing.T) {
+	device, client := createFakeIotDevice()
+	registry, _ := NewSubDeviceRegistry("")
+	registry.add(SubDeviceInfo{Devices: []DeviceInfo{{DeviceId: "meter_1", NodeId: "1"}}})
+
+	var added []DeviceInfo
+	respondSubDeviceRequest(device, client, func(entry DataEntry) (string, interface{}) {
+		request := SubDeviceInfo{}
+		json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), &request)
+		var devices []DeviceInfo
+		for _, info := range request.Devices {
+			info.DeviceId = info.ProductId + "_" + info.NodeId
+			devices = append(devices, info)
+		}
+		added = append(added, devices...)
+		return "add_sub_device_response", map[string]interface{}{"successful_devices": devices}
+	})
+
+	runtime := NewAdapterRuntime(device, AdapterRuntimeConfig{Registry: registry})
+	adapter := newMemoryAdapter("1", "2")
+	runtime.AddAdapter(adapter)
+	runtime.discover()
+
+	// 本地子设备列表中已经存在的节点不需要重新添加
+	if len(added) != 1 || added[0].NodeId != "2" {
+		t.Fatalf("only unknown node must be added,added = %s", Interface2JsonString(added))
+	}
+	if deviceId, _ := runtime.DeviceId("1"); deviceId != "meter_1" {
+		t.Errorf("node 1 must bind to registered sub device but is %s", deviceId)
+	}
+
+	client.onPublish = nil
+	runtime.poll(time.Now())
+	service := DevicesService{}
+	if !lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service) {
+		t.Fatalf("adapter devices properties must be batch reported")
+	}
+	if len(service.Devices) != 2 || service.Devices[0].DeviceId != "meter_1" || service.Devices[1].DeviceId != "meter_2" {
+		t.Errorf("batch report is wrong %s", Interface2JsonString(service))
+	}
+}
+
+func TestAdapterRuntime_DownlinkToAdapter(t *testing.T) {
+	device, client := createFakeIotDevice()
+	runtime := NewAdapterRuntime(device, AdapterRuntimeConfig{})
+	adapter := newMemoryAdapter("1")
+	runtime.bind(adapter, "1", "meter_1")
+
+	responses := make(chan string, 2)
+	client.onPublish = func(topic string, payload []byte) {
+		responses <- string(payload)
+	}
+
+	device.base.createPropertiesSetMqttHandler()(client, fakeMessage{
+		topic: "$oc/devices/" + device.base.Id + "/sys/properties/set/request_id=1",
+		payload: []byte(Interface2JsonString(DevicePropertyDownRequest{
+			ObjectDeviceId: "meter_1",
+			Services:       []DevicePropertyDownRequestEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 5}}},
+		})),
+	})
+	<-responses
+	if properties, _ := adapter.ReadProperties(context.Background(), "1"); properties[0].Properties.(map[string]interface{})["value"] != float64(5) {
+		t.Errorf("property set must be written to adapter,properties = %v", properties)
+	}
+
+	device.base.createCommandMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=2",
+		payload: []byte(Interface2JsonString(Command{ObjectDeviceId: "meter_1", CommandName: "reset"})),
+	})
+	response := CommandResponse{}
+	json.Unmarshal([]byte(<-responses), &response)
+	if response.ResultCode != 0 || response.Paras != "1" || len(adapter.commands) != 1 {
+		t.Errorf("command must be executed by adapter,response = %s", Interface2JsonString(response))
+	}
+}
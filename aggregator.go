@@ -0,0 +1,300 @@
+package iot
+
+import (
+	"github.com/golang/glog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 滚动窗口，窗口之间不重叠
+	AggregationWindowTumbling uint8 = 0
+	// 滑动窗口，每隔Slide时间输出最近Window时间内的统计值
+	AggregationWindowSliding uint8 = 1
+)
+
+// 窗口统计值，上报的属性名为原属性名加统计值后缀，如temperature_avg
+const (
+	AggregateMin   uint8 = 1 << 0 // 后缀_min
+	AggregateMax   uint8 = 1 << 1 // 后缀_max
+	AggregateAvg   uint8 = 1 << 2 // 后缀_avg
+	AggregateCount uint8 = 1 << 3 // 后缀_count
+	AggregateLast  uint8 = 1 << 4 // 后缀_last
+	AggregateAll         = AggregateMin | AggregateMax | AggregateAvg | AggregateCount | AggregateLast
+)
+
+// 默认窗口长度
+const defaultAggregationWindow = time.Minute
+
+type AggregatorConfig struct {
+	WindowType uint8         // 窗口类型，默认滚动窗口
+	Window     time.Duration // 窗口长度，默认1分钟
+	Slide      time.Duration // 滑动窗口的输出间隔，窗口长度不是Slide的整数倍时向上取整
+	Statistics uint8         // 需要上报的统计值，默认上报全部统计值
+}
+
+// 一个时间片内的统计值，滑动窗口由多个时间片组成
+type aggregatePane struct {
+	min      float64
+	max      float64
+	sum      float64
+	count    int
+	last     float64
+	lastTime time.Time
+}
+
+func (pane *aggregatePane) add(value float64, t time.Time) {
+	if pane.count == 0 {
+		pane.min = value
+		pane.max = value
+	} else {
+		pane.min = math.Min(pane.min, value)
+		pane.max = math.Max(pane.max, value)
+	}
+	pane.sum += value
+	pane.count++
+	if pane.count == 1 || !t.Before(pane.lastTime) {
+		pane.last = value
+		pane.lastTime = t
+	}
+}
+
+func (pane *aggregatePane) merge(other *aggregatePane) {
+	if other.count == 0 {
+		return
+	}
+	if pane.count == 0 {
+		*pane = *other
+		return
+	}
+	pane.min = math.Min(pane.min, other.min)
+	pane.max = math.Max(pane.max, other.max)
+	pane.sum += other.sum
+	pane.count += other.count
+	if !other.lastTime.Before(pane.lastTime) {
+		pane.last = other.last
+		pane.lastTime = other.lastTime
+	}
+}
+
+type aggregateKey struct {
+	deviceId     string
+	serviceId    string
+	propertyName string
+}
+
+// 属性窗口聚合器，按照时间窗口统计高频采样的最小值、最大值、平均值、数量和最新值，
+// 窗口结束时将统计值作为属性上报，设备ID为空时上报设备自身属性，否则作为子设备属性批量上报
+type PropertyAggregator struct {
+	device Device
+	config AggregatorConfig
+
+	lock    sync.Mutex
+	panes   map[aggregateKey]map[int64]*aggregatePane // 时间片序号 -> 时间片统计值
+	emitted int64                                     // 已经输出的窗口结束时间片序号
+	running bool
+	stop    chan struct{}
+}
+
+func NewPropertyAggregator(device Device, config AggregatorConfig) *PropertyAggregator {
+	if config.Window <= 0 {
+		config.Window = defaultAggregationWindow
+	}
+	if config.WindowType == AggregationWindowTumbling || config.Slide <= 0 || config.Slide > config.Window {
+		config.Slide = config.Window
+	}
+	if config.Window%config.Slide != 0 {
+		config.Window = (config.Window/config.Slide + 1) * config.Slide
+	}
+	if config.Statistics == 0 {
+		config.Statistics = AggregateAll
+	}
+
+	return &PropertyAggregator{
+		device: device,
+		config: config,
+		panes:  map[aggregateKey]map[int64]*aggregatePane{},
+	}
+}
+
+// 添加一个采样值，t为采样时间。已经输出过的窗口中的采样值被丢弃
+func (aggregator *PropertyAggregator) Add(deviceId, serviceId, propertyName string, value float64, t time.Time) {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+
+	index := aggregator.paneIndex(t)
+	if aggregator.emitted != 0 && index < aggregator.emitted {
+		glog.Warningf("sample of property %s is too late,ignore it", propertyName)
+		return
+	}
+
+	key := aggregateKey{deviceId: deviceId, serviceId: serviceId, propertyName: propertyName}
+	panes, ok := aggregator.panes[key]
+	if !ok {
+		panes = map[int64]*aggregatePane{}
+		aggregator.panes[key] = panes
+	}
+	pane, ok := panes[index]
+	if !ok {
+		pane = &aggregatePane{}
+		panes[index] = pane
+	}
+	pane.add(value, t)
+}
+
+func (aggregator *PropertyAggregator) paneIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(aggregator.config.Slide)
+}
+
+// 按照Slide间隔输出窗口统计值
+func (aggregator *PropertyAggregator) Start() {
+	aggregator.lock.Lock()
+	if aggregator.running {
+		aggregator.lock.Unlock()
+		return
+	}
+	aggregator.running = true
+	aggregator.stop = make(chan struct{})
+	stop := aggregator.stop
+	aggregator.lock.Unlock()
+
+	go func() {
+		slide := aggregator.config.Slide
+		for {
+			// 在时间片边界输出窗口统计值
+			next := time.Unix(0, (time.Now().UnixNano()/int64(slide)+1)*int64(slide))
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case t := <-timer.C:
+				aggregator.emit(t)
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (aggregator *PropertyAggregator) Stop() {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	if !aggregator.running {
+		return
+	}
+	aggregator.running = false
+	close(aggregator.stop)
+}
+
+// 输出在now之前结束的窗口的统计值
+func (aggregator *PropertyAggregator) emit(now time.Time) {
+	devices, end := aggregator.collect(now)
+	if len(devices) == 0 {
+		return
+	}
+
+	eventTime := end.UTC().Format("20060102T150405Z")
+	var deviceIds []string
+	for deviceId := range devices {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	sort.Strings(deviceIds)
+
+	var subDevices []DeviceService
+	for _, deviceId := range deviceIds {
+		var entries []DevicePropertyEntry
+		for serviceId, properties := range devices[deviceId] {
+			entries = append(entries, DevicePropertyEntry{
+				ServiceId:  serviceId,
+				Properties: properties,
+				EventTime:  eventTime,
+			})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].ServiceId < entries[j].ServiceId
+		})
+
+		if len(deviceId) == 0 {
+			if !aggregator.device.ReportProperties(DeviceProperties{Services: entries}) {
+				glog.Warningf("report aggregated properties failed")
+			}
+			continue
+		}
+		subDevices = append(subDevices, DeviceService{
+			DeviceId: deviceId,
+			Services: entries,
+		})
+	}
+
+	if len(subDevices) > 0 {
+		if !aggregator.device.BatchReportSubDevicesProperties(DevicesService{Devices: subDevices}) {
+			glog.Warningf("report aggregated sub devices properties failed")
+		}
+	}
+}
+
+// 计算窗口统计值，返回 deviceId -> serviceId -> 属性统计值 以及窗口结束时间
+func (aggregator *PropertyAggregator) collect(now time.Time) (map[string]map[string]map[string]interface{}, time.Time) {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+
+	slide := int64(aggregator.config.Slide)
+	panesPerWindow := int64(aggregator.config.Window) / slide
+	end := aggregator.paneIndex(now)
+	aggregator.emitted = end
+
+	devices := map[string]map[string]map[string]interface{}{}
+	for key, panes := range aggregator.panes {
+		window := &aggregatePane{}
+		for index, pane := range panes {
+			if index >= end {
+				continue
+			}
+			// 之后的窗口不再需要的时间片
+			if index <= end-panesPerWindow {
+				delete(panes, index)
+			}
+			if index >= end-panesPerWindow {
+				window.merge(pane)
+			}
+		}
+		if len(panes) == 0 {
+			delete(aggregator.panes, key)
+		}
+		if window.count == 0 {
+			continue
+		}
+
+		if _, ok := devices[key.deviceId]; !ok {
+			devices[key.deviceId] = map[string]map[string]interface{}{}
+		}
+		properties, ok := devices[key.deviceId][key.serviceId]
+		if !ok {
+			properties = map[string]interface{}{}
+			devices[key.deviceId][key.serviceId] = properties
+		}
+		aggregator.fill(properties, key.propertyName, window)
+	}
+
+	return devices, time.Unix(0, end*slide)
+}
+
+func (aggregator *PropertyAggregator) fill(properties map[string]interface{}, name string, window *aggregatePane) {
+	statistics := aggregator.config.Statistics
+	if statistics&AggregateMin != 0 {
+		properties[name+"_min"] = window.min
+	}
+	if statistics&AggregateMax != 0 {
+		properties[name+"_max"] = window.max
+	}
+	if statistics&AggregateAvg != 0 {
+		properties[name+"_avg"] = window.sum / float64(window.count)
+	}
+	if statistics&AggregateCount != 0 {
+		properties[name+"_count"] = window.count
+	}
+	if statistics&AggregateLast != 0 {
+		properties[name+"_last"] = window.last
+	}
+}
@@ -0,0 +1,89 @@
+package iot
+
+import (
+	"testing"
+	"time"
+)
+
+var aggregateBegin = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPropertyAggregator_Tumbling(t *testing.T) {
+	device, client := createFakeIotDevice()
+	aggregator := NewPropertyAggregator(device, AggregatorConfig{
+		Window: time.Minute,
+	})
+
+	for i, value := range []float64{3, 1, 5, 2} {
+		aggregator.Add("", "sensor", "temperature", value, aggregateBegin.Add(time.Duration(i)*time.Second))
+	}
+	// 下一个窗口的采样值不参与统计
+	aggregator.Add("", "sensor", "temperature", 100, aggregateBegin.Add(time.Minute))
+
+	aggregator.emit(aggregateBegin.Add(time.Minute))
+
+	properties := DeviceProperties{}
+	if !lastPublished(t, client, formatTopic(PropertiesUpTopic, device.base.Id), &properties) {
+		t.Fatalf("aggregator must report properties")
+	}
+	values := properties.Services[0].Properties.(map[string]interface{})
+	if values["temperature_min"] != 1.0 || values["temperature_max"] != 5.0 ||
+		values["temperature_avg"] != 2.75 || values["temperature_count"] != 4.0 || values["temperature_last"] != 2.0 {
+		t.Errorf("aggregated properties are wrong %s", Interface2JsonString(values))
+	}
+	if properties.Services[0].EventTime != "20210101T000100Z" {
+		t.Errorf("event time must be window end time but is %s", properties.Services[0].EventTime)
+	}
+
+	aggregator.emit(aggregateBegin.Add(2 * time.Minute))
+	if !lastPublished(t, client, formatTopic(PropertiesUpTopic, device.base.Id), &properties) {
+		t.Fatalf("aggregator must report properties")
+	}
+	values = properties.Services[0].Properties.(map[string]interface{})
+	if values["temperature_count"] != 1.0 || values["temperature_last"] != 100.0 {
+		t.Errorf("tumbling window must not contain samples of previous window %s", Interface2JsonString(values))
+	}
+
+	// 已经输出的窗口中的采样值被丢弃
+	aggregator.Add("", "sensor", "temperature", 7, aggregateBegin)
+	if len(aggregator.panes) != 0 {
+		t.Errorf("late sample must be ignored")
+	}
+}
+
+func TestPropertyAggregator_SlidingSubDevice(t *testing.T) {
+	device, client := createFakeIotDevice()
+	aggregator := NewPropertyAggregator(device, AggregatorConfig{
+		WindowType: AggregationWindowSliding,
+		Window:     time.Minute,
+		Slide:      30 * time.Second,
+		Statistics: AggregateCount | AggregateAvg,
+	})
+
+	aggregator.Add("sub-1", "sensor", "humidity", 10, aggregateBegin.Add(10*time.Second))
+	aggregator.Add("sub-1", "sensor", "humidity", 20, aggregateBegin.Add(40*time.Second))
+	aggregator.emit(aggregateBegin.Add(time.Minute))
+
+	topic := formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id)
+	service := DevicesService{}
+	if !lastPublished(t, client, topic, &service) {
+		t.Fatalf("aggregator must report sub device properties")
+	}
+	values := service.Devices[0].Services[0].Properties.(map[string]interface{})
+	if service.Devices[0].DeviceId != "sub-1" || values["humidity_count"] != 2.0 || values["humidity_avg"] != 15.0 {
+		t.Errorf("aggregated sub device properties are wrong %s", Interface2JsonString(service))
+	}
+	if _, ok := values["humidity_min"]; ok {
+		t.Errorf("only configured statistics should be reported")
+	}
+
+	// 滑动窗口包含上一个窗口后半部分的采样值
+	aggregator.Add("sub-1", "sensor", "humidity", 30, aggregateBegin.Add(70*time.Second))
+	aggregator.emit(aggregateBegin.Add(90 * time.Second))
+	if !lastPublished(t, client, topic, &service) {
+		t.Fatalf("aggregator must report sub device properties")
+	}
+	values = service.Devices[0].Services[0].Properties.(map[string]interface{})
+	if values["humidity_count"] != 2.0 || values["humidity_avg"] != 25.0 {
+		t.Errorf("sliding window statistics are wrong %s", Interface2JsonString(values))
+	}
+}
@@ -1,10 +1,10 @@
 package iot
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
-	uuid "github.com/satori/go.uuid"
-	"time"
+	"io"
 )
 
 type AsyncDevice interface {
@@ -12,11 +12,20 @@ type AsyncDevice interface {
 	AsyncGateway
 	SendMessage(message Message) AsyncResult
 	ReportProperties(properties DeviceProperties) AsyncResult
-	BatchReportSubDevicesProperties(service DevicesService) AsyncResult
+	// 不经过属性过滤上报属性，上报成功后同样记录过滤规则的上报值，用于必须送达平台的属性，例如设备影子同步
+	ReportPropertiesUnfiltered(properties DeviceProperties) AsyncResult
+	BackfillProperties(ctx context.Context, samples <-chan PropertySample, config BackfillConfig) AsyncResult
+	BatchReportSubDevicesProperties(service DevicesService) *BatchReportAsyncResult
 	QueryDeviceShadow(query DevicePropertyQueryRequest, handler DevicePropertyQueryResponseHandler) AsyncResult
+	GetShadow(ctx context.Context, serviceId string) *DeviceShadowAsyncResult
 	UploadFile(filename string) AsyncResult
 	DownloadFile(filename string) AsyncResult
+	UploadFrom(ctx context.Context, name string, reader io.Reader, size int64) AsyncResult
+	DownloadTo(ctx context.Context, name string, writer io.Writer) AsyncResult
+	UploadFileMultipart(ctx context.Context, filename string, config MultipartUploadConfig) AsyncResult
 	ReportDeviceInfo(swVersion, fwVersion string) AsyncResult
+	ReportUpgradeProgress(progress UpgradeProgress) AsyncResult
+	ReportVersion() AsyncResult
 	ReportLogs(logs []DeviceLogEntry) AsyncResult
 }
 
@@ -49,10 +58,17 @@ func CreateAsyncIotDeviceWitConfig(config DeviceConfig) *asyncDevice {
 	device.Servers = config.Servers
 	device.messageHandlers = []MessageHandler{}
 
-	device.fileUrls = map[string]string{}
+	device.fileUrls = &fileUrlRequests{}
+	device.shadowQueries = &shadowQueries{}
+	device.propertyFilters = newPropertyFilters()
+	device.subDeviceRouter = &subDeviceRouter{}
+	device.subDeviceRequests = &subDeviceRequests{}
+	device.subDeviceBatcher = &subDeviceBatcher{interval: config.SubDeviceBatchInterval}
 
 	device.qos = config.Qos
 	device.batchSubDeviceSize = config.BatchSubDeviceSize
+	device.maxBatchPayloadSize = config.MaxBatchPayloadSize
+	device.upgradeProgressInterval = config.UpgradeProgressInterval
 
 	result := &asyncDevice{
 		base: device,
@@ -89,14 +105,30 @@ func (device *asyncDevice) SetPropertyQueryHandler(handler DevicePropertyQueryHa
 	device.base.SetPropertyQueryHandler(handler)
 }
 
+func (device *asyncDevice) AddConnectHandler(handler ConnectHandler) {
+	device.base.AddConnectHandler(handler)
+}
+
+func (device *asyncDevice) SetPropertyFilter(serviceId, propertyName string, filter PropertyFilter) {
+	device.base.SetPropertyFilter(serviceId, propertyName, filter)
+}
+
 func (device *asyncDevice) SetSwFwVersionReporter(handler SwFwVersionReporter) {
 	device.base.SetSwFwVersionReporter(handler)
 }
 
+func (device *asyncDevice) SetComponentInventory(inventory *ComponentInventory) {
+	device.base.SetComponentInventory(inventory)
+}
+
 func (device *asyncDevice) SetDeviceUpgradeHandler(handler DeviceUpgradeHandler) {
 	device.base.SetDeviceUpgradeHandler(handler)
 }
 
+func (device *asyncDevice) SetDeviceUpgradeProgressHandler(handler DeviceUpgradeProgressHandler) {
+	device.base.SetDeviceUpgradeProgressHandler(handler)
+}
+
 func (device *asyncDevice) SetDeviceStatusLogCollector(collector DeviceStatusLogCollector) {
 	device.base.SetDeviceStatusLogCollector(collector)
 }
@@ -118,13 +150,9 @@ func (device *asyncDevice) SendMessage(message Message) AsyncResult {
 	go func() {
 		glog.Info("begin async send message")
 
-		messageData := Interface2JsonString(message)
-		topic := formatTopic(MessageUpTopic, device.base.Id)
-		glog.Infof("async send message topic is %s", topic)
-		token := device.base.Client.Publish(topic, device.base.qos, false, messageData)
-		if token.Wait() && token.Error() != nil {
+		if err := device.base.sendMessage(message); err != nil {
 			glog.Warning("async send message failed")
-			asyncResult.completeError(token.Error())
+			asyncResult.completeError(err)
 		} else {
 			asyncResult.completeSuccess()
 		}
@@ -137,10 +165,8 @@ func (device *asyncDevice) ReportProperties(properties DeviceProperties) AsyncRe
 	asyncResult := NewBooleanAsyncResult()
 	go func() {
 		glog.Info("begin to report properties")
-		propertiesData := Interface2JsonString(properties)
-		if token := device.base.Client.Publish(formatTopic(PropertiesUpTopic, device.base.Id), device.base.qos, false, propertiesData); token.Wait() && token.Error() != nil {
-			glog.Warningf("device %s async report properties failed", device.base.Id)
-			asyncResult.completeError(token.Error())
+		if err := device.base.reportProperties(properties); err != nil {
+			asyncResult.completeError(err)
 		} else {
 			asyncResult.completeSuccess()
 		}
@@ -149,40 +175,28 @@ func (device *asyncDevice) ReportProperties(properties DeviceProperties) AsyncRe
 	return asyncResult
 }
 
-func (device *asyncDevice) BatchReportSubDevicesProperties(service DevicesService) AsyncResult {
+func (device *asyncDevice) ReportPropertiesUnfiltered(properties DeviceProperties) AsyncResult {
 	asyncResult := NewBooleanAsyncResult()
-
 	go func() {
-		glog.Info("begin async batch report sub devices properties")
-		subDeviceCounts := len(service.Devices)
-		batchReportSubDeviceProperties := 0
-		if subDeviceCounts%device.base.batchSubDeviceSize == 0 {
-			batchReportSubDeviceProperties = subDeviceCounts / device.base.batchSubDeviceSize
+		glog.Info("begin to report properties without filter")
+		if err := device.base.reportPropertiesUnfiltered(properties); err != nil {
+			asyncResult.completeError(err)
 		} else {
-			batchReportSubDeviceProperties = subDeviceCounts/device.base.batchSubDeviceSize + 1
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		loopResult := true
-		for i := 0; i < batchReportSubDeviceProperties; i++ {
-			begin := i * device.base.batchSubDeviceSize
-			end := (i + 1) * device.base.batchSubDeviceSize
-			if end > subDeviceCounts {
-				end = subDeviceCounts
-			}
-
-			sds := DevicesService{
-				Devices: service.Devices[begin:end],
-			}
-
-			if token := device.base.Client.Publish(formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(sds)); token.Wait() && token.Error() != nil {
-				glog.Warningf("device %s batch report sub device properties failed", device.base.Id)
-				loopResult = false
-				asyncResult.completeError(token.Error())
-				break
-			}
-		}
+	return asyncResult
+}
 
-		if loopResult {
+func (device *asyncDevice) BackfillProperties(ctx context.Context, samples <-chan PropertySample, config BackfillConfig) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
+	go func() {
+		glog.Info("begin to backfill properties")
+		if err := device.base.backfillProperties(ctx, samples, config); err != nil {
+			glog.Warningf("device %s backfill properties failed %v", device.base.Id, err)
+			asyncResult.completeError(err)
+		} else {
 			asyncResult.completeSuccess()
 		}
 	}()
@@ -190,15 +204,23 @@ func (device *asyncDevice) BatchReportSubDevicesProperties(service DevicesServic
 	return asyncResult
 }
 
+func (device *asyncDevice) BatchReportSubDevicesProperties(service DevicesService) *BatchReportAsyncResult {
+	asyncResult := NewBatchReportAsyncResult()
+
+	go func() {
+		glog.Info("begin async batch report sub devices properties")
+		asyncResult.complete(device.base.batchReportSubDevicesProperties(service))
+	}()
+
+	return asyncResult
+}
+
 func (device *asyncDevice) QueryDeviceShadow(query DevicePropertyQueryRequest, handler DevicePropertyQueryResponseHandler) AsyncResult {
-	device.base.propertiesQueryResponseHandler = handler
 	asyncResult := NewBooleanAsyncResult()
 
 	go func() {
-		requestId := uuid.NewV4()
-		if token := device.base.Client.Publish(formatTopic(DeviceShadowQueryRequestTopic, device.base.Id)+requestId.String(), device.base.qos, false, Interface2JsonString(query)); token.Wait() && token.Error() != nil {
-			glog.Warningf("device %s query device shadow data failed,request id = %s", device.base.Id, requestId)
-			asyncResult.completeError(token.Error())
+		if _, err := device.base.queryShadow(query, handler); err != nil {
+			asyncResult.completeError(err)
 		} else {
 			asyncResult.completeSuccess()
 		}
@@ -207,75 +229,52 @@ func (device *asyncDevice) QueryDeviceShadow(query DevicePropertyQueryRequest, h
 	return asyncResult
 }
 
-func (device *asyncDevice) UploadFile(filename string) AsyncResult {
-	asyncResult := NewBooleanAsyncResult()
-	go func() {
-		// 构造获取文件上传URL的请求
-		requestParas := FileRequestServiceEventParas{
-			FileName: filename,
-		}
-
-		serviceEvent := FileRequestServiceEvent{
-			Paras: requestParas,
-		}
-		serviceEvent.ServiceId = "$file_manager"
-		serviceEvent.EventTime = GetEventTimeStamp()
-		serviceEvent.EventType = "get_upload_url"
+func (device *asyncDevice) GetShadow(ctx context.Context, serviceId string) *DeviceShadowAsyncResult {
+	asyncResult := NewDeviceShadowAsyncResult()
 
-		var services []FileRequestServiceEvent
-		services = append(services, serviceEvent)
-		request := FileRequest{
-			Services: services,
+	go func() {
+		response, err := device.base.getShadow(ctx, serviceId)
+		if err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess(response)
 		}
+	}()
 
-		if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-			glog.Warningf("publish file upload request url failed")
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "publish file upload request url failed",
-			})
-			return
-		}
-		glog.Info("publish file upload request url success")
-
-		ticker := time.Tick(time.Second)
-		for {
-			select {
-			case <-ticker:
-				_, ok := device.base.fileUrls[filename+FileActionUpload]
-				if ok {
-					glog.Infof("platform send file upload url success")
-					goto ENDFOR
-				}
+	return asyncResult
+}
 
-			}
+func (device *asyncDevice) UploadFile(filename string) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
+	go func() {
+		if err := device.base.uploadFile(filename); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
-	ENDFOR:
+	}()
 
-		if len(device.base.fileUrls[filename+FileActionUpload]) == 0 {
-			glog.Errorf("get file upload url failed")
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "get file upload url failed",
-			})
-			return
-		}
-		glog.Infof("file upload url is %s", device.base.fileUrls[filename+FileActionUpload])
+	return asyncResult
+}
 
-		//filename = smartFileName(filename)
-		uploadFlag := CreateHttpClient().UploadFile(filename, device.base.fileUrls[filename+FileActionUpload])
-		if !uploadFlag {
-			glog.Errorf("upload file failed")
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "upload file failed",
-			})
-			return
+func (device *asyncDevice) DownloadFile(filename string) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
+	go func() {
+		if err := device.base.downloadFile(filename); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		response := CreateFileUploadDownLoadResultResponse(filename, FileActionUpload, uploadFlag)
+	return asyncResult
+}
 
-		token := device.base.Client.Publish(formatTopic(PlatformEventToDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(response))
-		if token.Wait() && token.Error() != nil {
-			glog.Error("report file upload file result failed")
-			asyncResult.completeError(token.Error())
+func (device *asyncDevice) UploadFrom(ctx context.Context, name string, reader io.Reader, size int64) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
+	go func() {
+		if err := device.base.uploadFrom(ctx, name, reader, size); err != nil {
+			asyncResult.completeError(err)
 		} else {
 			asyncResult.completeSuccess()
 		}
@@ -284,76 +283,55 @@ func (device *asyncDevice) UploadFile(filename string) AsyncResult {
 	return asyncResult
 }
 
-func (device *asyncDevice) DownloadFile(filename string) AsyncResult {
+func (device *asyncDevice) DownloadTo(ctx context.Context, name string, writer io.Writer) AsyncResult {
 	asyncResult := NewBooleanAsyncResult()
 	go func() {
-		// 构造获取文件上传URL的请求
-		requestParas := FileRequestServiceEventParas{
-			FileName: filename,
+		if err := device.base.downloadTo(ctx, name, writer); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		serviceEvent := FileRequestServiceEvent{
-			Paras: requestParas,
-		}
-		serviceEvent.ServiceId = "$file_manager"
-		serviceEvent.EventTime = GetEventTimeStamp()
-		serviceEvent.EventType = "get_download_url"
+	return asyncResult
+}
 
-		var services []FileRequestServiceEvent
-		services = append(services, serviceEvent)
-		request := FileRequest{
-			Services: services,
+func (device *asyncDevice) UploadFileMultipart(ctx context.Context, filename string, config MultipartUploadConfig) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
+	go func() {
+		if err := device.base.uploadFileMultipart(ctx, filename, config); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-			glog.Warningf("publish file download request url failed")
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "publish file download request url failed",
-			})
-			return
-		}
-
-		ticker := time.Tick(time.Second)
-		for {
-			select {
-			case <-ticker:
-				_, ok := device.base.fileUrls[filename+FileActionDownload]
-				if ok {
-					glog.Infof("platform send file upload url success")
-					goto ENDFOR
-				}
+	return asyncResult
+}
 
-			}
-		}
-	ENDFOR:
+func (device *asyncDevice) ReportUpgradeProgress(progress UpgradeProgress) AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
 
-		if len(device.base.fileUrls[filename+FileActionDownload]) == 0 {
-			glog.Errorf("get file download url failed")
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "get file download url failed",
-			})
-			return
+	go func() {
+		if err := device.base.reportUpgradeProgress(progress); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		downloadFlag := CreateHttpClient().DownloadFile(filename, device.base.fileUrls[filename+FileActionDownload])
-		if !downloadFlag {
-			glog.Errorf("down load file { %s } failed", filename)
-			asyncResult.completeError(&DeviceError{
-				errorMsg: "down load file failedd",
-			})
-			return
-		}
+	return asyncResult
+}
 
-		response := CreateFileUploadDownLoadResultResponse(filename, FileActionDownload, downloadFlag)
+func (device *asyncDevice) ReportVersion() AsyncResult {
+	asyncResult := NewBooleanAsyncResult()
 
-		token := device.base.Client.Publish(formatTopic(PlatformEventToDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(response))
-		if token.Wait() && token.Error() != nil {
-			glog.Error("report file upload file result failed")
-			asyncResult.completeError(token.Error())
+	go func() {
+		if err := device.base.reportVersion(); err != nil {
+			asyncResult.completeError(err)
 		} else {
 			asyncResult.completeSuccess()
 		}
-
 	}()
 
 	return asyncResult
@@ -362,24 +340,7 @@ func (device *asyncDevice) DownloadFile(filename string) AsyncResult {
 func (device *asyncDevice) ReportDeviceInfo(swVersion, fwVersion string) AsyncResult {
 	asyncResult := NewBooleanAsyncResult()
 	go func() {
-		event := ReportDeviceInfoServiceEvent{
-			BaseServiceEvent{
-				ServiceId: "$device_info",
-				EventType: "device_info_report",
-				EventTime: GetEventTimeStamp(),
-			},
-			ReportDeviceInfoEventParas{
-				DeviceSdkVersion: SdkInfo()["sdk-version"],
-				SwVersion:        swVersion,
-				FwVersion:        fwVersion,
-			},
-		}
-
-		request := ReportDeviceInfoRequest{
-			ObjectDeviceId: device.base.Id,
-			Services:       []ReportDeviceInfoServiceEvent{event},
-		}
-
+		request := device.base.deviceInfoRequest(swVersion, fwVersion)
 		token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request))
 		if token.Wait() && token.Error() != nil {
 			asyncResult.completeError(token.Error())
@@ -440,52 +401,37 @@ func (device *asyncDevice) SetSubDevicesDeleteHandler(handler SubDevicesDeleteHa
 	device.base.subDevicesDeleteHandler = handler
 }
 
-func (device *asyncDevice) UpdateSubDeviceState(subDevicesStatus SubDevicesStatus) AsyncResult {
-	glog.Infof("begin to update sub-devices status")
-
-	asyncResult := NewBooleanAsyncResult()
+func (device *asyncDevice) SetSubDeviceRegistry(registry *SubDeviceRegistry) {
+	device.base.setSubDeviceRegistry(registry)
+}
 
-	go func() {
-		subDeviceCounts := len(subDevicesStatus.DeviceStatuses)
+func (device *asyncDevice) SubDevice(deviceId string) SubDevice {
+	return device.base.subDevice(deviceId)
+}
 
-		batchUpdateSubDeviceState := 0
-		if subDeviceCounts%device.base.batchSubDeviceSize == 0 {
-			batchUpdateSubDeviceState = subDeviceCounts / device.base.batchSubDeviceSize
-		} else {
-			batchUpdateSubDeviceState = subDeviceCounts/device.base.batchSubDeviceSize + 1
-		}
+func (device *asyncDevice) SubDeviceProduct(productId string) SubDeviceHandlers {
+	return device.base.subDeviceProduct(productId)
+}
 
-		for i := 0; i < batchUpdateSubDeviceState; i++ {
-			begin := i * device.base.batchSubDeviceSize
-			end := (i + 1) * device.base.batchSubDeviceSize
-			if end > subDeviceCounts {
-				end = subDeviceCounts
-			}
+func (device *asyncDevice) SubDeviceFallback() SubDeviceHandlers {
+	return device.base.subDeviceFallback()
+}
 
-			sds := SubDevicesStatus{
-				DeviceStatuses: subDevicesStatus.DeviceStatuses[begin:end],
-			}
+func (device *asyncDevice) AddSubDeviceActivityHandler(handler SubDeviceActivityHandler) {
+	device.base.AddSubDeviceActivityHandler(handler)
+}
 
-			requestEventService := DataEntry{
-				ServiceId: "$sub_device_manager",
-				EventType: "sub_device_update_status",
-				EventTime: GetEventTimeStamp(),
-				Paras:     sds,
-			}
+func (device *asyncDevice) UpdateSubDeviceState(subDevicesStatus SubDevicesStatus) AsyncResult {
+	glog.Infof("begin to update sub-devices status")
 
-			request := Data{
-				ObjectDeviceId: device.base.Id,
-				Services:       []DataEntry{requestEventService},
-			}
+	asyncResult := NewBooleanAsyncResult()
 
-			if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-				glog.Warningf("gateway %s update sub devices status failed", device.base.Id)
-				asyncResult.completeError(token.Error())
-				return
-			}
+	go func() {
+		if err := device.base.updateSubDeviceState(subDevicesStatus); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
-		asyncResult.completeSuccess()
-		glog.Info("gateway  update sub devices status failed", device.base.Id)
 	}()
 
 	return asyncResult
@@ -596,31 +542,66 @@ func (device *asyncDevice) SyncSubDevices(version int) AsyncResult {
 	asyncResult := NewBooleanAsyncResult()
 
 	go func() {
-		syncParas := struct {
-			Version int `json:"version"`
-		}{
-			Version: version,
+		if err := device.base.syncSubDevices(version); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess()
 		}
+	}()
 
-		dataEntry := DataEntry{
-			ServiceId: "$sub_device_manager",
-			EventType: "sub_device_sync_request",
-			EventTime: GetEventTimeStamp(),
-			Paras:     syncParas,
+	return asyncResult
+}
+
+func (device *asyncDevice) AddSubDevicesWithResult(ctx context.Context, deviceInfos []DeviceInfo) *SubDeviceAsyncResult {
+	asyncResult := NewSubDeviceAsyncResult()
+
+	go func() {
+		if result, err := device.base.addSubDevices(ctx, deviceInfos); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess(result)
 		}
+	}()
 
-		var dataEntries []DataEntry
-		dataEntries = append(dataEntries, dataEntry)
+	return asyncResult
+}
 
-		data := Data{
-			Services: dataEntries,
+func (device *asyncDevice) DeleteSubDevicesWithResult(ctx context.Context, deviceIds []string) *SubDeviceAsyncResult {
+	asyncResult := NewSubDeviceAsyncResult()
+
+	go func() {
+		if result, err := device.base.deleteSubDevices(ctx, deviceIds); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess(result)
 		}
+	}()
 
-		if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
-			glog.Errorf("send sync sub device request failed")
-			asyncResult.completeError(token.Error())
+	return asyncResult
+}
+
+func (device *asyncDevice) UpdateSubDeviceStateWithResult(ctx context.Context, subDevicesStatus SubDevicesStatus) *SubDeviceAsyncResult {
+	asyncResult := NewSubDeviceAsyncResult()
+
+	go func() {
+		if result, err := device.base.updateSubDeviceStateWithResult(ctx, subDevicesStatus); err != nil {
+			asyncResult.completeError(err)
 		} else {
-			asyncResult.completeSuccess()
+			asyncResult.completeSuccess(result)
+		}
+	}()
+
+	return asyncResult
+}
+
+func (device *asyncDevice) SyncSubDevicesWithResult(ctx context.Context, version int) *SubDeviceAsyncResult {
+	asyncResult := NewSubDeviceAsyncResult()
+
+	go func() {
+		if result, err := device.base.syncSubDevicesWithResult(ctx, version); err != nil {
+			asyncResult.completeError(err)
+		} else {
+			asyncResult.completeSuccess(result)
 		}
 	}()
 
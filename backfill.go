@@ -0,0 +1,199 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 历史数据补传单次上报的默认最大字节数
+	defaultBackfillMaxPayloadSize = 64 * 1024
+
+	// 历史数据补传默认上报间隔
+	defaultBackfillInterval = time.Second
+
+	// 实时属性上报中时历史数据补传的等待间隔
+	backfillLiveWaitInterval = 10 * time.Millisecond
+
+	// 空属性上报请求 {"services":[]} 的字节数
+	emptyDevicePropertiesSize = 15
+)
+
+// 带有采集时间的历史属性数据
+type PropertySample struct {
+	ServiceId  string
+	Properties interface{}
+	Time       time.Time // 数据采集时间，上报时作为event_time
+}
+
+type BackfillConfig struct {
+	MaxPayloadSize int           // 单次上报的最大字节数，默认64KB
+	Interval       time.Duration // 两次上报之间的最小间隔，默认1秒
+	CheckpointPath string        // 补传进度文件，为空时不记录进度
+}
+
+// 历史数据补传进度
+type BackfillProgress struct {
+	Reported      int64  `json:"reported"`        // 已经上报的样本数量
+	LastEventTime string `json:"last_event_time"` // 最后一个上报样本的采集时间
+}
+
+// 读取补传进度文件，文件不存在时返回空进度
+func LoadBackfillProgress(path string) (BackfillProgress, error) {
+	progress := BackfillProgress{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+
+	err = json.Unmarshal(data, &progress)
+	return progress, err
+}
+
+func saveBackfillProgress(path string, progress BackfillProgress) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(Interface2JsonString(progress)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 按照配置的速率将历史属性打包上报，实时属性上报优先。
+// 配置了进度文件时，每次上报成功后记录进度，重新补传时跳过已经上报的样本，因此samples需要按照相同的顺序提供数据。
+func (device *baseIotDevice) backfillProperties(ctx context.Context, samples <-chan PropertySample, config BackfillConfig) error {
+	if config.MaxPayloadSize <= 0 {
+		config.MaxPayloadSize = defaultBackfillMaxPayloadSize
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultBackfillInterval
+	}
+
+	progress := BackfillProgress{}
+	if len(config.CheckpointPath) != 0 {
+		var err error
+		if progress, err = LoadBackfillProgress(config.CheckpointPath); err != nil {
+			glog.Errorf("device %s load backfill progress failed %v", device.Id, err)
+			return err
+		}
+	}
+	skip := progress.Reported
+
+	var carry *DevicePropertyEntry
+	carrySize := 0
+	closed := false
+	next := time.Now()
+	for !closed || carry != nil {
+		var batch []DevicePropertyEntry
+		size := emptyDevicePropertiesSize
+		if carry != nil {
+			batch = append(batch, *carry)
+			size += carrySize
+			carry = nil
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		expired := false
+		for !closed && carry == nil && !(expired && len(batch) > 0) {
+			var sample PropertySample
+			var ok bool
+			if expired {
+				select {
+				case sample, ok = <-samples:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			} else {
+				select {
+				case sample, ok = <-samples:
+				case <-timer.C:
+					expired = true
+					continue
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+
+			if !ok {
+				closed = true
+				break
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			entry := DevicePropertyEntry{
+				ServiceId:  sample.ServiceId,
+				Properties: sample.Properties,
+				EventTime:  sample.Time.UTC().Format("20060102T150405Z"),
+			}
+			entrySize := len(Interface2JsonString(entry))
+			if emptyDevicePropertiesSize+entrySize > config.MaxPayloadSize {
+				timer.Stop()
+				glog.Errorf("device %s backfill sample size %d exceed max payload size", device.Id, entrySize)
+				return &DeviceError{
+					errorMsg: "backfill sample exceed max payload size",
+				}
+			}
+
+			// 第一个样本之后每个样本前需要一个逗号分隔
+			if len(batch) > 0 {
+				entrySize++
+			}
+			if size+entrySize > config.MaxPayloadSize {
+				carry = &entry
+				carrySize = entrySize - 1
+				break
+			}
+			batch = append(batch, entry)
+			size += entrySize
+		}
+
+		if len(batch) == 0 {
+			timer.Stop()
+			continue
+		}
+
+		if !expired {
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		for atomic.LoadInt32(&device.liveReports) > 0 {
+			select {
+			case <-time.After(backfillLiveWaitInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err := device.publishProperties(DeviceProperties{Services: batch}); err != nil {
+			return err
+		}
+		next = time.Now().Add(config.Interval)
+
+		progress.Reported += int64(len(batch))
+		progress.LastEventTime = batch[len(batch)-1].EventTime
+		if len(config.CheckpointPath) != 0 {
+			if err := saveBackfillProgress(config.CheckpointPath, progress); err != nil {
+				glog.Errorf("device %s save backfill progress failed %v", device.Id, err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createSamples(count int) <-chan PropertySample {
+	samples := make(chan PropertySample, count)
+	begin := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		samples <- PropertySample{
+			ServiceId:  "meter",
+			Properties: map[string]interface{}{"value": i},
+			Time:       begin.Add(time.Duration(i) * time.Minute),
+		}
+	}
+	close(samples)
+	return samples
+}
+
+func reportedProperties(t *testing.T, client *fakeClient, deviceId string) []DeviceProperties {
+	var reports []DeviceProperties
+	for _, message := range client.messages() {
+		if message.topic != formatTopic(PropertiesUpTopic, deviceId) {
+			continue
+		}
+		if len(message.payload) > 400 {
+			t.Errorf("report payload size %d exceed max payload size", len(message.payload))
+		}
+		properties := DeviceProperties{}
+		if err := json.Unmarshal(message.payload, &properties); err != nil {
+			t.Fatalf("unmarshal reported properties failed %v", err)
+		}
+		reports = append(reports, properties)
+	}
+	return reports
+}
+
+func TestBaseIotDevice_BackfillProperties(t *testing.T) {
+	device := createBaseIotDevice()
+	client := &fakeClient{}
+	device.Client = client
+
+	config := BackfillConfig{
+		MaxPayloadSize: 400,
+		Interval:       time.Millisecond,
+	}
+	if err := device.backfillProperties(context.Background(), createSamples(20), config); err != nil {
+		t.Fatalf("backfill properties failed %v", err)
+	}
+
+	reports := reportedProperties(t, client, device.Id)
+	if len(reports) < 2 {
+		t.Fatalf("samples must be split into multiple reports")
+	}
+	total := 0
+	for _, report := range reports {
+		total += len(report.Services)
+	}
+	if total != 20 {
+		t.Errorf("reported samples must be 20 but is %d", total)
+	}
+	if reports[0].Services[0].EventTime != "20210101T000000Z" {
+		t.Errorf("event time must be sample time but is %s", reports[0].Services[0].EventTime)
+	}
+}
+
+func TestBaseIotDevice_BackfillPropertiesCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "progress.json")
+
+	device := createBaseIotDevice()
+	client := &fakeClient{}
+	device.Client = client
+
+	// 模拟上次补传已经上报了15个样本
+	if err := saveBackfillProgress(checkpoint, BackfillProgress{Reported: 15}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := BackfillConfig{
+		MaxPayloadSize: 400,
+		Interval:       time.Millisecond,
+		CheckpointPath: checkpoint,
+	}
+	if err := device.backfillProperties(context.Background(), createSamples(20), config); err != nil {
+		t.Fatalf("backfill properties failed %v", err)
+	}
+
+	total := 0
+	for _, report := range reportedProperties(t, client, device.Id) {
+		total += len(report.Services)
+	}
+	if total != 5 {
+		t.Errorf("reported samples must be 5 but is %d", total)
+	}
+
+	progress, err := LoadBackfillProgress(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Reported != 20 || progress.LastEventTime != "20210101T001900Z" {
+		t.Errorf("backfill progress is wrong %s", Interface2JsonString(progress))
+	}
+}
+
+func TestBaseIotDevice_BackfillPropertiesOversizedSample(t *testing.T) {
+	device := createBaseIotDevice()
+	device.Client = &fakeClient{}
+
+	config := BackfillConfig{
+		MaxPayloadSize: 20,
+		Interval:       time.Millisecond,
+	}
+	if err := device.backfillProperties(context.Background(), createSamples(1), config); err == nil {
+		t.Errorf("oversized sample must return error")
+	}
+}
+
+func TestBaseIotDevice_BackfillPropertiesLivePriority(t *testing.T) {
+	device := createBaseIotDevice()
+	client := &fakeClient{}
+	device.Client = client
+
+	// 模拟实时属性正在上报
+	device.liveReports = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := device.backfillProperties(ctx, createSamples(1), BackfillConfig{Interval: time.Millisecond})
+	if err != context.DeadlineExceeded {
+		t.Errorf("backfill must wait live report,err = %v", err)
+	}
+	if len(client.messages()) != 0 {
+		t.Errorf("backfill must not report when live report in progress")
+	}
+}
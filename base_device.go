@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -72,12 +73,18 @@ type DeviceConfig struct {
 	VerifyTimestamp    bool
 	Servers            string
 	Qos                byte
-	BatchSubDeviceSize int
+	BatchSubDeviceSize int // 网关批量上报子设备属性和更新子设备状态时每批最多包含的子设备数量，默认100
 	AuthType           uint8
 	ServerCaPath       string
 	CertFilePath       string
 	CertKeyFilePath    string
 	UseBootstrap       bool // 使用设备引导功能开关，true-使用，false-不使用
+	// 网关子设备属性合并上报的等待时间，等待期间子设备上报的属性合并为一次批量上报，默认不等待
+	SubDeviceBatchInterval time.Duration
+	// 网关批量上报子设备属性时单条消息编码后的最大字节数，默认1MB
+	MaxBatchPayloadSize int
+	// 升级过程中两次上报升级进度的最小间隔，默认1秒，最终的升级状态不受限制
+	UpgradeProgressInterval time.Duration
 }
 
 type BaseDevice interface {
@@ -90,7 +97,11 @@ type BaseDevice interface {
 	AddPropertiesSetHandler(handler DevicePropertiesSetHandler)
 	SetPropertyQueryHandler(handler DevicePropertyQueryHandler)
 	SetSwFwVersionReporter(handler SwFwVersionReporter)
+	SetComponentInventory(inventory *ComponentInventory)
 	SetDeviceUpgradeHandler(handler DeviceUpgradeHandler)
+	SetDeviceUpgradeProgressHandler(handler DeviceUpgradeProgressHandler)
+	AddConnectHandler(handler ConnectHandler)
+	SetPropertyFilter(serviceId, propertyName string, filter PropertyFilter)
 
 	SetDeviceStatusLogCollector(collector DeviceStatusLogCollector)
 	SetDevicePropertyLogCollector(collector DevicePropertyLogCollector)
@@ -129,33 +140,46 @@ func (lcc *LogCollectionConfig) getEndTime() string {
 }
 
 type baseIotDevice struct {
-	Id                             string // 设备Id，平台又称为deviceId
-	Password                       string // 设备密码
-	VerifyTimestamp                bool
-	AuthType                       uint8  // 鉴权类型，0：密码认证；1：x.509证书认证
-	ServerCaPath                   string // 平台CA证书
-	CertFilePath                   string // 设备证书路径
-	CertKeyFilePath                string // 设备证书key路径
-	Servers                        string
-	Client                         mqtt.Client
-	commandHandler                 CommandHandler
-	messageHandlers                []MessageHandler
-	propertiesSetHandlers          []DevicePropertiesSetHandler
-	propertyQueryHandler           DevicePropertyQueryHandler
-	propertiesQueryResponseHandler DevicePropertyQueryResponseHandler
-	subDevicesAddHandler           SubDevicesAddHandler
-	subDevicesDeleteHandler        SubDevicesDeleteHandler
-	swFwVersionReporter            SwFwVersionReporter
-	deviceUpgradeHandler           DeviceUpgradeHandler
-	fileUrls                       map[string]string
-	qos                            byte
-	batchSubDeviceSize             int
-	lcc                            *LogCollectionConfig
-	deviceStatusLogCollector       DeviceStatusLogCollector
-	devicePropertyLogCollector     DevicePropertyLogCollector
-	deviceMessageLogCollector      DeviceMessageLogCollector
-	deviceCommandLogCollector      DeviceCommandLogCollector
-	useBootstrap                   bool
+	Id                         string // 设备Id，平台又称为deviceId
+	Password                   string // 设备密码
+	VerifyTimestamp            bool
+	AuthType                   uint8  // 鉴权类型，0：密码认证；1：x.509证书认证
+	ServerCaPath               string // 平台CA证书
+	CertFilePath               string // 设备证书路径
+	CertKeyFilePath            string // 设备证书key路径
+	Servers                    string
+	Client                     mqtt.Client
+	commandHandler             CommandHandler
+	messageHandlers            []MessageHandler
+	propertiesSetHandlers      []DevicePropertiesSetHandler
+	propertyQueryHandler       DevicePropertyQueryHandler
+	shadowQueries              *shadowQueries
+	subDevicesAddHandler       SubDevicesAddHandler
+	subDevicesDeleteHandler    SubDevicesDeleteHandler
+	subDeviceRegistry          *SubDeviceRegistry
+	subDeviceRouter            *subDeviceRouter
+	subDeviceBatcher           *subDeviceBatcher
+	subDeviceRequests          *subDeviceRequests
+	subDeviceActivityHandlers  []SubDeviceActivityHandler
+	swFwVersionReporter        SwFwVersionReporter
+	componentInventory         *ComponentInventory
+	deviceUpgradeHandler       DeviceUpgradeHandler
+	upgradeProgressHandler     DeviceUpgradeProgressHandler
+	upgradeProgressInterval    time.Duration
+	fileUrls                   *fileUrlRequests
+	qos                        byte
+	batchSubDeviceSize         int
+	maxBatchPayloadSize        int
+	lcc                        *LogCollectionConfig
+	deviceStatusLogCollector   DeviceStatusLogCollector
+	devicePropertyLogCollector DevicePropertyLogCollector
+	deviceMessageLogCollector  DeviceMessageLogCollector
+	deviceCommandLogCollector  DeviceCommandLogCollector
+	useBootstrap               bool
+	connectHandlers            []ConnectHandler
+	connectCount               int32
+	liveReports                int32 // 正在上报的实时属性数量，历史数据补传时优先上报实时属性
+	propertyFilters            *propertyFilters
 }
 
 func (device *baseIotDevice) DisConnect() {
@@ -197,6 +221,12 @@ func (device *baseIotDevice) Init() bool {
 	options.SetAutoReconnect(true)
 	options.SetConnectRetry(true)
 	options.SetConnectTimeout(2 * time.Second)
+	options.SetOnConnectHandler(func(client mqtt.Client) {
+		// 首次连接由Init通知，这里只处理重连
+		if atomic.AddInt32(&device.connectCount, 1) > 1 {
+			device.notifyConnectHandlers()
+		}
+	})
 	if strings.Contains(device.Servers, "tls") || strings.Contains(device.Servers, "ssl") {
 		glog.Infof("server support tls connection")
 
@@ -264,6 +294,7 @@ func (device *baseIotDevice) Init() bool {
 	}
 
 	device.subscribeDefaultTopics()
+	device.notifyConnectHandlers()
 
 	go logFlush()
 
@@ -290,14 +321,53 @@ func (device *baseIotDevice) AddPropertiesSetHandler(handler DevicePropertiesSet
 	}
 	device.propertiesSetHandlers = append(device.propertiesSetHandlers, handler)
 }
+func (device *baseIotDevice) AddConnectHandler(handler ConnectHandler) {
+	if handler == nil {
+		return
+	}
+	device.connectHandlers = append(device.connectHandlers, handler)
+}
+
+func (device *baseIotDevice) AddSubDeviceActivityHandler(handler SubDeviceActivityHandler) {
+	if handler == nil {
+		return
+	}
+	device.subDeviceActivityHandlers = append(device.subDeviceActivityHandlers, handler)
+}
+
+func (device *baseIotDevice) notifySubDeviceActivity(deviceId string) {
+	for _, handler := range device.subDeviceActivityHandlers {
+		handler(deviceId)
+	}
+}
+
+func (device *baseIotDevice) notifyConnectHandlers() {
+	for _, handler := range device.connectHandlers {
+		go handler()
+	}
+}
+
+func (device *baseIotDevice) SetPropertyFilter(serviceId, propertyName string, filter PropertyFilter) {
+	device.propertyFilters.set(serviceId, propertyName, filter)
+}
+
 func (device *baseIotDevice) SetSwFwVersionReporter(handler SwFwVersionReporter) {
 	device.swFwVersionReporter = handler
 }
 
+// 设置组件清单后上报软固件版本和设备信息时携带各组件的版本，未设置软固件版本上报函数时使用清单中的软固件版本
+func (device *baseIotDevice) SetComponentInventory(inventory *ComponentInventory) {
+	device.componentInventory = inventory
+}
+
 func (device *baseIotDevice) SetDeviceUpgradeHandler(handler DeviceUpgradeHandler) {
 	device.deviceUpgradeHandler = handler
 }
 
+func (device *baseIotDevice) SetDeviceUpgradeProgressHandler(handler DeviceUpgradeProgressHandler) {
+	device.upgradeProgressHandler = handler
+}
+
 func (device *baseIotDevice) SetPropertyQueryHandler(handler DevicePropertyQueryHandler) {
 	device.propertyQueryHandler = handler
 }
@@ -350,7 +420,14 @@ func (device *baseIotDevice) createCommandMqttHandler() func(client mqtt.Client,
 				glog.Warningf("unmarshal platform command failed,device id = %s，message = %s", device.Id, message)
 			}
 
-			flag, response := device.commandHandler(*command)
+			handler := device.getCommandHandler(*command)
+			if handler == nil {
+				glog.Warningf("device %s has no command handler for %s", device.Id, command.ObjectDeviceId)
+				handler = func(Command) (bool, interface{}) {
+					return false, nil
+				}
+			}
+			flag, response := handler(*command)
 			var res string
 			if flag {
 				glog.Infof("device %s handle command success", device.Id)
@@ -384,7 +461,7 @@ func (device *baseIotDevice) createPropertiesSetMqttHandler() func(client mqtt.C
 			}
 
 			handleFlag := true
-			for _, handler := range device.propertiesSetHandlers {
+			for _, handler := range device.getPropertiesSetHandlers(*propertiesSetRequest) {
 				handleFlag = handleFlag && handler(*propertiesSetRequest)
 			}
 
@@ -419,7 +496,7 @@ func (device *baseIotDevice) createMessageMqttHandler() func(client mqtt.Client,
 				glog.Warningf("unmarshal device message failed,device id = %s,message = %s", device.Id, message)
 			}
 
-			for _, handler := range device.messageHandlers {
+			for _, handler := range device.getMessageHandlers(*msg) {
 				handler(*msg)
 			}
 		}()
@@ -436,7 +513,12 @@ func (device *baseIotDevice) createPropertiesQueryMqttHandler() func(client mqtt
 				glog.Warningf("device %s unmarshal properties query request failed %s", device.Id, message)
 			}
 
-			queryResult := device.propertyQueryHandler(*propertiesQueryRequest)
+			handler := device.getPropertyQueryHandler(*propertiesQueryRequest)
+			if handler == nil {
+				glog.Warningf("device %s has no property query handler for %s", device.Id, propertiesQueryRequest.ObjectDeviceId)
+				return
+			}
+			queryResult := handler(*propertiesQueryRequest)
 			responseToPlatform := Interface2JsonString(queryResult)
 			if token := device.Client.Publish(formatTopic(PropertiesQueryResponseTopic, device.Id)+getTopicRequestId(message.Topic()), device.qos, false, responseToPlatform); token.Wait() && token.Error() != nil {
 				glog.Warningf("device %s send properties query response failed.", device.Id)
@@ -447,18 +529,6 @@ func (device *baseIotDevice) createPropertiesQueryMqttHandler() func(client mqtt
 	return propertiesQueryHandler
 }
 
-func (device *baseIotDevice) createPropertiesQueryResponseMqttHandler() func(client mqtt.Client, message mqtt.Message) {
-	propertiesQueryResponseHandler := func(client mqtt.Client, message mqtt.Message) {
-		propertiesQueryResponse := &DevicePropertyQueryResponse{}
-		if json.Unmarshal(message.Payload(), propertiesQueryResponse) != nil {
-			glog.Warningf("device %s unmarshal property response failed,message %s", device.Id, Interface2JsonString(message))
-		}
-		device.propertiesQueryResponseHandler(*propertiesQueryResponse)
-	}
-
-	return propertiesQueryResponseHandler
-}
-
 func (device *baseIotDevice) subscribeDefaultTopics() {
 	// 订阅平台命令下发topic
 	topic := formatTopic(CommandDownTopic, device.Id)
@@ -523,13 +593,40 @@ func (device *baseIotDevice) handlePlatformToDeviceData() func(client mqtt.Clien
 				if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), subDeviceInfo) != nil {
 					continue
 				}
-				device.subDevicesAddHandler(*subDeviceInfo)
+				device.subDeviceRouter.addDevices(subDeviceInfo.Devices)
+				if device.subDeviceRegistry != nil {
+					if err := device.subDeviceRegistry.add(*subDeviceInfo); err != nil {
+						glog.Errorf("gateway %s save added sub devices failed %v", device.Id, err)
+					}
+				}
+				if device.subDevicesAddHandler != nil {
+					device.subDevicesAddHandler(*subDeviceInfo)
+				}
+			case "sub_device_sync_response":
+				// 网关同步子设备列表，本地列表与平台返回的列表保持一致
+				subDeviceInfo := &SubDeviceInfo{}
+				if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), subDeviceInfo) != nil {
+					continue
+				}
+				device.syncSubDeviceList(*subDeviceInfo)
+				device.handleSubDeviceResponse(entry)
 			case "delete_sub_device_notify":
 				subDeviceInfo := &SubDeviceInfo{}
 				if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), subDeviceInfo) != nil {
 					continue
 				}
-				device.subDevicesDeleteHandler(*subDeviceInfo)
+				device.subDeviceRouter.removeDevices(subDeviceInfo.Devices)
+				if device.subDeviceRegistry != nil {
+					if err := device.subDeviceRegistry.remove(*subDeviceInfo); err != nil {
+						glog.Errorf("gateway %s save deleted sub devices failed %v", device.Id, err)
+					}
+				}
+				if device.subDevicesDeleteHandler != nil {
+					device.subDevicesDeleteHandler(*subDeviceInfo)
+				}
+			case "add_sub_device_response", "delete_sub_device_response", "sub_device_update_status_response":
+				// 网关新增、删除子设备和更新子设备状态请求的响应
+				device.handleSubDeviceResponse(entry)
 
 			case "get_upload_url_response":
 				//获取文件上传URL
@@ -537,16 +634,22 @@ func (device *baseIotDevice) handlePlatformToDeviceData() func(client mqtt.Clien
 				if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), fileResponse) != nil {
 					continue
 				}
-				device.fileUrls[fileResponse.ObjectName+FileActionUpload] = fileResponse.Url
+				if !device.fileUrls.complete(fileResponse.ObjectName+FileActionUpload, fileResponse.Url) {
+					glog.Warningf("device %s receive upload url of file %s without request", device.Id, fileResponse.ObjectName)
+				}
 			case "get_download_url_response":
 				fileResponse := &FileResponseServiceEventParas{}
 				if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), fileResponse) != nil {
 					continue
 				}
-				device.fileUrls[fileResponse.ObjectName+FileActionDownload] = fileResponse.Url
+				if !device.fileUrls.complete(fileResponse.ObjectName+FileActionDownload, fileResponse.Url) {
+					glog.Warningf("device %s receive download url of file %s without request", device.Id, fileResponse.ObjectName)
+				}
 			case "version_query":
 				// 查询软固件版本
-				device.reportVersion()
+				if err := device.reportVersion(); err != nil {
+					glog.Warningf("device %s report version failed %v", device.Id, err)
+				}
 
 			case "firmware_upgrade":
 				upgradeInfo := &UpgradeInfo{}
@@ -666,18 +769,24 @@ func (device *baseIotDevice) reportLogs(logs []DeviceLogEntry) {
 	device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), 0, false, reportedLog)
 }
 
-func (device *baseIotDevice) reportVersion() {
-	sw, fw := device.swFwVersionReporter()
+// 上报软固件版本
+func (device *baseIotDevice) reportVersion() error {
+	if device.swFwVersionReporter == nil && device.componentInventory == nil {
+		return &DeviceError{errorMsg: "sw fw version reporter is not set"}
+	}
+	sw, fw, components := device.versions()
 	dataEntry := DataEntry{
 		ServiceId: "$ota",
 		EventType: "version_report",
 		EventTime: GetEventTimeStamp(),
 		Paras: struct {
-			SwVersion string `json:"sw_version"`
-			FwVersion string `json:"fw_version"`
+			SwVersion  string             `json:"sw_version"`
+			FwVersion  string             `json:"fw_version"`
+			Components []ComponentVersion `json:"components,omitempty"`
 		}{
-			SwVersion: sw,
-			FwVersion: fw,
+			SwVersion:  sw,
+			FwVersion:  fw,
+			Components: components,
 		},
 	}
 	data := Data{
@@ -685,11 +794,329 @@ func (device *baseIotDevice) reportVersion() {
 		Services:       []DataEntry{dataEntry},
 	}
 
-	device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(data))
+	if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// 设备的软固件版本和组件版本，优先使用软固件版本上报函数
+func (device *baseIotDevice) versions() (string, string, []ComponentVersion) {
+	var sw, fw string
+	var components []ComponentVersion
+	if device.componentInventory != nil {
+		components = device.componentInventory.Versions()
+		sw, fw = device.componentInventory.SwFwVersion()
+	}
+	if device.swFwVersionReporter != nil {
+		sw, fw = device.swFwVersionReporter()
+	}
+	return sw, fw, components
+}
+
+// 设备信息上报请求，设置组件清单时携带各组件的版本，未指定的软固件版本使用清单中的版本
+func (device *baseIotDevice) deviceInfoRequest(swVersion, fwVersion string) ReportDeviceInfoRequest {
+	paras := ReportDeviceInfoEventParas{
+		DeviceSdkVersion: SdkInfo()["sdk-version"],
+		SwVersion:        swVersion,
+		FwVersion:        fwVersion,
+	}
+	if device.componentInventory != nil {
+		paras.Components = device.componentInventory.Versions()
+		sw, fw := device.componentInventory.SwFwVersion()
+		if len(paras.SwVersion) == 0 {
+			paras.SwVersion = sw
+		}
+		if len(paras.FwVersion) == 0 {
+			paras.FwVersion = fw
+		}
+	}
+
+	event := ReportDeviceInfoServiceEvent{
+		BaseServiceEvent{
+			ServiceId: "$device_info",
+			EventType: "device_info_report",
+			EventTime: GetEventTimeStamp(),
+		},
+		paras,
+	}
+	return ReportDeviceInfoRequest{
+		ObjectDeviceId: device.Id,
+		Services:       []ReportDeviceInfoServiceEvent{event},
+	}
+}
+
+// 设置网关本地子设备列表，每次连接平台后使用本地版本号同步子设备列表
+func (device *baseIotDevice) setSubDeviceRegistry(registry *SubDeviceRegistry) {
+	if device.subDeviceRegistry == nil {
+		device.AddConnectHandler(func() {
+			if err := device.syncSubDevices(device.subDeviceRegistry.Version()); err != nil {
+				glog.Warningf("gateway %s sync sub devices failed %v", device.Id, err)
+			}
+		})
+	}
+	device.subDeviceRegistry = registry
+	device.subDeviceRouter.addDevices(registry.List())
+}
+
+// 处理平台的子设备同步响应，本地列表中平台已经删除的子设备按照删除通知处理
+func (device *baseIotDevice) syncSubDeviceList(info SubDeviceInfo) {
+	device.subDeviceRouter.addDevices(info.Devices)
+	if device.subDeviceRegistry != nil {
+		removed, err := device.subDeviceRegistry.sync(info)
+		if err != nil {
+			glog.Errorf("gateway %s save synced sub devices failed %v", device.Id, err)
+		}
+		if len(removed) > 0 {
+			device.subDeviceRouter.removeDevices(removed)
+			if device.subDevicesDeleteHandler != nil {
+				device.subDevicesDeleteHandler(SubDeviceInfo{Devices: removed, Version: info.Version})
+			}
+		}
+	}
+	if device.subDevicesAddHandler != nil {
+		device.subDevicesAddHandler(info)
+	}
+}
+
+// 网关同步特定版本之后的子设备列表
+func (device *baseIotDevice) syncSubDevices(version int) error {
+	syncParas := struct {
+		Version int `json:"version"`
+	}{
+		Version: version,
+	}
+
+	dataEntry := DataEntry{
+		ServiceId: "$sub_device_manager",
+		EventType: "sub_device_sync_request",
+		EventTime: GetEventTimeStamp(),
+		Paras:     syncParas,
+	}
+
+	data := Data{
+		Services: []DataEntry{dataEntry},
+	}
+
+	if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
+		glog.Errorf("send sync sub device request failed")
+		return token.Error()
+	}
+	return nil
+}
+
+// 每批最多处理的子设备数量，没有设置时使用默认值
+func (device *baseIotDevice) subDeviceBatchSize() int {
+	if device.batchSubDeviceSize <= 0 {
+		return defaultBatchSubDeviceSize
+	}
+	return device.batchSubDeviceSize
+}
+
+// 网关更新子设备状态，每批最多更新batchSubDeviceSize个子设备
+func (device *baseIotDevice) updateSubDeviceState(subDevicesStatus SubDevicesStatus) error {
+	subDeviceCounts := len(subDevicesStatus.DeviceStatuses)
+	batchSize := device.subDeviceBatchSize()
+
+	for begin := 0; begin < subDeviceCounts; begin += batchSize {
+		end := begin + batchSize
+		if end > subDeviceCounts {
+			end = subDeviceCounts
+		}
+
+		sds := SubDevicesStatus{
+			DeviceStatuses: subDevicesStatus.DeviceStatuses[begin:end],
+		}
+
+		requestEventService := DataEntry{
+			ServiceId: "$sub_device_manager",
+			EventType: "sub_device_update_status",
+			EventTime: GetEventTimeStamp(),
+			Paras:     sds,
+		}
+
+		request := Data{
+			ObjectDeviceId: device.Id,
+			Services:       []DataEntry{requestEventService},
+		}
+
+		if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
+			glog.Warningf("gateway %s update sub devices status failed", device.Id)
+			return token.Error()
+		}
+
+		if device.subDeviceRegistry != nil {
+			if err := device.subDeviceRegistry.updateStatus(sds.DeviceStatuses); err != nil {
+				glog.Errorf("gateway %s save sub devices status failed %v", device.Id, err)
+			}
+		}
+	}
+
+	glog.Infof("gateway %s update sub devices status success", device.Id)
+	return nil
 }
 
+// 上报设备实时属性
+func (device *baseIotDevice) reportProperties(properties DeviceProperties) error {
+	atomic.AddInt32(&device.liveReports, 1)
+	defer atomic.AddInt32(&device.liveReports, -1)
+
+	services, commit := device.propertyFilters.filter(device.Id, properties.Services)
+	if len(services) == 0 {
+		glog.Infof("device %s properties filtered,no need to report", device.Id)
+		return nil
+	}
+
+	if err := device.publishProperties(DeviceProperties{Services: services}); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// 不经过属性过滤直接上报设备属性，用于必须送达平台的上报，例如设备影子同步后上报设备已经应用的值
+func (device *baseIotDevice) reportPropertiesUnfiltered(properties DeviceProperties) error {
+	atomic.AddInt32(&device.liveReports, 1)
+	defer atomic.AddInt32(&device.liveReports, -1)
+
+	commit := device.propertyFilters.pass(device.Id, properties.Services)
+	if err := device.publishProperties(properties); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// 网关批量上报子设备属性，每批最多上报batchSubDeviceSize个子设备并且消息不超过maxBatchPayloadSize字节。
+// 某一批上报失败时继续上报其余批次，上报成功的批次记录过滤器的上报值，返回每一批的结果以及第一个失败的原因
+func (device *baseIotDevice) batchReportSubDevicesProperties(devicesService DevicesService) ([]BatchReportResult, error) {
+	service, commits := device.filterDevicesService(devicesService)
+	batches, results := splitDevicesService(service.Devices, device.subDeviceBatchSize(), device.maxBatchPayloadSize)
+	for _, result := range results {
+		glog.Warningf("device %s batch report sub device properties failed %v", device.Id, result.Err)
+	}
+
+	// 被过滤掉全部属性的子设备同样有活动，其余子设备在所在批次上报成功后才有活动
+	active := map[string]bool{}
+	for _, deviceService := range devicesService.Devices {
+		active[deviceService.DeviceId] = true
+	}
+	for _, deviceService := range service.Devices {
+		active[deviceService.DeviceId] = false
+	}
+
+	for _, batch := range batches {
+		payload := Interface2JsonString(DevicesService{Devices: batch})
+		result := BatchReportResult{Size: len(payload)}
+		for _, deviceService := range batch {
+			result.DeviceIds = append(result.DeviceIds, deviceService.DeviceId)
+		}
+
+		if token := device.Client.Publish(formatTopic(GatewayBatchReportSubDeviceTopic, device.Id), device.qos, false, payload); token.Wait() && token.Error() != nil {
+			glog.Warningf("device %s batch report sub device properties failed", device.Id)
+			result.Err = token.Error()
+		} else {
+			for _, deviceId := range result.DeviceIds {
+				commits[deviceId]()
+				active[deviceId] = true
+			}
+		}
+		results = append(results, result)
+	}
+
+	for _, deviceService := range devicesService.Devices {
+		if active[deviceService.DeviceId] {
+			device.notifySubDeviceActivity(deviceService.DeviceId)
+			active[deviceService.DeviceId] = false
+		}
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, result.Err
+		}
+	}
+	return results, nil
+}
+
+// 过滤子设备属性，返回需要上报的子设备属性以及每个子设备上报成功后记录上报值的函数
+func (device *baseIotDevice) filterDevicesService(service DevicesService) (DevicesService, map[string]func()) {
+	result := DevicesService{}
+	commits := map[string]func(){}
+	for _, deviceService := range service.Devices {
+		services, commit := device.propertyFilters.filter(deviceService.DeviceId, deviceService.Services)
+		if previous, ok := commits[deviceService.DeviceId]; ok {
+			commits[deviceService.DeviceId] = func() {
+				previous()
+				commit()
+			}
+		} else {
+			commits[deviceService.DeviceId] = commit
+		}
+		if len(services) == 0 {
+			continue
+		}
+		result.Devices = append(result.Devices, DeviceService{
+			DeviceId: deviceService.DeviceId,
+			Services: services,
+		})
+	}
+
+	return result, commits
+}
+
+// 上报消息，消息的object_device_id为子设备时记录子设备活动
+func (device *baseIotDevice) sendMessage(message Message) error {
+	messageData := Interface2JsonString(message)
+	if token := device.Client.Publish(formatTopic(MessageUpTopic, device.Id), device.qos, false, messageData); token.Wait() && token.Error() != nil {
+		glog.Warningf("device %s send message failed", device.Id)
+		return token.Error()
+	}
+
+	if len(message.ObjectDeviceId) > 0 && message.ObjectDeviceId != device.Id {
+		device.notifySubDeviceActivity(message.ObjectDeviceId)
+	}
+	return nil
+}
+
+func (device *baseIotDevice) publishProperties(properties DeviceProperties) error {
+	propertiesData := Interface2JsonString(properties)
+	if token := device.Client.Publish(formatTopic(PropertiesUpTopic, device.Id), device.qos, false, propertiesData); token.Wait() && token.Error() != nil {
+		glog.Warningf("device %s report properties failed", device.Id)
+		return token.Error()
+	}
+	return nil
+}
+
+// 执行软固件升级，优先使用可以多次上报进度的升级处理函数，该函数在单独的goroutine中执行
 func (device *baseIotDevice) upgradeDevice(upgradeType byte, upgradeInfo *UpgradeInfo) {
+	if handler := device.upgradeProgressHandler; handler != nil {
+		reporter := newUpgradeProgressReporter(device, upgradeType)
+		go func() {
+			progress := handler(upgradeType, *upgradeInfo, reporter)
+			if progress.ResultCode == upgradeCodeSuperseded {
+				reporter.discard()
+				return
+			}
+			if err := reporter.finish(progress); err != nil {
+				glog.Errorf("device %s upgrade failed,type %d", device.Id, upgradeType)
+			}
+		}()
+		return
+	}
+
+	if device.deviceUpgradeHandler == nil {
+		glog.Warningf("device %s has no upgrade handler,ignore upgrade to version %s", device.Id, upgradeInfo.Version)
+		return
+	}
 	progress := device.deviceUpgradeHandler(upgradeType, *upgradeInfo)
+	if err := device.reportUpgradeProgress(progress); err != nil {
+		glog.Errorf("device %s upgrade failed,type %d", device.Id, upgradeType)
+	}
+}
+
+// 上报软固件升级状态
+func (device *baseIotDevice) reportUpgradeProgress(progress UpgradeProgress) error {
 	dataEntry := DataEntry{
 		ServiceId: "$ota",
 		EventType: "upgrade_progress_report",
@@ -702,6 +1129,7 @@ func (device *baseIotDevice) upgradeDevice(upgradeType byte, upgradeInfo *Upgrad
 	}
 
 	if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
-		glog.Errorf("device %s upgrade failed,type %d", device.Id, upgradeType)
+		return token.Error()
 	}
+	return nil
 }
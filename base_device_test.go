@@ -53,11 +53,11 @@ func TestBaseIotDevice_AddMessageHandler(t *testing.T) {
 func TestBaseIotDevice_AddCommandHandler(t *testing.T) {
 	device := createBaseIotDevice()
 
-	device.AddCommandHandler(func(command Command) bool {
-		return true
+	device.AddCommandHandler(func(command Command) (bool, interface{}) {
+		return true, nil
 	})
 
-	if len(device.commandHandler) == 0 {
+	if device.commandHandler == nil {
 		t.Errorf("add command handlers failed")
 	}
 }
@@ -117,9 +117,13 @@ func createBaseIotDevice() baseIotDevice {
 	device.Password = devicePwd
 	device.Servers = server
 	device.messageHandlers = []MessageHandler{}
-	device.commandHandler = []CommandHandler{}
 
-	device.fileUrls = map[string]string{}
+	device.fileUrls = &fileUrlRequests{}
+	device.shadowQueries = &shadowQueries{}
+	device.propertyFilters = newPropertyFilters()
+	device.subDeviceRouter = &subDeviceRouter{}
+	device.subDeviceRequests = &subDeviceRequests{}
+	device.subDeviceBatcher = &subDeviceBatcher{}
 
 	device.qos = qos
 	device.batchSubDeviceSize = 10
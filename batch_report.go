@@ -0,0 +1,103 @@
+package iot
+
+import (
+	"fmt"
+)
+
+const (
+	defaultBatchSubDeviceSize  = 100
+	defaultMaxBatchPayloadSize = 1024 * 1024
+)
+
+// 一批子设备属性的上报结果
+type BatchReportResult struct {
+	DeviceIds []string // 本批上报的子设备
+	Size      int      // 本批消息编码后的字节数
+	Err       error    // 上报失败的原因，为nil时上报成功
+}
+
+// 单个子设备的属性编码后超过一条消息的最大字节数，无法上报
+type SubDevicePayloadTooLargeError struct {
+	DeviceId string
+	Size     int
+	Limit    int
+}
+
+func (err *SubDevicePayloadTooLargeError) Error() string {
+	return fmt.Sprintf("properties of sub device %s encoded to %d bytes,exceed batch payload limit %d bytes",
+		err.DeviceId, err.Size, err.Limit)
+}
+
+// 批量上报子设备属性的异步结果，每一批的结果在Wait返回后有效
+type BatchReportAsyncResult struct {
+	baseAsyncResult
+	results []BatchReportResult
+}
+
+func (result *BatchReportAsyncResult) Results() []BatchReportResult {
+	result.m.RLock()
+	defer result.m.RUnlock()
+	return result.results
+}
+
+func (result *BatchReportAsyncResult) complete(results []BatchReportResult, err error) {
+	result.m.Lock()
+	defer result.m.Unlock()
+	result.results = results
+	result.err = err
+	result.flowComplete()
+}
+
+func NewBatchReportAsyncResult() *BatchReportAsyncResult {
+	return &BatchReportAsyncResult{
+		baseAsyncResult: baseAsyncResult{
+			complete: make(chan struct{}),
+		},
+	}
+}
+
+// 按照设备数量和消息编码后的字节数将子设备属性分批，每批不超过maxCount个子设备并且编码后不超过maxSize字节。
+// 单个子设备超过maxSize时不能上报，返回对应的错误
+func splitDevicesService(devices []DeviceService, maxCount, maxSize int) ([][]DeviceService, []BatchReportResult) {
+	if maxCount <= 0 {
+		maxCount = defaultBatchSubDeviceSize
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchPayloadSize
+	}
+	envelope := len(Interface2JsonString(DevicesService{Devices: []DeviceService{}}))
+
+	var batches [][]DeviceService
+	var oversized []BatchReportResult
+	var batch []DeviceService
+	size := envelope
+	for _, device := range devices {
+		entrySize := len(Interface2JsonString(device))
+		if envelope+entrySize > maxSize {
+			oversized = append(oversized, BatchReportResult{
+				DeviceIds: []string{device.DeviceId},
+				Size:      envelope + entrySize,
+				Err:       &SubDevicePayloadTooLargeError{DeviceId: device.DeviceId, Size: envelope + entrySize, Limit: maxSize},
+			})
+			continue
+		}
+
+		// 除第一个子设备外每个子设备需要一个逗号分隔
+		if len(batch) > 0 {
+			entrySize++
+		}
+		if len(batch) == maxCount || size+entrySize > maxSize {
+			batches = append(batches, batch)
+			batch = nil
+			size = envelope
+			entrySize = len(Interface2JsonString(device))
+		}
+		batch = append(batch, device)
+		size += entrySize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches, oversized
+}
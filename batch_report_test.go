@@ -0,0 +1,132 @@
+package iot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func createDeviceService(deviceId string, valueSize int) DeviceService {
+	return DeviceService{
+		DeviceId: deviceId,
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": strings.Repeat("x", valueSize)}}},
+	}
+}
+
+func TestSplitDevicesService(t *testing.T) {
+	var devices []DeviceService
+	for _, id := range []string{"sub-1", "sub-2", "sub-3", "sub-4"} {
+		devices = append(devices, createDeviceService(id, 100))
+	}
+	entrySize := len(Interface2JsonString(devices[0]))
+	envelope := len(Interface2JsonString(DevicesService{Devices: []DeviceService{}}))
+
+	// 每批最多容纳两个子设备
+	batches, oversized := splitDevicesService(devices, 10, envelope+2*entrySize+1)
+	if len(batches) != 2 || len(batches[0]) != 2 || len(oversized) != 0 {
+		t.Fatalf("devices must be split into 2 batches by size but is %d", len(batches))
+	}
+	for _, batch := range batches {
+		if size := len(Interface2JsonString(DevicesService{Devices: batch})); size > envelope+2*entrySize+1 {
+			t.Errorf("batch size %d exceed limit", size)
+		}
+	}
+
+	batches, _ = splitDevicesService(devices, 3, 0)
+	if len(batches) != 2 || len(batches[0]) != 3 {
+		t.Errorf("devices must be split into 2 batches by count")
+	}
+
+	devices = append(devices, createDeviceService("sub-5", 1000))
+	batches, oversized = splitDevicesService(devices, 10, 1000)
+	if len(oversized) != 1 || len(batches) != 1 || len(batches[0]) != 4 {
+		t.Fatalf("oversized device must be rejected alone")
+	}
+	if err, ok := oversized[0].Err.(*SubDevicePayloadTooLargeError); !ok || err.DeviceId != "sub-5" || err.Limit != 1000 {
+		t.Errorf("oversized device must report clear error %v", oversized[0].Err)
+	}
+}
+
+func TestBatchReportSubDevicesProperties_Oversized(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.maxBatchPayloadSize = 500
+
+	ok := device.BatchReportSubDevicesProperties(DevicesService{
+		Devices: []DeviceService{createDeviceService("sub-1", 10), createDeviceService("sub-2", 1000)},
+	})
+	if ok {
+		t.Errorf("batch report with oversized device must fail")
+	}
+	service := DevicesService{}
+	if !lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service) ||
+		len(service.Devices) != 1 || service.Devices[0].DeviceId != "sub-1" {
+		t.Errorf("devices within limit must still be reported")
+	}
+}
+
+func TestBatchReportSubDevicesProperties_CommitReportedBatches(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.maxBatchPayloadSize = 500
+	device.SetPropertyFilter("sensor", "value", PropertyFilter{ChangeOnly: true})
+
+	service := DevicesService{
+		Devices: []DeviceService{createDeviceService("sub-1", 10), createDeviceService("sub-2", 1000)},
+	}
+	if device.BatchReportSubDevicesProperties(service) {
+		t.Errorf("batch report with failed batch must return false")
+	}
+	published := len(client.messages())
+
+	// 已经上报成功的子设备属性没有变化时不再上报
+	device.BatchReportSubDevicesProperties(DevicesService{Devices: service.Devices[:1]})
+	if len(client.messages()) != published {
+		t.Errorf("unchanged properties of reported batch must be filtered")
+	}
+}
+
+func TestAsyncBatchReportSubDevicesProperties(t *testing.T) {
+	device := CreateAsyncIotDevice(deviceId, devicePwd, server)
+	client := &fakeClient{}
+	device.base.Client = client
+	device.base.maxBatchPayloadSize = 600
+
+	var devices []DeviceService
+	for _, id := range []string{"sub-1", "sub-2", "sub-3", "sub-4"} {
+		devices = append(devices, createDeviceService(id, 150))
+	}
+	devices = append(devices, createDeviceService("sub-5", 1000))
+
+	result := device.BatchReportSubDevicesProperties(DevicesService{Devices: devices})
+	if !result.WaitTimeout(time.Second) {
+		t.Fatalf("async batch report must complete")
+	}
+	if _, ok := result.Error().(*SubDevicePayloadTooLargeError); !ok {
+		t.Errorf("async batch report must return oversized error but is %v", result.Error())
+	}
+
+	reported := 0
+	for _, batch := range result.Results() {
+		if batch.Err == nil {
+			reported += len(batch.DeviceIds)
+			if batch.Size > 600 {
+				t.Errorf("batch size %d exceed limit", batch.Size)
+			}
+		}
+	}
+	if reported != 4 || len(client.messages()) != 2 {
+		t.Errorf("4 devices must be reported in 2 batches but reported %d in %d", reported, len(client.messages()))
+	}
+}
+
+func TestAsyncUpdateSubDeviceState_DefaultBatchSize(t *testing.T) {
+	device := CreateAsyncIotDevice(deviceId, devicePwd, server)
+	client := &fakeClient{}
+	device.base.Client = client
+
+	result := device.UpdateSubDeviceState(SubDevicesStatus{
+		DeviceStatuses: []DeviceStatus{{DeviceId: "sub-1", Status: SubDeviceStatusOnline}},
+	})
+	if !result.WaitTimeout(time.Second) || result.Error() != nil {
+		t.Errorf("update sub device state without batch size must succeed")
+	}
+}
@@ -0,0 +1,142 @@
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// 设备的可升级组件，例如主程序、通信模组固件和插件
+type DeviceComponent struct {
+	Name        string
+	UpgradeType byte          // 组件的升级类型，0为软件，1为固件
+	Version     func() string // 组件当前的版本号
+	Install     OtaInstallHandler
+}
+
+// 上报的组件版本
+type ComponentVersion struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // software或者firmware
+	Version string `json:"version"`
+}
+
+// 设备的组件清单，上报软固件版本和设备信息时携带各组件的版本。
+// 清单的Install可以作为OtaConfig的Install，根据升级包的custom_info将升级包交给对应组件安装
+type ComponentInventory struct {
+	lock       sync.RWMutex
+	components []DeviceComponent
+}
+
+func NewComponentInventory() *ComponentInventory {
+	return &ComponentInventory{}
+}
+
+// 添加组件，组件名称不能重复
+func (inventory *ComponentInventory) Add(component DeviceComponent) error {
+	if len(component.Name) == 0 || component.Version == nil {
+		return &DeviceError{errorMsg: "component name and version are required"}
+	}
+
+	inventory.lock.Lock()
+	defer inventory.lock.Unlock()
+	for _, c := range inventory.components {
+		if c.Name == component.Name {
+			return &DeviceError{errorMsg: "component " + component.Name + " already exists"}
+		}
+	}
+	inventory.components = append(inventory.components, component)
+	return nil
+}
+
+func (inventory *ComponentInventory) Remove(name string) {
+	inventory.lock.Lock()
+	defer inventory.lock.Unlock()
+	for i, c := range inventory.components {
+		if c.Name == name {
+			inventory.components = append(inventory.components[:i], inventory.components[i+1:]...)
+			return
+		}
+	}
+}
+
+// 按照添加顺序返回全部组件的当前版本
+func (inventory *ComponentInventory) Versions() []ComponentVersion {
+	inventory.lock.RLock()
+	defer inventory.lock.RUnlock()
+	versions := make([]ComponentVersion, 0, len(inventory.components))
+	for _, c := range inventory.components {
+		versions = append(versions, ComponentVersion{
+			Name:    c.Name,
+			Type:    componentType(c.UpgradeType),
+			Version: c.Version(),
+		})
+	}
+	return versions
+}
+
+// 第一个软件组件和第一个固件组件的版本，作为设备的软固件版本
+func (inventory *ComponentInventory) SwFwVersion() (string, string) {
+	sw, fw := "", ""
+	for _, version := range inventory.Versions() {
+		if len(sw) == 0 && version.Type == componentType(0) {
+			sw = version.Version
+		}
+		if len(fw) == 0 && version.Type == componentType(1) {
+			fw = version.Version
+		}
+	}
+	return sw, fw
+}
+
+// 将升级包交给对应组件的安装函数安装，没有对应组件时结果码为8
+func (inventory *ComponentInventory) Install(upgradeType byte, info UpgradeInfo, packagePath string) error {
+	component, err := inventory.route(upgradeType, info)
+	if err != nil {
+		return err
+	}
+	if component.Install == nil {
+		return &UpgradeError{ResultCode: UpgradeCodeUnsupported, Description: "component " + component.Name + " can not be upgraded"}
+	}
+	return component.Install(upgradeType, info, packagePath)
+}
+
+// custom_info为组件名称或者{"component":"组件名称"}，为空时使用该升级类型唯一的组件
+func (inventory *ComponentInventory) route(upgradeType byte, info UpgradeInfo) (DeviceComponent, error) {
+	name := componentName(info.CustomInfo)
+
+	inventory.lock.RLock()
+	defer inventory.lock.RUnlock()
+	var candidates []DeviceComponent
+	for _, c := range inventory.components {
+		if c.UpgradeType == upgradeType && (len(name) == 0 || c.Name == name) {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) != 1 {
+		return DeviceComponent{}, &UpgradeError{
+			ResultCode:  UpgradeCodeUnsupported,
+			Description: fmt.Sprintf("no unique %s component for package %s", componentType(upgradeType), info.Version),
+		}
+	}
+	return candidates[0], nil
+}
+
+func componentName(customInfo string) string {
+	customInfo = strings.TrimSpace(customInfo)
+	metadata := struct {
+		Component string `json:"component"`
+	}{}
+	if strings.HasPrefix(customInfo, "{") && json.Unmarshal([]byte(customInfo), &metadata) == nil {
+		return metadata.Component
+	}
+	return customInfo
+}
+
+func componentType(upgradeType byte) string {
+	if upgradeType == 1 {
+		return "firmware"
+	}
+	return "software"
+}
@@ -0,0 +1,125 @@
+package iot
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func createComponentInventory(t *testing.T, installed *[]string) *ComponentInventory {
+	inventory := NewComponentInventory()
+	for _, c := range []struct {
+		name        string
+		upgradeType byte
+		version     string
+	}{{"app", 0, "v1.0"}, {"modem", 1, "m1.2"}, {"plugin", 0, "p0.3"}} {
+		name := c.name
+		version := c.version
+		err := inventory.Add(DeviceComponent{
+			Name:        name,
+			UpgradeType: c.upgradeType,
+			Version: func() string {
+				return version
+			},
+			Install: func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+				*installed = append(*installed, name)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inventory
+}
+
+func TestComponentInventory_Install(t *testing.T) {
+	var installed []string
+	inventory := createComponentInventory(t, &installed)
+	if inventory.Add(DeviceComponent{Name: "app", Version: func() string { return "" }}) == nil {
+		t.Errorf("duplicated component must be rejected")
+	}
+
+	for _, c := range []struct {
+		upgradeType byte
+		customInfo  string
+		component   string
+		code        int
+	}{
+		{0, "plugin", "plugin", 0},
+		{0, `{"component":"app"}`, "app", 0},
+		{1, "", "modem", 0},
+		{0, "", "", UpgradeCodeUnsupported},
+		{1, "app", "", UpgradeCodeUnsupported},
+		{0, "unknown", "", UpgradeCodeUnsupported},
+	} {
+		installed = nil
+		err := inventory.Install(c.upgradeType, UpgradeInfo{Version: "v2.0", CustomInfo: c.customInfo}, "package.bin")
+		if len(c.component) > 0 {
+			if err != nil || len(installed) != 1 || installed[0] != c.component {
+				t.Errorf("package %q must be installed by %s but is %v %v", c.customInfo, c.component, installed, err)
+			}
+			continue
+		}
+		if upgradeErr, ok := err.(*UpgradeError); !ok || upgradeErr.ResultCode != c.code || len(installed) != 0 {
+			t.Errorf("package %q must be rejected with code %d but is %v", c.customInfo, c.code, err)
+		}
+	}
+}
+
+func TestComponentInventory_Report(t *testing.T) {
+	var installed []string
+	device, client := createFakeIotDevice()
+	device.SetComponentInventory(createComponentInventory(t, &installed))
+
+	if !device.ReportVersion() {
+		t.Fatal("report version failed")
+	}
+	versions := struct {
+		Services []struct {
+			Paras struct {
+				SwVersion  string             `json:"sw_version"`
+				FwVersion  string             `json:"fw_version"`
+				Components []ComponentVersion `json:"components"`
+			} `json:"paras"`
+		} `json:"services"`
+	}{}
+	messages := client.messages()
+	json.Unmarshal(messages[len(messages)-1].payload, &versions)
+	paras := versions.Services[0].Paras
+	if paras.SwVersion != "v1.0" || paras.FwVersion != "m1.2" || len(paras.Components) != 3 {
+		t.Fatalf("version report must contain component versions %+v", paras)
+	}
+	if paras.Components[1] != (ComponentVersion{Name: "modem", Type: "firmware", Version: "m1.2"}) {
+		t.Errorf("component version is wrong %+v", paras.Components[1])
+	}
+
+	device.ReportDeviceInfo("", "")
+	info := ReportDeviceInfoRequest{}
+	messages = client.messages()
+	json.Unmarshal(messages[len(messages)-1].payload, &info)
+	if len(info.Services) != 1 || len(info.Services[0].Paras.Components) != 3 || info.Services[0].Paras.SwVersion != "v1.0" {
+		t.Errorf("device info must contain component versions %+v", info)
+	}
+}
+
+func TestOtaEngine_Components(t *testing.T) {
+	content := []byte("modem firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	var installed []string
+	inventory := createComponentInventory(t, &installed)
+	device, client := createFakeIotDevice()
+	engine, dir := createOtaEngine(t, device, inventory.Install)
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+
+	info := createOtaUpgradeInfo(server.URL, content)
+	info.CustomInfo = `{"component":"modem"}`
+	device.base.upgradeDevice(1, &info)
+	progresses := waitUpgradeResult(t, client)
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeSuccess || len(installed) != 1 || installed[0] != "modem" {
+		t.Errorf("firmware package must be installed by modem %+v %v", last, installed)
+	}
+}
@@ -1,10 +1,10 @@
 package iot
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
-	uuid "github.com/satori/go.uuid"
-	"time"
+	"io"
 )
 
 type Device interface {
@@ -12,11 +12,20 @@ type Device interface {
 	Gateway
 	SendMessage(message Message) bool
 	ReportProperties(properties DeviceProperties) bool
+	// 不经过属性过滤上报属性，上报成功后同样记录过滤规则的上报值，用于必须送达平台的属性，例如设备影子同步
+	ReportPropertiesUnfiltered(properties DeviceProperties) bool
+	BackfillProperties(ctx context.Context, samples <-chan PropertySample, config BackfillConfig) error
 	BatchReportSubDevicesProperties(service DevicesService) bool
 	QueryDeviceShadow(query DevicePropertyQueryRequest, handler DevicePropertyQueryResponseHandler)
+	GetShadow(ctx context.Context, serviceId string) (DevicePropertyQueryResponse, error)
 	UploadFile(filename string) bool
 	DownloadFile(filename string) bool
+	UploadFrom(ctx context.Context, name string, reader io.Reader, size int64) error
+	DownloadTo(ctx context.Context, name string, writer io.Writer) error
+	UploadFileMultipart(ctx context.Context, filename string, config MultipartUploadConfig) error
 	ReportDeviceInfo(swVersion, fwVersion string)
+	ReportUpgradeProgress(progress UpgradeProgress) bool
+	ReportVersion() bool
 	ReportLogs(logs []DeviceLogEntry) bool
 }
 
@@ -50,14 +59,30 @@ func (device *iotDevice) SetSwFwVersionReporter(handler SwFwVersionReporter) {
 	device.base.SetSwFwVersionReporter(handler)
 }
 
+func (device *iotDevice) SetComponentInventory(inventory *ComponentInventory) {
+	device.base.SetComponentInventory(inventory)
+}
+
 func (device *iotDevice) SetDeviceUpgradeHandler(handler DeviceUpgradeHandler) {
 	device.base.SetDeviceUpgradeHandler(handler)
 }
 
+func (device *iotDevice) SetDeviceUpgradeProgressHandler(handler DeviceUpgradeProgressHandler) {
+	device.base.SetDeviceUpgradeProgressHandler(handler)
+}
+
 func (device *iotDevice) SetPropertyQueryHandler(handler DevicePropertyQueryHandler) {
 	device.base.SetPropertyQueryHandler(handler)
 }
 
+func (device *iotDevice) AddConnectHandler(handler ConnectHandler) {
+	device.base.AddConnectHandler(handler)
+}
+
+func (device *iotDevice) SetPropertyFilter(serviceId, propertyName string, filter PropertyFilter) {
+	device.base.SetPropertyFilter(serviceId, propertyName, filter)
+}
+
 func (device *iotDevice) ReportLogs(logs []DeviceLogEntry) bool {
 	var services []ReportDeviceLogServiceEvent
 
@@ -93,203 +118,73 @@ func (device *iotDevice) ReportLogs(logs []DeviceLogEntry) bool {
 }
 
 func (device *iotDevice) SendMessage(message Message) bool {
-	messageData := Interface2JsonString(message)
-	if token := device.base.Client.Publish(formatTopic(MessageUpTopic, device.base.Id), device.base.qos, false, messageData); token.Wait() && token.Error() != nil {
-		glog.Warningf("device %s send message failed", device.base.Id)
-		return false
-	}
-	return true
+	return device.base.sendMessage(message) == nil
 }
 
 func (device *iotDevice) ReportProperties(properties DeviceProperties) bool {
-	propertiesData := Interface2JsonString(properties)
-	if token := device.base.Client.Publish(formatTopic(PropertiesUpTopic, device.base.Id), device.base.qos, false, propertiesData); token.Wait() && token.Error() != nil {
-		glog.Warningf("device %s report properties failed", device.base.Id)
-		return false
-	}
-	return true
+	return device.base.reportProperties(properties) == nil
 }
-func (device *iotDevice) BatchReportSubDevicesProperties(service DevicesService) bool {
 
-	subDeviceCounts := len(service.Devices)
-
-	batchReportSubDeviceProperties := 0
-	if subDeviceCounts%device.base.batchSubDeviceSize == 0 {
-		batchReportSubDeviceProperties = subDeviceCounts / device.base.batchSubDeviceSize
-	} else {
-		batchReportSubDeviceProperties = subDeviceCounts/device.base.batchSubDeviceSize + 1
-	}
-
-	for i := 0; i < batchReportSubDeviceProperties; i++ {
-		begin := i * device.base.batchSubDeviceSize
-		end := (i + 1) * device.base.batchSubDeviceSize
-		if end > subDeviceCounts {
-			end = subDeviceCounts
-		}
-
-		sds := DevicesService{
-			Devices: service.Devices[begin:end],
-		}
+func (device *iotDevice) ReportPropertiesUnfiltered(properties DeviceProperties) bool {
+	return device.base.reportPropertiesUnfiltered(properties) == nil
+}
 
-		if token := device.base.Client.Publish(formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(sds)); token.Wait() && token.Error() != nil {
-			glog.Warningf("device %s batch report sub device properties failed", device.base.Id)
-			return false
-		}
-	}
+func (device *iotDevice) BackfillProperties(ctx context.Context, samples <-chan PropertySample, config BackfillConfig) error {
+	return device.base.backfillProperties(ctx, samples, config)
+}
 
-	return true
+// 全部批次上报成功时返回true，部分批次失败时返回false，上报成功的批次不受影响
+func (device *iotDevice) BatchReportSubDevicesProperties(service DevicesService) bool {
+	_, err := device.base.batchReportSubDevicesProperties(service)
+	return err == nil
 }
 
 func (device *iotDevice) QueryDeviceShadow(query DevicePropertyQueryRequest, handler DevicePropertyQueryResponseHandler) {
-	device.base.propertiesQueryResponseHandler = handler
-	requestId := uuid.NewV4()
-	if token := device.base.Client.Publish(formatTopic(DeviceShadowQueryRequestTopic, device.base.Id)+requestId.String(), device.base.qos, false, Interface2JsonString(query)); token.Wait() && token.Error() != nil {
-		glog.Warningf("device %s query device shadow data failed,request id = %s", device.base.Id, requestId)
-	}
+	device.base.queryShadow(query, handler)
 }
 
-func (device *iotDevice) UploadFile(filename string) bool {
-	// 构造获取文件上传URL的请求
-	requestParas := FileRequestServiceEventParas{
-		FileName: filename,
-	}
-
-	serviceEvent := FileRequestServiceEvent{
-		Paras: requestParas,
-	}
-	serviceEvent.ServiceId = "$file_manager"
-	serviceEvent.EventTime = GetEventTimeStamp()
-	serviceEvent.EventType = "get_upload_url"
-
-	var services []FileRequestServiceEvent
-	services = append(services, serviceEvent)
-	request := FileRequest{
-		Services: services,
-	}
-
-	if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-		glog.Warningf("publish file upload request url failed")
-		return false
-	}
-	glog.Info("publish file upload request url success")
-
-	ticker := time.Tick(time.Second)
-	for {
-		select {
-		case <-ticker:
-			_, ok := device.base.fileUrls[filename+FileActionUpload]
-			if ok {
-				glog.Infof("platform send file upload url success")
-				goto BreakPoint
-			}
-
-		}
-	}
-BreakPoint:
-
-	if len(device.base.fileUrls[filename+FileActionUpload]) == 0 {
-		glog.Errorf("get file upload url failed")
-		return false
-	}
-	glog.Infof("file upload url is %s", device.base.fileUrls[filename+FileActionUpload])
-
-	//filename = smartFileName(filename)
-	uploadFlag := CreateHttpClient().UploadFile(filename, device.base.fileUrls[filename+FileActionUpload])
-	if !uploadFlag {
-		glog.Errorf("upload file failed")
-		return false
-	}
-
-	response := CreateFileUploadDownLoadResultResponse(filename, FileActionUpload, uploadFlag)
+func (device *iotDevice) GetShadow(ctx context.Context, serviceId string) (DevicePropertyQueryResponse, error) {
+	return device.base.getShadow(ctx, serviceId)
+}
 
-	token := device.base.Client.Publish(formatTopic(PlatformEventToDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(response))
-	if token.Wait() && token.Error() != nil {
-		glog.Error("report file upload file result failed")
+func (device *iotDevice) UploadFile(filename string) bool {
+	if err := device.base.uploadFile(filename); err != nil {
+		glog.Errorf("upload file %s failed %v", filename, err)
 		return false
 	}
-
 	return true
 }
 
 func (device *iotDevice) DownloadFile(filename string) bool {
-	// 构造获取文件上传URL的请求
-	requestParas := FileRequestServiceEventParas{
-		FileName: filename,
-	}
-
-	serviceEvent := FileRequestServiceEvent{
-		Paras: requestParas,
-	}
-	serviceEvent.ServiceId = "$file_manager"
-	serviceEvent.EventTime = GetEventTimeStamp()
-	serviceEvent.EventType = "get_download_url"
-
-	var services []FileRequestServiceEvent
-	services = append(services, serviceEvent)
-	request := FileRequest{
-		Services: services,
-	}
-
-	if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-		glog.Warningf("publish file download request url failed")
+	if err := device.base.downloadFile(filename); err != nil {
+		glog.Errorf("download file %s failed %v", filename, err)
 		return false
 	}
+	return true
+}
 
-	ticker := time.Tick(time.Second)
-	for {
-		select {
-		case <-ticker:
-			_, ok := device.base.fileUrls[filename+FileActionDownload]
-			if ok {
-				glog.Infof("platform send file upload url success")
-				goto BreakPoint
-			}
-
-		}
-	}
-BreakPoint:
-
-	if len(device.base.fileUrls[filename+FileActionDownload]) == 0 {
-		glog.Errorf("get file download url failed")
-		return false
-	}
+func (device *iotDevice) UploadFrom(ctx context.Context, name string, reader io.Reader, size int64) error {
+	return device.base.uploadFrom(ctx, name, reader, size)
+}
 
-	downloadFlag := CreateHttpClient().DownloadFile(filename, device.base.fileUrls[filename+FileActionDownload])
-	if !downloadFlag {
-		glog.Errorf("down load file { %s } failed", filename)
-		return false
-	}
+func (device *iotDevice) DownloadTo(ctx context.Context, name string, writer io.Writer) error {
+	return device.base.downloadTo(ctx, name, writer)
+}
 
-	response := CreateFileUploadDownLoadResultResponse(filename, FileActionDownload, downloadFlag)
+func (device *iotDevice) UploadFileMultipart(ctx context.Context, filename string, config MultipartUploadConfig) error {
+	return device.base.uploadFileMultipart(ctx, filename, config)
+}
 
-	token := device.base.Client.Publish(formatTopic(PlatformEventToDeviceTopic, device.base.Id), device.base.qos, false, Interface2JsonString(response))
-	if token.Wait() && token.Error() != nil {
-		glog.Error("report file upload file result failed")
-		return false
-	}
+func (device *iotDevice) ReportUpgradeProgress(progress UpgradeProgress) bool {
+	return device.base.reportUpgradeProgress(progress) == nil
+}
 
-	return true
+func (device *iotDevice) ReportVersion() bool {
+	return device.base.reportVersion() == nil
 }
 
 func (device *iotDevice) ReportDeviceInfo(swVersion, fwVersion string) {
-	event := ReportDeviceInfoServiceEvent{
-		BaseServiceEvent{
-			ServiceId: "$device_info",
-			EventType: "device_info_report",
-			EventTime: GetEventTimeStamp(),
-		},
-		ReportDeviceInfoEventParas{
-			DeviceSdkVersion: SdkInfo()["sdk-version"],
-			SwVersion:        swVersion,
-			FwVersion:        fwVersion,
-		},
-	}
-
-	request := ReportDeviceInfoRequest{
-		ObjectDeviceId: device.base.Id,
-		Services:       []ReportDeviceInfoServiceEvent{event},
-	}
-
+	request := device.base.deviceInfoRequest(swVersion, fwVersion)
 	device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request))
 }
 
@@ -301,6 +196,26 @@ func (device *iotDevice) SetSubDevicesDeleteHandler(handler SubDevicesDeleteHand
 	device.base.subDevicesDeleteHandler = handler
 }
 
+func (device *iotDevice) SetSubDeviceRegistry(registry *SubDeviceRegistry) {
+	device.base.setSubDeviceRegistry(registry)
+}
+
+func (device *iotDevice) SubDevice(deviceId string) SubDevice {
+	return device.base.subDevice(deviceId)
+}
+
+func (device *iotDevice) SubDeviceProduct(productId string) SubDeviceHandlers {
+	return device.base.subDeviceProduct(productId)
+}
+
+func (device *iotDevice) SubDeviceFallback() SubDeviceHandlers {
+	return device.base.subDeviceFallback()
+}
+
+func (device *iotDevice) AddSubDeviceActivityHandler(handler SubDeviceActivityHandler) {
+	device.base.AddSubDeviceActivityHandler(handler)
+}
+
 func (device *iotDevice) SetDeviceStatusLogCollector(collector DeviceStatusLogCollector) {
 	device.base.SetDeviceStatusLogCollector(collector)
 }
@@ -319,47 +234,7 @@ func (device *iotDevice) SetDeviceCommandLogCollector(collector DeviceCommandLog
 
 func (device *iotDevice) UpdateSubDeviceState(subDevicesStatus SubDevicesStatus) bool {
 	glog.Infof("begin to update sub-devices status")
-
-	subDeviceCounts := len(subDevicesStatus.DeviceStatuses)
-
-	batchUpdateSubDeviceState := 0
-	if subDeviceCounts%device.base.batchSubDeviceSize == 0 {
-		batchUpdateSubDeviceState = subDeviceCounts / device.base.batchSubDeviceSize
-	} else {
-		batchUpdateSubDeviceState = subDeviceCounts/device.base.batchSubDeviceSize + 1
-	}
-
-	for i := 0; i < batchUpdateSubDeviceState; i++ {
-		begin := i * device.base.batchSubDeviceSize
-		end := (i + 1) * device.base.batchSubDeviceSize
-		if end > subDeviceCounts {
-			end = subDeviceCounts
-		}
-
-		sds := SubDevicesStatus{
-			DeviceStatuses: subDevicesStatus.DeviceStatuses[begin:end],
-		}
-
-		requestEventService := DataEntry{
-			ServiceId: "$sub_device_manager",
-			EventType: "sub_device_update_status",
-			EventTime: GetEventTimeStamp(),
-			Paras:     sds,
-		}
-
-		request := Data{
-			ObjectDeviceId: device.base.Id,
-			Services:       []DataEntry{requestEventService},
-		}
-
-		if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
-			glog.Warningf("gateway %s update sub devices status failed", device.base.Id)
-			return false
-		}
-	}
-
-	glog.Info("gateway  update sub devices status failed", device.base.Id)
-	return true
+	return device.base.updateSubDeviceState(subDevicesStatus) == nil
 }
 
 func (device *iotDevice) DeleteSubDevices(deviceIds []string) bool {
@@ -442,29 +317,23 @@ func (device *iotDevice) SyncAllVersionSubDevices() {
 }
 
 func (device *iotDevice) SyncSubDevices(version int) {
-	syncParas := struct {
-		Version int `json:"version"`
-	}{
-		Version: version,
-	}
+	device.base.syncSubDevices(version)
+}
 
-	dataEntry := DataEntry{
-		ServiceId: "$sub_device_manager",
-		EventType: "sub_device_sync_request",
-		EventTime: GetEventTimeStamp(),
-		Paras:     syncParas,
-	}
+func (device *iotDevice) AddSubDevicesWithResult(ctx context.Context, deviceInfos []DeviceInfo) (SubDeviceResult, error) {
+	return device.base.addSubDevices(ctx, deviceInfos)
+}
 
-	var dataEntries []DataEntry
-	dataEntries = append(dataEntries, dataEntry)
+func (device *iotDevice) DeleteSubDevicesWithResult(ctx context.Context, deviceIds []string) (SubDeviceResult, error) {
+	return device.base.deleteSubDevices(ctx, deviceIds)
+}
 
-	data := Data{
-		Services: dataEntries,
-	}
+func (device *iotDevice) UpdateSubDeviceStateWithResult(ctx context.Context, subDevicesStatus SubDevicesStatus) (SubDeviceResult, error) {
+	return device.base.updateSubDeviceStateWithResult(ctx, subDevicesStatus)
+}
 
-	if token := device.base.Client.Publish(formatTopic(DeviceToPlatformTopic, device.base.Id), device.base.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
-		glog.Errorf("send sync sub device request failed")
-	}
+func (device *iotDevice) SyncSubDevicesWithResult(ctx context.Context, version int) (SubDeviceResult, error) {
+	return device.base.syncSubDevicesWithResult(ctx, version)
 }
 
 func CreateIotDevice(id, password, servers string) Device {
@@ -497,10 +366,17 @@ func CreateIotDeviceWitConfig(config DeviceConfig) Device {
 	device.Servers = config.Servers
 	device.messageHandlers = []MessageHandler{}
 
-	device.fileUrls = map[string]string{}
+	device.fileUrls = &fileUrlRequests{}
+	device.shadowQueries = &shadowQueries{}
+	device.propertyFilters = newPropertyFilters()
+	device.subDeviceRouter = &subDeviceRouter{}
+	device.subDeviceRequests = &subDeviceRequests{}
+	device.subDeviceBatcher = &subDeviceBatcher{interval: config.SubDeviceBatchInterval}
 
 	device.qos = config.Qos
-	device.batchSubDeviceSize = 100
+	device.batchSubDeviceSize = config.BatchSubDeviceSize
+	device.maxBatchPayloadSize = config.MaxBatchPayloadSize
+	device.upgradeProgressInterval = config.UpgradeProgressInterval
 	device.AuthType = config.AuthType
 	device.ServerCaPath = config.ServerCaPath
 	device.CertFilePath = config.CertFilePath
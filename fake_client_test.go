@@ -0,0 +1,145 @@
+package iot
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"time"
+)
+
+// 创建使用fakeClient的设备
+func createFakeIotDevice() (*iotDevice, *fakeClient) {
+	device := CreateIotDevice(deviceId, devicePwd, server).(*iotDevice)
+	client := &fakeClient{}
+	device.base.Client = client
+	return device, client
+}
+
+// 测试使用的mqtt client，记录设备发布的消息，不连接平台
+type fakeClient struct {
+	lock       sync.Mutex
+	published  []fakeMessage
+	onPublish  func(topic string, payload []byte)
+	publishErr func(topic string, payload []byte) error // 返回非nil时发布失败
+}
+
+func (client *fakeClient) IsConnected() bool {
+	return true
+}
+
+func (client *fakeClient) IsConnectionOpen() bool {
+	return true
+}
+
+func (client *fakeClient) Connect() mqtt.Token {
+	return &fakeToken{}
+}
+
+func (client *fakeClient) Disconnect(quiesce uint) {
+}
+
+func (client *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	}
+
+	client.lock.Lock()
+	onPublish, publishErr := client.onPublish, client.publishErr
+	client.lock.Unlock()
+	if publishErr != nil {
+		if err := publishErr(topic, data); err != nil {
+			return &fakeToken{err: err}
+		}
+	}
+
+	client.lock.Lock()
+	client.published = append(client.published, fakeMessage{topic: topic, payload: data})
+	client.lock.Unlock()
+
+	if onPublish != nil {
+		onPublish(topic, data)
+	}
+	return &fakeToken{}
+}
+
+func (client *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+
+func (client *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+
+func (client *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	return &fakeToken{}
+}
+
+func (client *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+}
+
+func (client *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func (client *fakeClient) messages() []fakeMessage {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return append([]fakeMessage{}, client.published...)
+}
+
+type fakeToken struct {
+	err error
+}
+
+func (token *fakeToken) Wait() bool {
+	return true
+}
+
+func (token *fakeToken) WaitTimeout(time.Duration) bool {
+	return true
+}
+
+func (token *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (token *fakeToken) Error() error {
+	return token.err
+}
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (message fakeMessage) Duplicate() bool {
+	return false
+}
+
+func (message fakeMessage) Qos() byte {
+	return 0
+}
+
+func (message fakeMessage) Retained() bool {
+	return false
+}
+
+func (message fakeMessage) Topic() string {
+	return message.topic
+}
+
+func (message fakeMessage) MessageID() uint16 {
+	return 0
+}
+
+func (message fakeMessage) Payload() []byte {
+	return message.payload
+}
+
+func (message fakeMessage) Ack() {
+}
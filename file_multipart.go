@@ -0,0 +1,304 @@
+package iot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMultipartPartSize      = 5 * 1024 * 1024
+	defaultMultipartRetries       = 3
+	defaultMultipartRetryInterval = time.Second
+)
+
+// 为分段上传的请求生成签名URL。平台下发的上传URL只对整个对象的PUT请求签名，分段上传的每个请求需要单独签名：
+// method为请求方法，objectUrl为平台下发的上传URL，query为分段上传的子资源uploads、partNumber和uploadId
+type MultipartUrlSigner func(ctx context.Context, method, objectUrl string, query url.Values) (string, error)
+
+// 分段上传配置
+type MultipartUploadConfig struct {
+	PartSize      int64         // 每段的字节数，默认5MB
+	Retries       int           // 每段上传失败后的最大重试次数，默认3
+	RetryInterval time.Duration // 重试的间隔时间，默认1秒
+	StateDir      string        // 保存续传状态的目录，默认为系统临时目录
+
+	// 为空时不能分段上传，使用平台下发的URL上传整个文件，失败后重新上传整个文件，不保存续传状态
+	Signer MultipartUrlSigner
+}
+
+// 分段上传的续传状态，每上传完成一段保存一次
+type multipartUploadState struct {
+	FileName string          `json:"file_name"`
+	Size     int64           `json:"size"`
+	ModTime  int64           `json:"mod_time"`
+	PartSize int64           `json:"part_size"`
+	UploadId string          `json:"upload_id"`
+	Parts    []multipartPart `json:"parts"`
+}
+
+type multipartPart struct {
+	PartNumber int    `json:"part_number" xml:"PartNumber"`
+	ETag       string `json:"etag" xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []multipartPart `xml:"Part"`
+}
+
+// 分段上传本地文件到平台下发的OBS地址，每段失败后单独重试，上传中断后再次调用时从未完成的段继续上传。
+// 全部分段上传完成或者重试后仍然失败时上报上传结果，ctx取消导致的中断不上报，续传状态保留。
+// 没有设置Signer时退化为整个文件上传，中断后再次调用从头上传
+func (device *baseIotDevice) uploadFileMultipart(ctx context.Context, filename string, config MultipartUploadConfig) error {
+	if config.PartSize <= 0 {
+		config.PartSize = defaultMultipartPartSize
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultMultipartRetries
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultMultipartRetryInterval
+	}
+	if len(config.StateDir) == 0 {
+		config.StateDir = os.TempDir()
+	}
+
+	file, err := os.Open(smartFileName(filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 平台下发的URL会过期，每次上传都重新获取，已经初始化的分段上传继续使用
+	uploadUrl, err := device.requestFileUrl(ctx, filename, FileActionUpload)
+	if err != nil {
+		return err
+	}
+
+	if config.Signer == nil {
+		statusCode, err := retryMultipart(ctx, config, filename, func() (int, error) {
+			return putFile(ctx, uploadUrl, filename, io.NewSectionReader(file, 0, info.Size()), info.Size())
+		})
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		return device.finishFileTransfer(filename, FileActionUpload, statusCode, err)
+	}
+
+	statePath := filepath.Join(config.StateDir, multipartStateName(filename))
+	state := loadMultipartState(statePath, filename, info, config.PartSize)
+	statusCode, err := device.uploadParts(ctx, uploadUrl, file, state, statePath, config)
+	if err != nil && ctx.Err() != nil {
+		glog.Infof("multipart upload of file %s is interrupted,%d parts uploaded", filename, len(state.Parts))
+		return err
+	}
+	// 上传成功或者分段上传已经不存在时删除续传状态
+	if err == nil || statusCode == http.StatusNotFound {
+		os.Remove(statePath)
+	}
+	return device.finishFileTransfer(filename, FileActionUpload, statusCode, err)
+}
+
+// 上传未完成的分段并合并，返回OBS最后一次响应的状态码
+func (device *baseIotDevice) uploadParts(ctx context.Context, uploadUrl string, file *os.File, state *multipartUploadState,
+	statePath string, config MultipartUploadConfig) (int, error) {
+	if len(state.UploadId) == 0 {
+		initiateUrl, err := config.Signer(ctx, http.MethodPost, uploadUrl, url.Values{"uploads": {""}})
+		if err != nil {
+			return 0, err
+		}
+		statusCode, uploadId, err := initiateMultipartUpload(ctx, initiateUrl)
+		if err != nil {
+			return statusCode, err
+		}
+		state.UploadId = uploadId
+		if err := saveMultipartState(statePath, state); err != nil {
+			return 0, err
+		}
+	}
+
+	uploaded := map[int]bool{}
+	for _, part := range state.Parts {
+		uploaded[part.PartNumber] = true
+	}
+	parts := int((state.Size + state.PartSize - 1) / state.PartSize)
+	if parts == 0 {
+		parts = 1
+	}
+	for number := 1; number <= parts; number++ {
+		if uploaded[number] {
+			continue
+		}
+		offset := int64(number-1) * state.PartSize
+		size := state.PartSize
+		if offset+size > state.Size {
+			size = state.Size - offset
+		}
+
+		partUrl, err := config.Signer(ctx, http.MethodPut, uploadUrl, url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {state.UploadId},
+		})
+		if err != nil {
+			return 0, err
+		}
+		var etag string
+		statusCode, err := retryMultipart(ctx, config, state.FileName, func() (int, error) {
+			var statusCode int
+			var err error
+			statusCode, etag, err = uploadPart(ctx, partUrl, io.NewSectionReader(file, offset, size), size)
+			return statusCode, err
+		})
+		if err != nil {
+			return statusCode, err
+		}
+
+		state.Parts = append(state.Parts, multipartPart{PartNumber: number, ETag: etag})
+		if err := saveMultipartState(statePath, state); err != nil {
+			return 0, err
+		}
+	}
+
+	completeUrl, err := config.Signer(ctx, http.MethodPost, uploadUrl, url.Values{"uploadId": {state.UploadId}})
+	if err != nil {
+		return 0, err
+	}
+	return completeMultipart(ctx, completeUrl, state.Parts)
+}
+
+// 网络错误和OBS服务端错误时按照配置的间隔重试，URL过期等客户端错误不重试，ctx取消时立即返回
+func retryMultipart(ctx context.Context, config MultipartUploadConfig, name string, upload func() (int, error)) (int, error) {
+	statusCode, err := upload()
+	for i := 1; i <= config.Retries && retryableFileTransfer(statusCode, err) && ctx.Err() == nil; i++ {
+		glog.Warningf("upload file %s failed %v,retry %d", name, err, i)
+		select {
+		case <-time.After(config.RetryInterval):
+		case <-ctx.Done():
+			return statusCode, ctx.Err()
+		}
+		statusCode, err = upload()
+	}
+	return statusCode, err
+}
+
+func initiateMultipartUpload(ctx context.Context, initiateUrl string) (int, string, error) {
+	response, err := doMultipartRequest(ctx, http.MethodPost, initiateUrl, nil, 0)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, "", &DeviceError{errorMsg: fmt.Sprintf("initiate multipart upload failed,status code %d", response.StatusCode)}
+	}
+
+	result := struct {
+		UploadId string `xml:"UploadId"`
+	}{}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil || len(result.UploadId) == 0 {
+		return response.StatusCode, "", &DeviceError{errorMsg: "initiate multipart upload response has no upload id"}
+	}
+	return response.StatusCode, result.UploadId, nil
+}
+
+func uploadPart(ctx context.Context, partUrl string, body io.Reader, size int64) (int, string, error) {
+	response, err := doMultipartRequest(ctx, http.MethodPut, partUrl, body, size)
+	if err != nil {
+		return 0, "", err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, "", &DeviceError{errorMsg: fmt.Sprintf("upload part failed,status code %d", response.StatusCode)}
+	}
+	return response.StatusCode, response.Header.Get("ETag"), nil
+}
+
+func completeMultipart(ctx context.Context, completeUrl string, parts []multipartPart) (int, error) {
+	sorted := append([]multipartPart{}, parts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PartNumber < sorted[j].PartNumber
+	})
+	body, err := xml.Marshal(completeMultipartUpload{Parts: sorted})
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := doMultipartRequest(ctx, http.MethodPost, completeUrl, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, &DeviceError{errorMsg: fmt.Sprintf("complete multipart upload failed,status code %d", response.StatusCode)}
+	}
+	return response.StatusCode, nil
+}
+
+func doMultipartRequest(ctx context.Context, method, requestUrl string, body io.Reader, size int64) (*http.Response, error) {
+	if body == nil || size == 0 {
+		body = http.NoBody
+	} else {
+		body = ioutil.NopCloser(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, requestUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "text/plain")
+	return fileHttpClient.Do(request)
+}
+
+func multipartStateName(filename string) string {
+	digest := sha256.Sum256([]byte(filename))
+	return "multipart_" + hex.EncodeToString(digest[:8]) + ".json"
+}
+
+// 读取续传状态，文件已经改变或者分段大小不同时重新上传
+func loadMultipartState(path, filename string, info os.FileInfo, partSize int64) *multipartUploadState {
+	state := &multipartUploadState{}
+	if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, state) == nil &&
+		state.FileName == filename && state.Size == info.Size() && state.ModTime == info.ModTime().UnixNano() && state.PartSize == partSize {
+		glog.Infof("resume multipart upload of file %s,%d parts uploaded", filename, len(state.Parts))
+		return state
+	}
+
+	return &multipartUploadState{
+		FileName: filename,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		PartSize: partSize,
+	}
+}
+
+// 先写入临时文件再重命名，避免掉电时状态文件损坏
+func saveMultipartState(path string, state *multipartUploadState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, []byte(Interface2JsonString(state)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
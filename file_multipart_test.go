@@ -0,0 +1,266 @@
+package iot
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟OBS分段上传接口，failures为每段需要失败的次数。请求方法和分段上传子资源都需要签名，没有签名的请求返回403
+type fakeMultipartServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	uploads   int
+	parts     map[int]string
+	requests  map[int]int
+	failures  map[int]int
+	rejected  int
+	object    string
+	onPart    func(number int)
+	completed []multipartPart
+}
+
+func fakeObsSignature(method string, query url.Values) string {
+	var resources []string
+	for _, name := range []string{"partNumber", "uploadId", "uploads"} {
+		if values, ok := query[name]; ok {
+			resources = append(resources, name+"="+values[0])
+		}
+	}
+	return method + ":" + strings.Join(resources, "&")
+}
+
+func newFakeMultipartServer() *fakeMultipartServer {
+	obs := &fakeMultipartServer{parts: map[int]string{}, requests: map[int]int{}, failures: map[int]int{}}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		obs.lock.Lock()
+		defer obs.lock.Unlock()
+		if query.Get("Signature") != fakeObsSignature(request.Method, query) {
+			obs.rejected++
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case request.Method == http.MethodPut && query.Get("uploadId") == "":
+			data, _ := ioutil.ReadAll(request.Body)
+			obs.object = string(data)
+		case request.Method == http.MethodPost && query["uploads"] != nil:
+			obs.uploads++
+			fmt.Fprintf(writer, "<InitiateMultipartUploadResult><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>", obs.uploads)
+		case request.Method == http.MethodPut:
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			obs.requests[number]++
+			if obs.onPart != nil {
+				obs.onPart(number)
+			}
+			if obs.failures[number] > 0 {
+				obs.failures[number]--
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			data, _ := ioutil.ReadAll(request.Body)
+			obs.parts[number] = string(data)
+			writer.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+		case request.Method == http.MethodPost && query.Get("uploadId") != "":
+			complete := completeMultipartUpload{}
+			if err := xml.NewDecoder(request.Body).Decode(&complete); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			obs.completed = complete.Parts
+			for _, part := range complete.Parts {
+				obs.object += obs.parts[part.PartNumber]
+			}
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return obs
+}
+
+// 平台下发的上传地址，只对整个对象的PUT签名
+func (obs *fakeMultipartServer) objectUrl(name string) string {
+	return obs.URL + "/bucket/bundle.tar?Signature=" + url.QueryEscape(fakeObsSignature(http.MethodPut, nil))
+}
+
+func (obs *fakeMultipartServer) sign(ctx context.Context, method, objectUrl string, query url.Values) (string, error) {
+	signed := url.Values{"Signature": {fakeObsSignature(method, query)}}
+	for name, values := range query {
+		signed[name] = values
+	}
+	return strings.Split(objectUrl, "?")[0] + "?" + signed.Encode(), nil
+}
+
+func createMultipartFile(t *testing.T, dir string) (string, string) {
+	content := strings.Repeat("0123456789", 350)
+	path := filepath.Join(dir, "bundle.tar")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, content
+}
+
+func TestUploadFileMultipart_Retry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multipart")
+	defer os.RemoveAll(dir)
+	obs := newFakeMultipartServer()
+	defer obs.Close()
+	obs.failures[2] = 2
+	path, content := createMultipartFile(t, dir)
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	config := MultipartUploadConfig{PartSize: 1000, RetryInterval: time.Millisecond, StateDir: dir, Signer: obs.sign}
+	if err := device.UploadFileMultipart(context.Background(), path, config); err != nil {
+		t.Fatal(err)
+	}
+
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if obs.object != content || len(obs.completed) != 4 || obs.completed[3].ETag != `"etag-4"` {
+		t.Errorf("parts must be merged in order %d %+v", len(obs.object), obs.completed)
+	}
+	if obs.requests[2] != 3 || obs.requests[1] != 1 || obs.rejected != 0 {
+		t.Errorf("only failed part must be retried %v,rejected %d", obs.requests, obs.rejected)
+	}
+	if result := lastFileResult(t, client); result.EventType != "upload_result_report" || result.Paras.ResultCode != FileResultSuccess {
+		t.Errorf("upload success must be reported %+v", result)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "multipart_*")); len(files) != 0 {
+		t.Errorf("resume state must be removed after upload %v", files)
+	}
+}
+
+func TestUploadFileMultipart_Resume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multipart")
+	defer os.RemoveAll(dir)
+	obs := newFakeMultipartServer()
+	defer obs.Close()
+	path, content := createMultipartFile(t, dir)
+	config := MultipartUploadConfig{PartSize: 1000, RetryInterval: time.Millisecond, StateDir: dir, Signer: obs.sign}
+
+	// 上传第3段时中断
+	ctx, cancel := context.WithCancel(context.Background())
+	obs.onPart = func(number int) {
+		if number == 3 {
+			cancel()
+		}
+	}
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	if device.UploadFileMultipart(ctx, path, config) == nil {
+		t.Fatal("upload must be interrupted")
+	}
+	for _, message := range client.messages() {
+		if strings.Contains(string(message.payload), "upload_result_report") {
+			t.Errorf("interrupted upload must not report result")
+		}
+	}
+
+	// 重启后继续上传
+	obs.lock.Lock()
+	obs.onPart = nil
+	obs.lock.Unlock()
+	device, client = createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	if err := device.UploadFileMultipart(context.Background(), path, config); err != nil {
+		t.Fatal(err)
+	}
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if obs.object != content || obs.uploads != 1 {
+		t.Errorf("upload must be resumed with same upload id,uploads %d", obs.uploads)
+	}
+	if obs.requests[1] != 1 || obs.requests[2] != 1 {
+		t.Errorf("uploaded parts must not be uploaded again %v", obs.requests)
+	}
+	if result := lastFileResult(t, client); result.Paras.ResultCode != FileResultSuccess {
+		t.Errorf("upload success must be reported %+v", result)
+	}
+}
+
+func TestUploadFileMultipart_Failed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multipart")
+	defer os.RemoveAll(dir)
+	obs := newFakeMultipartServer()
+	defer obs.Close()
+	obs.failures[1] = 10
+	path, _ := createMultipartFile(t, dir)
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	config := MultipartUploadConfig{PartSize: 1000, Retries: 2, RetryInterval: time.Millisecond, StateDir: dir, Signer: obs.sign}
+	if device.UploadFileMultipart(context.Background(), path, config) == nil {
+		t.Fatal("upload must fail")
+	}
+	result := lastFileResult(t, client)
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if result.Paras.ResultCode != FileResultFailed || result.Paras.StatusCode != http.StatusInternalServerError || obs.requests[1] != 3 {
+		t.Errorf("upload failure must be reported after retries %+v %v", result, obs.requests)
+	}
+}
+
+func TestUploadFileMultipart_WithoutSigner(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multipart")
+	defer os.RemoveAll(dir)
+	obs := newFakeMultipartServer()
+	defer obs.Close()
+	path, content := createMultipartFile(t, dir)
+
+	// 平台下发的URL只能上传整个文件
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	config := MultipartUploadConfig{PartSize: 1000, RetryInterval: time.Millisecond, StateDir: dir}
+	if err := device.UploadFileMultipart(context.Background(), path, config); err != nil {
+		t.Fatal(err)
+	}
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if obs.object != content || obs.uploads != 0 || obs.rejected != 0 {
+		t.Errorf("file must be uploaded with platform url,uploads %d rejected %d", obs.uploads, obs.rejected)
+	}
+	if result := lastFileResult(t, client); result.Paras.ResultCode != FileResultSuccess {
+		t.Errorf("upload success must be reported %+v", result)
+	}
+}
+
+func TestUploadFileMultipart_UnsignedOperation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multipart")
+	defer os.RemoveAll(dir)
+	obs := newFakeMultipartServer()
+	defer obs.Close()
+	path, _ := createMultipartFile(t, dir)
+
+	// 直接在平台下发的URL上追加分段上传参数，签名不匹配
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.objectUrl)
+	config := MultipartUploadConfig{PartSize: 1000, Retries: 3, RetryInterval: time.Millisecond, StateDir: dir,
+		Signer: func(ctx context.Context, method, objectUrl string, query url.Values) (string, error) {
+			return objectUrl + "&" + query.Encode(), nil
+		}}
+	if device.UploadFileMultipart(context.Background(), path, config) == nil {
+		t.Fatal("upload with unsigned operation must fail")
+	}
+	if result := lastFileResult(t, client); result.Paras.StatusCode != http.StatusForbidden {
+		t.Errorf("signature mismatch must be reported %+v", result)
+	}
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if obs.rejected != 1 {
+		t.Errorf("client error must not be retried,requests %d", obs.rejected)
+	}
+}
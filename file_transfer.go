@@ -0,0 +1,315 @@
+package iot
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// 等待平台下发文件上传下载URL的超时时间
+	defaultFileUrlTimeout = 30 * time.Second
+
+	// UploadFile和DownloadFile传输文件的超时时间和失败后的重试次数
+	defaultFileTransferTimeout = 30 * time.Minute
+	defaultFileTransferRetries = 3
+	fileTransferRetryInterval  = time.Second
+
+	// 等待OBS响应的超时时间，不限制传输数据的时间
+	fileResponseHeaderTimeout = 30 * time.Second
+)
+
+// 文件上传下载使用的HTTP客户端，连接和等待响应超时后请求失败
+var fileHttpClient = newFileHttpClient()
+
+func newFileHttpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = fileResponseHeaderTimeout
+	return &http.Client{Transport: transport}
+}
+
+// 文件上传下载结果码
+const (
+	FileResultSuccess = 0
+	FileResultFailed  = 1
+)
+
+// 等待平台下发文件上传下载URL的请求，同一文件的多个请求按照发送顺序对应平台的响应
+type fileUrlRequests struct {
+	lock    sync.Mutex
+	waiters map[string][]chan string
+}
+
+func (requests *fileUrlRequests) add(key string) chan string {
+	requests.lock.Lock()
+	defer requests.lock.Unlock()
+	if requests.waiters == nil {
+		requests.waiters = map[string][]chan string{}
+	}
+	waiter := make(chan string, 1)
+	requests.waiters[key] = append(requests.waiters[key], waiter)
+	return waiter
+}
+
+func (requests *fileUrlRequests) remove(key string, waiter chan string) {
+	requests.lock.Lock()
+	defer requests.lock.Unlock()
+	waiters := requests.waiters[key]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(requests.waiters, key)
+	} else {
+		requests.waiters[key] = waiters
+	}
+}
+
+// 将平台下发的URL交给最早的请求，没有等待的请求时返回false
+func (requests *fileUrlRequests) complete(key, url string) bool {
+	requests.lock.Lock()
+	defer requests.lock.Unlock()
+	waiters := requests.waiters[key]
+	if len(waiters) == 0 {
+		return false
+	}
+	waiters[0] <- url
+	if len(waiters) == 1 {
+		delete(requests.waiters, key)
+	} else {
+		requests.waiters[key] = waiters[1:]
+	}
+	return true
+}
+
+// 向平台获取文件上传或下载URL，最长等待defaultFileUrlTimeout
+func (device *baseIotDevice) requestFileUrl(ctx context.Context, name, action string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultFileUrlTimeout)
+	defer cancel()
+
+	key := name + action
+	waiter := device.fileUrls.add(key)
+	defer device.fileUrls.remove(key, waiter)
+
+	event := FileRequestServiceEvent{
+		Paras: FileRequestServiceEventParas{
+			FileName: name,
+		},
+	}
+	event.ServiceId = "$file_manager"
+	event.EventTime = GetEventTimeStamp()
+	event.EventType = "get_download_url"
+	if action == FileActionUpload {
+		event.EventType = "get_upload_url"
+	}
+	request := FileRequest{
+		ObjectDeviceId: device.Id,
+		Services:       []FileRequestServiceEvent{event},
+	}
+	if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(request)); token.Wait() && token.Error() != nil {
+		return "", token.Error()
+	}
+
+	select {
+	case url := <-waiter:
+		if len(url) == 0 {
+			return "", &DeviceError{errorMsg: "platform send empty " + action + " url for file " + name}
+		}
+		return url, nil
+	case <-ctx.Done():
+		return "", &DeviceError{errorMsg: fmt.Sprintf("get %s url of file %s failed %v", action, name, ctx.Err())}
+	}
+}
+
+// 从reader读取size字节上传到平台下发的URL，size小于0时使用分块传输，上传结束后上报上传结果
+func (device *baseIotDevice) uploadFrom(ctx context.Context, name string, reader io.Reader, size int64) error {
+	uploadUrl, err := device.requestFileUrl(ctx, name, FileActionUpload)
+	if err != nil {
+		return err
+	}
+
+	statusCode, err := putFile(ctx, uploadUrl, name, reader, size)
+	return device.finishFileTransfer(name, FileActionUpload, statusCode, err)
+}
+
+// 从平台下发的URL下载文件写入writer，下载结束后上报下载结果
+func (device *baseIotDevice) downloadTo(ctx context.Context, name string, writer io.Writer) error {
+	downloadUrl, err := device.requestFileUrl(ctx, name, FileActionDownload)
+	if err != nil {
+		return err
+	}
+
+	statusCode, err := getFile(ctx, downloadUrl, name, writer)
+	return device.finishFileTransfer(name, FileActionDownload, statusCode, err)
+}
+
+// 上传数据到OBS，返回OBS响应的状态码
+func putFile(ctx context.Context, uploadUrl, name string, reader io.Reader, size int64) (int, error) {
+	// 空文件不能使用分块传输
+	body := ioutil.NopCloser(reader)
+	if size == 0 {
+		body = http.NoBody
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadUrl, body)
+	if err != nil {
+		return 0, err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "text/plain")
+
+	response, err := fileHttpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, &DeviceError{errorMsg: fmt.Sprintf("upload file %s failed,status code %d", name, response.StatusCode)}
+	}
+	return response.StatusCode, nil
+}
+
+// 从OBS下载数据，返回OBS响应的状态码
+func getFile(ctx context.Context, downloadUrl, name string, writer io.Writer) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := fileHttpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, &DeviceError{errorMsg: fmt.Sprintf("download file %s failed,status code %d", name, response.StatusCode)}
+	}
+	_, err = io.Copy(writer, response.Body)
+	return response.StatusCode, err
+}
+
+// 网络错误和OBS服务端错误可以重试
+func retryableFileTransfer(statusCode int, err error) bool {
+	return err != nil && (statusCode == 0 || statusCode >= http.StatusInternalServerError)
+}
+
+// 传输失败后重试，每次重试前调用reset重新定位本地文件
+func retryFileTransfer(ctx context.Context, name string, reset func() error, transfer func() (int, error)) (int, error) {
+	statusCode, err := transfer()
+	for i := 1; i < defaultFileTransferRetries && retryableFileTransfer(statusCode, err) && ctx.Err() == nil; i++ {
+		glog.Warningf("transfer file %s failed %v,retry %d", name, err, i)
+		select {
+		case <-time.After(fileTransferRetryInterval):
+		case <-ctx.Done():
+			return statusCode, err
+		}
+		if resetErr := reset(); resetErr != nil {
+			return statusCode, resetErr
+		}
+		statusCode, err = transfer()
+	}
+	return statusCode, err
+}
+
+// 上报文件上传下载结果，返回传输的错误
+func (device *baseIotDevice) finishFileTransfer(name, action string, statusCode int, err error) error {
+	response := CreateFileUploadDownLoadResultResponse(name, action, err == nil)
+	response.ObjectDeviceId = device.Id
+	paras := &response.Services[0].Paras
+	paras.StatusCode = statusCode
+	paras.StatusDescription = http.StatusText(statusCode)
+	if err != nil {
+		glog.Warningf("device %s %s file %s failed %v", device.Id, action, name, err)
+		paras.StatusDescription = err.Error()
+	}
+
+	token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(response))
+	if token.Wait() && token.Error() != nil {
+		glog.Warningf("device %s report %s result of file %s failed %v", device.Id, action, name, token.Error())
+		if err == nil {
+			return token.Error()
+		}
+	}
+	return err
+}
+
+// 上传本地文件，网络错误和OBS服务端错误时重试
+func (device *baseIotDevice) uploadFile(filename string) error {
+	file, err := os.Open(smartFileName(filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultFileTransferTimeout)
+	defer cancel()
+	uploadUrl, err := device.requestFileUrl(ctx, filename, FileActionUpload)
+	if err != nil {
+		return err
+	}
+	statusCode, err := retryFileTransfer(ctx, filename, func() error {
+		_, err := file.Seek(0, io.SeekStart)
+		return err
+	}, func() (int, error) {
+		return putFile(ctx, uploadUrl, filename, file, info.Size())
+	})
+	return device.finishFileTransfer(filename, FileActionUpload, statusCode, err)
+}
+
+// 下载文件保存到本地，网络错误和OBS服务端错误时重试，下载成功后才覆盖本地已有的文件
+func (device *baseIotDevice) downloadFile(filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultFileTransferTimeout)
+	defer cancel()
+	downloadUrl, err := device.requestFileUrl(ctx, filename, FileActionDownload)
+	if err != nil {
+		return err
+	}
+
+	statusCode := 0
+	err = saveFile(smartFileName(filename), func(file *os.File) error {
+		statusCode, err = retryFileTransfer(ctx, filename, func() error {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			_, err := file.Seek(0, io.SeekStart)
+			return err
+		}, func() (int, error) {
+			return getFile(ctx, downloadUrl, filename, file)
+		})
+		return err
+	})
+	return device.finishFileTransfer(filename, FileActionDownload, statusCode, err)
+}
+
+// 先写入同目录下的临时文件，成功后再重命名为目标文件，失败时删除临时文件，不影响已有的文件
+func saveFile(path string, write func(file *os.File) error) error {
+	tempPath := path + ".part"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+	}
+	return err
+}
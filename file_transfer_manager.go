@@ -0,0 +1,309 @@
+package iot
+
+import (
+	"context"
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTransferConcurrency      = 2
+	defaultTransferQueueSize        = 100
+	defaultTransferProgressInterval = time.Second
+)
+
+// 文件传输任务，Reader/Writer为nil时使用本地文件Path
+type TransferJob struct {
+	Action string    // FileActionUpload或者FileActionDownload
+	Name   string    // 平台上的文件名
+	Path   string    // 本地文件路径，下载成功后才覆盖已有的文件
+	Reader io.Reader // 上传的数据
+	Size   int64     // 上传数据的字节数，使用Path时自动获取
+	Writer io.Writer // 下载数据写入的位置
+}
+
+// 文件传输事件，Done为true时传输结束，Err为nil表示传输成功
+type TransferEvent struct {
+	Id          string
+	Action      string
+	Name        string
+	Transferred int64
+	Total       int64 // 传输的总字节数，未知时为0
+	Done        bool
+	Err         error
+}
+
+// 在传输协程中调用，不能阻塞
+type TransferEventHandler func(event TransferEvent)
+
+type TransferManagerConfig struct {
+	Concurrency      int           // 同时执行的传输任务数，默认2
+	QueueSize        int           // 等待执行的任务数上限，默认100
+	ProgressInterval time.Duration // 两次进度事件的最小间隔，默认1秒
+	EventHandler     TransferEventHandler
+}
+
+// 文件传输任务的句柄
+type TransferTask struct {
+	id     string
+	job    TransferJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+func (task *TransferTask) Id() string {
+	return task.id
+}
+
+// 取消任务，排队中的任务不再执行，执行中的任务中断传输
+func (task *TransferTask) Cancel() {
+	task.cancel()
+}
+
+// 等待任务结束并返回传输结果
+func (task *TransferTask) Wait() error {
+	<-task.done
+	return task.err
+}
+
+// 文件传输管理，任务排队后由固定数量的协程执行，执行过程中上报进度和完成事件
+type TransferManager struct {
+	device Device
+	config TransferManagerConfig
+
+	lock    sync.Mutex
+	queue   chan *TransferTask
+	tasks   map[string]*TransferTask
+	stopped bool
+	workers sync.WaitGroup
+}
+
+func NewTransferManager(device Device, config TransferManagerConfig) *TransferManager {
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultTransferConcurrency
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultTransferQueueSize
+	}
+	if config.ProgressInterval <= 0 {
+		config.ProgressInterval = defaultTransferProgressInterval
+	}
+
+	return &TransferManager{
+		device:  device,
+		config:  config,
+		stopped: true,
+	}
+}
+
+func (manager *TransferManager) Start() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if !manager.stopped {
+		return
+	}
+	manager.stopped = false
+	manager.queue = make(chan *TransferTask, manager.config.QueueSize)
+	manager.tasks = map[string]*TransferTask{}
+	for i := 0; i < manager.config.Concurrency; i++ {
+		manager.workers.Add(1)
+		go manager.work(manager.queue)
+	}
+}
+
+// 取消全部任务并等待执行中的任务结束
+func (manager *TransferManager) Stop() {
+	manager.lock.Lock()
+	if manager.stopped {
+		manager.lock.Unlock()
+		return
+	}
+	manager.stopped = true
+	for _, task := range manager.tasks {
+		task.cancel()
+	}
+	close(manager.queue)
+	manager.lock.Unlock()
+
+	manager.workers.Wait()
+}
+
+// 提交传输任务，队列已满或者管理器已经停止时返回错误
+func (manager *TransferManager) Submit(job TransferJob) (*TransferTask, error) {
+	if job.Action != FileActionUpload && job.Action != FileActionDownload {
+		return nil, &DeviceError{errorMsg: "unknown transfer action " + job.Action}
+	}
+	if len(job.Name) == 0 || (len(job.Path) == 0 && job.Reader == nil && job.Writer == nil) {
+		return nil, &DeviceError{errorMsg: "transfer job must have name and local file or stream"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &TransferTask{
+		id:     uuid.NewV4().String(),
+		job:    job,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.stopped {
+		cancel()
+		return nil, &DeviceError{errorMsg: "transfer manager is stopped"}
+	}
+	select {
+	case manager.queue <- task:
+		manager.tasks[task.id] = task
+		return task, nil
+	default:
+		cancel()
+		return nil, &DeviceError{errorMsg: "transfer queue is full"}
+	}
+}
+
+// 取消指定的任务
+func (manager *TransferManager) Cancel(id string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	task, ok := manager.tasks[id]
+	if ok {
+		task.cancel()
+	}
+	return ok
+}
+
+func (manager *TransferManager) work(queue chan *TransferTask) {
+	defer manager.workers.Done()
+	for task := range queue {
+		progress := &transferProgress{manager: manager, task: task, total: task.job.Size}
+		err := task.ctx.Err()
+		if err == nil {
+			err = manager.transfer(task, progress)
+		}
+		task.err = err
+		task.cancel()
+
+		manager.lock.Lock()
+		delete(manager.tasks, task.id)
+		manager.lock.Unlock()
+
+		if err != nil {
+			glog.Warningf("%s file %s failed %v", task.job.Action, task.job.Name, err)
+		}
+		transferred, total := progress.finish()
+		manager.emit(task, transferred, total, true, err)
+		close(task.done)
+	}
+}
+
+func (manager *TransferManager) transfer(task *TransferTask, progress *transferProgress) error {
+	job := task.job
+	if job.Action == FileActionUpload {
+		reader := job.Reader
+		if reader == nil {
+			file, err := os.Open(smartFileName(job.Path))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			reader = file
+			progress.total = info.Size()
+		}
+		return manager.device.UploadFrom(task.ctx, job.Name, &progressReader{reader: reader, progress: progress}, progress.total)
+	}
+
+	writer := job.Writer
+	if writer == nil {
+		return saveFile(smartFileName(job.Path), func(file *os.File) error {
+			return manager.device.DownloadTo(task.ctx, job.Name, &progressWriter{writer: file, progress: progress})
+		})
+	}
+	return manager.device.DownloadTo(task.ctx, job.Name, &progressWriter{writer: writer, progress: progress})
+}
+
+func (manager *TransferManager) emit(task *TransferTask, transferred, total int64, done bool, err error) {
+	if manager.config.EventHandler == nil {
+		return
+	}
+	manager.config.EventHandler(TransferEvent{
+		Id:          task.id,
+		Action:      task.job.Action,
+		Name:        task.job.Name,
+		Transferred: transferred,
+		Total:       total,
+		Done:        done,
+		Err:         err,
+	})
+}
+
+// 统计传输的字节数，按照最小间隔发送进度事件。传输失败后net/http的协程可能仍在读取数据，统计需要加锁
+type transferProgress struct {
+	manager *TransferManager
+	task    *TransferTask
+	total   int64
+
+	lock        sync.Mutex
+	transferred int64
+	lastEmit    time.Time
+	finished    bool
+}
+
+func (progress *transferProgress) add(n int) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	if progress.finished {
+		return
+	}
+	progress.transferred += int64(n)
+	now := time.Now()
+	if now.Sub(progress.lastEmit) < progress.manager.config.ProgressInterval && progress.transferred != progress.total {
+		return
+	}
+	progress.lastEmit = now
+	progress.manager.emit(progress.task, progress.transferred, progress.total, false, nil)
+}
+
+// 传输结束，不再发送进度事件，返回已经传输的字节数和总字节数
+func (progress *transferProgress) finish() (int64, int64) {
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	progress.finished = true
+	return progress.transferred, progress.total
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *transferProgress
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.progress.add(n)
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	writer   io.Writer
+	progress *transferProgress
+}
+
+func (writer *progressWriter) Write(p []byte) (int, error) {
+	n, err := writer.writer.Write(p)
+	if n > 0 {
+		writer.progress.add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,216 @@
+package iot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type transferEvents struct {
+	lock   sync.Mutex
+	events []TransferEvent
+}
+
+func (events *transferEvents) handle(event TransferEvent) {
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	events.events = append(events.events, event)
+}
+
+func (events *transferEvents) list() []TransferEvent {
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	return append([]TransferEvent{}, events.events...)
+}
+
+func TestTransferManager_Concurrency(t *testing.T) {
+	var running, maxRunning int32
+	obs := &fakeObsServer{}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		ioutil.ReadAll(request.Body)
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer obs.Close()
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+	events := &transferEvents{}
+	manager := NewTransferManager(device, TransferManagerConfig{Concurrency: 2, EventHandler: events.handle})
+	manager.Start()
+	defer manager.Stop()
+
+	var tasks []*TransferTask
+	for i := 0; i < 6; i++ {
+		content := strings.Repeat("image", 100)
+		task, err := manager.Submit(TransferJob{
+			Action: FileActionUpload,
+			Name:   fmt.Sprintf("image_%d.jpg", i),
+			Reader: strings.NewReader(content),
+			Size:   int64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks {
+		if err := task.Wait(); err != nil {
+			t.Errorf("upload task %s failed %v", task.Id(), err)
+		}
+	}
+
+	if atomic.LoadInt32(&maxRunning) != 2 {
+		t.Errorf("transfers must be limited by concurrency,max running %d", maxRunning)
+	}
+	done, progress := 0, 0
+	for _, event := range events.list() {
+		if event.Done && event.Err == nil && event.Transferred == 500 {
+			done++
+		}
+		if !event.Done && event.Total == 500 {
+			progress++
+		}
+	}
+	if done != 6 || progress < 6 {
+		t.Errorf("progress and completion events must be emitted for every task,done %d progress %d", done, progress)
+	}
+}
+
+func TestTransferManager_Cancel(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	obs.block = make(chan struct{})
+	defer close(obs.block)
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+	events := &transferEvents{}
+	manager := NewTransferManager(device, TransferManagerConfig{Concurrency: 1, QueueSize: 1, EventHandler: events.handle})
+	manager.Start()
+	defer manager.Stop()
+
+	running, _ := manager.Submit(TransferJob{Action: FileActionDownload, Name: "a.jpg", Writer: &bytes.Buffer{}})
+	deadline := time.Now().Add(time.Second)
+	for len(manager.queue) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	queued, err := manager.Submit(TransferJob{Action: FileActionDownload, Name: "b.jpg", Writer: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Submit(TransferJob{Action: FileActionDownload, Name: "c.jpg", Writer: &bytes.Buffer{}}); err == nil {
+		t.Errorf("task must be rejected when queue is full")
+	}
+
+	queued.Cancel()
+	if !manager.Cancel(running.Id()) {
+		t.Errorf("running task must be canceled by id")
+	}
+	if err := running.Wait(); err == nil {
+		t.Errorf("canceled running task must fail")
+	}
+	if err := queued.Wait(); err != context.Canceled {
+		t.Errorf("canceled queued task must not run,err %v", err)
+	}
+	for _, event := range events.list() {
+		if event.Done && event.Err == nil {
+			t.Errorf("canceled task must not complete successfully %+v", event)
+		}
+	}
+}
+
+func TestTransferManager_FailedUploadProgress(t *testing.T) {
+	// OBS不读取数据直接拒绝上传，net/http的协程可能仍在读取上传数据
+	obs := &fakeObsServer{}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusForbidden)
+	}))
+	defer obs.Close()
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+	events := &transferEvents{}
+	manager := NewTransferManager(device, TransferManagerConfig{ProgressInterval: time.Nanosecond, EventHandler: events.handle})
+	manager.Start()
+	defer manager.Stop()
+
+	size := int64(8 << 20)
+	task, err := manager.Submit(TransferJob{
+		Action: FileActionUpload,
+		Name:   "image.jpg",
+		Reader: io.LimitReader(zeroReader{}, size),
+		Size:   size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Wait() == nil {
+		t.Fatal("rejected upload must fail")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	list := events.list()
+	if last := list[len(list)-1]; !last.Done || last.Err == nil {
+		t.Errorf("no progress event must be emitted after failure %+v", last)
+	}
+}
+
+func TestTransferManager_CancelKeepExistingFile(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	obs.block = make(chan struct{})
+	defer close(obs.block)
+
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+	manager := NewTransferManager(device, TransferManagerConfig{})
+	manager.Start()
+	defer manager.Stop()
+
+	file, _ := ioutil.TempFile("", "download")
+	defer os.Remove(file.Name())
+	file.WriteString("local")
+	file.Close()
+	task, err := manager.Submit(TransferJob{Action: FileActionDownload, Name: "a.jpg", Path: file.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	task.Cancel()
+	if task.Wait() == nil {
+		t.Fatal("canceled download must fail")
+	}
+	if data, _ := ioutil.ReadFile(file.Name()); string(data) != "local" {
+		t.Errorf("canceled download must keep existing file,got %q", data)
+	}
+	if _, err := os.Stat(file.Name() + ".part"); !os.IsNotExist(err) {
+		t.Errorf("temp file must be removed")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,262 @@
+package iot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 模拟OBS的文件服务，上传的文件保存在内存中
+type fakeObsServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	files  map[string][]byte
+	status int
+	block  chan struct{}
+}
+
+func newFakeObsServer() *fakeObsServer {
+	obs := &fakeObsServer{files: map[string][]byte{}, status: http.StatusOK}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		obs.lock.Lock()
+		status, block := obs.status, obs.block
+		obs.lock.Unlock()
+		if block != nil {
+			writer.WriteHeader(http.StatusOK)
+			writer.(http.Flusher).Flush()
+			select {
+			case <-block:
+			case <-request.Context().Done():
+			}
+			return
+		}
+		if status != http.StatusOK {
+			writer.WriteHeader(status)
+			return
+		}
+
+		switch request.Method {
+		case http.MethodPut:
+			data, _ := ioutil.ReadAll(request.Body)
+			obs.lock.Lock()
+			obs.files[request.URL.Path] = data
+			obs.lock.Unlock()
+		case http.MethodGet:
+			obs.lock.Lock()
+			data, ok := obs.files[request.URL.Path]
+			obs.lock.Unlock()
+			if !ok {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writer.Write(data)
+		}
+	}))
+	return obs
+}
+
+func (obs *fakeObsServer) fileUrl(name string) string {
+	return obs.URL + "/" + name
+}
+
+// 平台收到获取文件URL的请求后下发fileUrl生成的OBS地址
+func serveFileUrls(device *iotDevice, client *fakeClient, fileUrl func(name string) string) {
+	client.onPublish = func(topic string, payload []byte) {
+		request := FileRequest{}
+		if json.Unmarshal(payload, &request) != nil || len(request.Services) == 0 {
+			return
+		}
+		event := request.Services[0]
+		if event.EventType != "get_upload_url" && event.EventType != "get_download_url" {
+			return
+		}
+		device.base.handlePlatformToDeviceData()(client, createPlatformEvent(event.EventType+"_response", FileResponseServiceEventParas{
+			Url:        fileUrl(event.Paras.FileName),
+			ObjectName: event.Paras.FileName,
+		}))
+	}
+}
+
+func lastFileResult(t *testing.T, client *fakeClient) FileResultResponseServiceEvent {
+	result := FileResultResponse{}
+	if !lastPublished(t, client, formatTopic(DeviceToPlatformTopic, deviceId), &result) || len(result.Services) == 0 {
+		t.Fatalf("file result must be reported")
+	}
+	return result.Services[0]
+}
+
+func TestUploadFromAndDownloadTo(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	content := strings.Repeat("log line\n", 1000)
+	if err := device.UploadFrom(context.Background(), "device.log", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	result := lastFileResult(t, client)
+	if result.EventType != "upload_result_report" || result.Paras.ResultCode != FileResultSuccess || result.Paras.StatusCode != http.StatusOK {
+		t.Errorf("upload success must be reported %+v", result)
+	}
+
+	out := &bytes.Buffer{}
+	if err := device.DownloadTo(context.Background(), "device.log", out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != content {
+		t.Errorf("downloaded content must be uploaded content")
+	}
+	if result := lastFileResult(t, client); result.EventType != "download_result_report" || result.Paras.ResultCode != FileResultSuccess {
+		t.Errorf("download success must be reported %+v", result)
+	}
+}
+
+func TestUploadFrom_StatusCode(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	obs.status = http.StatusForbidden
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	if device.UploadFrom(context.Background(), "device.log", strings.NewReader("log"), 3) == nil {
+		t.Fatal("upload must fail")
+	}
+	result := lastFileResult(t, client)
+	if result.Paras.ResultCode != FileResultFailed || result.Paras.StatusCode != http.StatusForbidden {
+		t.Errorf("upload failure must be reported with obs status code %+v", result)
+	}
+}
+
+func TestDownloadTo_Cancel(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	obs.block = make(chan struct{})
+	defer close(obs.block)
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if device.DownloadTo(ctx, "device.log", &bytes.Buffer{}) == nil {
+		t.Fatal("download must fail when context is done")
+	}
+	if result := lastFileResult(t, client); result.Paras.ResultCode != FileResultFailed {
+		t.Errorf("canceled download must be reported as failure %+v", result)
+	}
+}
+
+func TestUploadFrom_NoUrl(t *testing.T) {
+	device, client := createFakeIotDevice()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if device.UploadFrom(ctx, "device.log", strings.NewReader("log"), 3) == nil {
+		t.Fatal("upload must fail without url")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("upload must stop waiting for url when context is done")
+	}
+	if len(client.messages()) != 1 {
+		t.Errorf("only url request must be published")
+	}
+	if len(device.base.fileUrls.waiters) != 0 {
+		t.Errorf("url request must be removed")
+	}
+}
+
+func TestUploadFrom_EmptyFile(t *testing.T) {
+	var chunked bool
+	obs := &fakeObsServer{}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		obs.lock.Lock()
+		chunked = len(request.TransferEncoding) > 0
+		obs.lock.Unlock()
+		if request.ContentLength != 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer obs.Close()
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	if err := device.UploadFrom(context.Background(), "empty.log", strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if chunked {
+		t.Errorf("empty file must not be uploaded with chunked encoding")
+	}
+}
+
+func TestUploadFile_Retry(t *testing.T) {
+	var requests int
+	obs := &fakeObsServer{}
+	obs.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, _ := ioutil.ReadAll(request.Body)
+		obs.lock.Lock()
+		defer obs.lock.Unlock()
+		requests++
+		if requests == 1 || string(data) != "log" {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer obs.Close()
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	file, _ := ioutil.TempFile("", "upload")
+	defer os.Remove(file.Name())
+	file.WriteString("log")
+	file.Close()
+	if err := device.base.uploadFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	obs.lock.Lock()
+	defer obs.lock.Unlock()
+	if requests != 2 {
+		t.Errorf("failed upload must be retried with whole file,requests %d", requests)
+	}
+	if result := lastFileResult(t, client); result.Paras.ResultCode != FileResultSuccess {
+		t.Errorf("upload success must be reported once %+v", result)
+	}
+}
+
+func TestDownloadFile_KeepExistingFile(t *testing.T) {
+	obs := newFakeObsServer()
+	defer obs.Close()
+	device, client := createFakeIotDevice()
+	serveFileUrls(device, client, obs.fileUrl)
+
+	file, _ := ioutil.TempFile("", "download")
+	defer os.Remove(file.Name())
+	file.WriteString("local")
+	file.Close()
+	if device.base.downloadFile(file.Name()) == nil {
+		t.Fatal("download must fail when obs file does not exist")
+	}
+	if data, _ := ioutil.ReadFile(file.Name()); string(data) != "local" {
+		t.Errorf("failed download must keep existing file,got %q", data)
+	}
+	if _, err := os.Stat(file.Name() + ".part"); !os.IsNotExist(err) {
+		t.Errorf("temp file must be removed")
+	}
+
+	obs.files["/"+file.Name()] = []byte("remote")
+	if err := device.base.downloadFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(file.Name()); string(data) != "remote" {
+		t.Errorf("downloaded file must replace existing file,got %q", data)
+	}
+}
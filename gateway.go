@@ -1,11 +1,30 @@
 package iot
 
+import (
+	"context"
+)
+
 type baseGateway interface {
 	// 设置平台添加子设备回调函数
 	SetSubDevicesAddHandler(handler SubDevicesAddHandler)
 
 	// 设置平台删除子设备回调函数
 	SetSubDevicesDeleteHandler(handler SubDevicesDeleteHandler)
+
+	// 设置网关本地子设备列表，SDK根据平台通知自动更新，连接平台后自动同步
+	SetSubDeviceRegistry(registry *SubDeviceRegistry)
+
+	// 获取子设备，子设备通过网关的连接收发数据
+	SubDevice(deviceId string) SubDevice
+
+	// 获取子设备产品的handler，平台下发给该产品子设备的请求在子设备没有注册handler时回调
+	SubDeviceProduct(productId string) SubDeviceHandlers
+
+	// 获取未知子设备的兜底handler，子设备和所属产品都没有注册同类handler时回调，没有设置时由网关的handler处理
+	SubDeviceFallback() SubDeviceHandlers
+
+	// 注册子设备活动回调，网关上报子设备属性或者消息成功后回调
+	AddSubDeviceActivityHandler(handler SubDeviceActivityHandler)
 }
 
 type Gateway interface {
@@ -25,6 +44,18 @@ type Gateway interface {
 
 	// 网关同步特定版本子设备列表
 	SyncSubDevices(version int)
+
+	// 网关添加子设备并等待平台响应，返回添加成功和失败的子设备
+	AddSubDevicesWithResult(ctx context.Context, deviceInfos []DeviceInfo) (SubDeviceResult, error)
+
+	// 网关删除子设备并等待平台响应，返回删除成功和失败的子设备
+	DeleteSubDevicesWithResult(ctx context.Context, deviceIds []string) (SubDeviceResult, error)
+
+	// 网关更新子设备状态并等待平台响应，返回更新成功和失败的子设备
+	UpdateSubDeviceStateWithResult(ctx context.Context, subDevicesStatus SubDevicesStatus) (SubDeviceResult, error)
+
+	// 网关同步特定版本子设备列表并等待平台响应，返回平台下发的子设备
+	SyncSubDevicesWithResult(ctx context.Context, version int) (SubDeviceResult, error)
 }
 
 type AsyncGateway interface {
@@ -44,4 +75,16 @@ type AsyncGateway interface {
 
 	// 网关同步特定版本子设备列表
 	SyncSubDevices(version int) AsyncResult
+
+	// 网关添加子设备，平台响应后返回添加成功和失败的子设备
+	AddSubDevicesWithResult(ctx context.Context, deviceInfos []DeviceInfo) *SubDeviceAsyncResult
+
+	// 网关删除子设备，平台响应后返回删除成功和失败的子设备
+	DeleteSubDevicesWithResult(ctx context.Context, deviceIds []string) *SubDeviceAsyncResult
+
+	// 网关更新子设备状态，平台响应后返回更新成功和失败的子设备
+	UpdateSubDeviceStateWithResult(ctx context.Context, subDevicesStatus SubDevicesStatus) *SubDeviceAsyncResult
+
+	// 网关同步特定版本子设备列表，平台响应后返回平台下发的子设备
+	SyncSubDevicesWithResult(ctx context.Context, version int) *SubDeviceAsyncResult
 }
@@ -0,0 +1,454 @@
+package iot
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 本地子设备与网关之间的topic，{device_id}为子设备在平台的设备ID
+const (
+	// LocalPropertiesReportTopic 子设备上报属性，payload为DeviceProperties
+	LocalPropertiesReportTopic = "devices/{device_id}/properties/report"
+
+	// LocalMessageUpTopic 子设备上报消息，payload为Message，不是JSON时作为消息内容
+	LocalMessageUpTopic = "devices/{device_id}/messages/up"
+
+	// LocalMessageDownTopic 网关转发平台下发的消息
+	LocalMessageDownTopic = "devices/{device_id}/messages/down"
+
+	// LocalCommandTopic 网关转发平台下发的命令，子设备使用相同的request_id响应
+	LocalCommandTopic         = "devices/{device_id}/commands/request_id="
+	LocalCommandResponseTopic = "devices/{device_id}/commands/response/request_id="
+
+	// LocalPropertiesSetTopic 网关转发平台设置属性请求，响应payload为{"result_code":0}
+	LocalPropertiesSetTopic         = "devices/{device_id}/properties/set/request_id="
+	LocalPropertiesSetResponseTopic = "devices/{device_id}/properties/set/response/request_id="
+
+	// LocalPropertiesGetTopic 网关转发平台查询属性请求，响应payload为DevicePropertyEntry
+	LocalPropertiesGetTopic         = "devices/{device_id}/properties/get/request_id="
+	LocalPropertiesGetResponseTopic = "devices/{device_id}/properties/get/response/request_id="
+)
+
+const defaultLocalBrokerRequestTimeout = 10 * time.Second
+
+type LocalBrokerConfig struct {
+	Address        string            // 监听地址，如:1883
+	Credentials    map[string]string // 子设备ID -> 密码，子设备使用设备ID作为用户名连接
+	RequestTimeout time.Duration     // 等待子设备响应命令和属性请求以及向子设备写入数据的超时时间，默认10秒
+}
+
+// 网关内置的MQTT broker，供不能直接连接平台的子设备接入。子设备只能发布和订阅自己的topic，
+// 上行数据通过网关上报给平台，平台下发给子设备的请求转发给连接的子设备。上行消息支持QoS 0/1/2，下行消息使用QoS 0
+type LocalBroker struct {
+	device Device
+	config LocalBrokerConfig
+
+	lock     sync.Mutex
+	listener net.Listener
+	sessions map[string]*brokerSession // 子设备ID -> 会话
+	bound    map[string]bool           // 已经注册平台请求handler的子设备
+	pending  map[string]chan []byte    // request_id -> 子设备响应
+}
+
+type brokerSession struct {
+	deviceId     string
+	conn         net.Conn
+	writeTimeout time.Duration
+
+	writeLock sync.Mutex
+
+	lock          sync.Mutex
+	subscriptions map[string]byte
+	received      map[uint16]bool // 已经收到但是子设备还没有发送PUBREL的QoS 2消息
+}
+
+func NewLocalBroker(device Device, config LocalBrokerConfig) *LocalBroker {
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultLocalBrokerRequestTimeout
+	}
+
+	return &LocalBroker{
+		device:   device,
+		config:   config,
+		sessions: map[string]*brokerSession{},
+		bound:    map[string]bool{},
+		pending:  map[string]chan []byte{},
+	}
+}
+
+// 开始监听子设备连接
+func (broker *LocalBroker) Start() error {
+	listener, err := net.Listen("tcp", broker.config.Address)
+	if err != nil {
+		return err
+	}
+	broker.lock.Lock()
+	broker.listener = listener
+	broker.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				glog.Infof("local broker stop accept connections %v", err)
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// 监听地址，Start之后有效
+func (broker *LocalBroker) Addr() net.Addr {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.listener == nil {
+		return nil
+	}
+	return broker.listener.Addr()
+}
+
+// 停止监听并断开全部子设备
+func (broker *LocalBroker) Stop() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.listener != nil {
+		broker.listener.Close()
+		broker.listener = nil
+	}
+	for _, session := range broker.sessions {
+		session.conn.Close()
+	}
+}
+
+func (broker *LocalBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(broker.config.RequestTimeout))
+	packet, err := readMqttPacket(reader)
+	if err != nil || packet.packetType != mqttConnect {
+		glog.Warningf("local broker read connect packet from %s failed", conn.RemoteAddr())
+		return
+	}
+	session, keepAlive, code := broker.connect(conn, packet.body)
+	conn.SetWriteDeadline(time.Now().Add(broker.config.RequestTimeout))
+	conn.Write(encodeMqttPacket(mqttConnack, 0, []byte{0, code}))
+	if code != mqttConnectAccepted {
+		return
+	}
+	defer broker.disconnect(session)
+	glog.Infof("sub device %s connect to local broker", session.deviceId)
+
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch packet.packetType {
+		case mqttPublish:
+			publish, err := parseMqttPublish(packet)
+			if err != nil {
+				return
+			}
+			// 转发到平台成功后才确认，转发失败时不确认，由子设备重发
+			packetId := []byte{byte(publish.packetId >> 8), byte(publish.packetId)}
+			switch publish.qos {
+			case 0:
+				broker.handlePublish(session, publish)
+			case 1:
+				if broker.handlePublish(session, publish) {
+					session.write(encodeMqttPacket(mqttPuback, 0, packetId))
+				}
+			default:
+				// QoS 2的消息在收到PUBREL之前重发时不再处理
+				if session.receive(publish.packetId) && !broker.handlePublish(session, publish) {
+					session.release(publish.packetId)
+					continue
+				}
+				session.write(encodeMqttPacket(mqttPubrec, 0, packetId))
+			}
+		case mqttPubrel:
+			if len(packet.body) < 2 {
+				return
+			}
+			session.release(uint16(packet.body[0])<<8 | uint16(packet.body[1]))
+			session.write(encodeMqttPacket(mqttPubcomp, 0, packet.body[:2]))
+		case mqttSubscribe:
+			packetId, filters, err := parseMqttSubscribe(packet.body, true)
+			if err != nil {
+				return
+			}
+			session.write(encodeMqttPacket(mqttSuback, 0, session.subscribe(packetId, filters)))
+		case mqttUnsubscribe:
+			packetId, filters, err := parseMqttSubscribe(packet.body, false)
+			if err != nil {
+				return
+			}
+			session.unsubscribe(filters)
+			session.write(encodeMqttPacket(mqttUnsuback, 0, []byte{byte(packetId >> 8), byte(packetId)}))
+		case mqttPingreq:
+			session.write(encodeMqttPacket(mqttPingresp, 0, nil))
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// 校验子设备身份，同一个子设备重复连接时断开之前的连接
+func (broker *LocalBroker) connect(conn net.Conn, body []byte) (*brokerSession, time.Duration, byte) {
+	connect, err := parseMqttConnect(body)
+	if err != nil {
+		return nil, 0, mqttConnectBadProtocol
+	}
+	password, ok := broker.config.Credentials[connect.username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(connect.password)) != 1 {
+		glog.Warningf("sub device %s connect to local broker with wrong credential", connect.username)
+		return nil, 0, mqttConnectBadUsernamePassword
+	}
+
+	session := &brokerSession{
+		deviceId:      connect.username,
+		conn:          conn,
+		writeTimeout:  broker.config.RequestTimeout,
+		subscriptions: map[string]byte{},
+		received:      map[uint16]bool{},
+	}
+	broker.lock.Lock()
+	if old, ok := broker.sessions[session.deviceId]; ok {
+		old.conn.Close()
+	}
+	broker.sessions[session.deviceId] = session
+	bound := broker.bound[session.deviceId]
+	broker.bound[session.deviceId] = true
+	broker.lock.Unlock()
+
+	if !bound {
+		broker.bind(session.deviceId)
+	}
+	return session, time.Duration(connect.keepAlive) * time.Second, mqttConnectAccepted
+}
+
+func (broker *LocalBroker) disconnect(session *brokerSession) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.sessions[session.deviceId] == session {
+		delete(broker.sessions, session.deviceId)
+	}
+	glog.Infof("sub device %s disconnect from local broker", session.deviceId)
+}
+
+func (broker *LocalBroker) session(deviceId string) *brokerSession {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	return broker.sessions[deviceId]
+}
+
+// 处理子设备发布的消息，子设备只能发布自己的topic。属性和消息在当前连接上同步转发到平台，
+// 转发失败时返回false，无效的消息直接丢弃
+func (broker *LocalBroker) handlePublish(session *brokerSession, publish *mqttPublishPacket) bool {
+	prefix := "devices/" + session.deviceId + "/"
+	if !strings.HasPrefix(publish.topic, prefix) {
+		glog.Warningf("sub device %s publish to unauthorized topic %s", session.deviceId, publish.topic)
+		return true
+	}
+
+	subDevice := broker.device.SubDevice(session.deviceId)
+	topic := publish.topic
+	switch {
+	case topic == formatTopic(LocalPropertiesReportTopic, session.deviceId):
+		properties := DeviceProperties{}
+		if json.Unmarshal(publish.payload, &properties) != nil {
+			glog.Warningf("sub device %s report invalid properties", session.deviceId)
+			return true
+		}
+		return subDevice.ReportProperties(properties)
+	case topic == formatTopic(LocalMessageUpTopic, session.deviceId):
+		message := Message{}
+		if json.Unmarshal(publish.payload, &message) != nil {
+			message = Message{Content: string(publish.payload)}
+		}
+		return subDevice.SendMessage(message)
+	case strings.HasPrefix(topic, formatTopic(LocalCommandResponseTopic, session.deviceId)),
+		strings.HasPrefix(topic, formatTopic(LocalPropertiesSetResponseTopic, session.deviceId)),
+		strings.HasPrefix(topic, formatTopic(LocalPropertiesGetResponseTopic, session.deviceId)):
+		broker.complete(getTopicRequestId(topic), publish.payload)
+	default:
+		glog.Warningf("sub device %s publish to unknown topic %s", session.deviceId, topic)
+	}
+	return true
+}
+
+func (broker *LocalBroker) complete(requestId string, payload []byte) {
+	broker.lock.Lock()
+	response, ok := broker.pending[requestId]
+	delete(broker.pending, requestId)
+	broker.lock.Unlock()
+	if !ok {
+		glog.Warningf("local broker receive unknown response,request id = %s", requestId)
+		return
+	}
+	response <- payload
+}
+
+// 向子设备发布消息，子设备没有订阅topic时丢弃
+func (broker *LocalBroker) publish(deviceId, topic string, payload []byte) error {
+	session := broker.session(deviceId)
+	if session == nil {
+		return &DeviceError{errorMsg: "sub device " + deviceId + " is not connected to local broker"}
+	}
+	if !session.subscribed(topic) {
+		return &DeviceError{errorMsg: "sub device " + deviceId + " does not subscribe " + topic}
+	}
+
+	body := appendMqttString(nil, topic)
+	return session.write(encodeMqttPacket(mqttPublish, 0, append(body, payload...)))
+}
+
+// 向子设备发送请求并等待子设备响应
+func (broker *LocalBroker) request(deviceId, topic string, payload interface{}) ([]byte, error) {
+	requestId := uuid.NewV4().String()
+	response := make(chan []byte, 1)
+	broker.lock.Lock()
+	broker.pending[requestId] = response
+	broker.lock.Unlock()
+	defer func() {
+		broker.lock.Lock()
+		delete(broker.pending, requestId)
+		broker.lock.Unlock()
+	}()
+
+	if err := broker.publish(deviceId, formatTopic(topic, deviceId)+requestId, []byte(Interface2JsonString(payload))); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), broker.config.RequestTimeout)
+	defer cancel()
+	select {
+	case data := <-response:
+		return data, nil
+	case <-ctx.Done():
+		return nil, &DeviceError{errorMsg: "wait sub device " + deviceId + " response timeout"}
+	}
+}
+
+// 将平台下发给子设备的请求转发给本地子设备
+func (broker *LocalBroker) bind(deviceId string) {
+	subDevice := broker.device.SubDevice(deviceId)
+	subDevice.AddMessageHandler(func(message Message) bool {
+		if err := broker.publish(deviceId, formatTopic(LocalMessageDownTopic, deviceId), []byte(Interface2JsonString(message))); err != nil {
+			glog.Warningf("forward message to sub device %s failed %v", deviceId, err)
+			return false
+		}
+		return true
+	})
+	subDevice.AddCommandHandler(func(command Command) (bool, interface{}) {
+		data, err := broker.request(deviceId, LocalCommandTopic, command)
+		if err != nil {
+			glog.Warningf("forward command to sub device %s failed %v", deviceId, err)
+			return false, err.Error()
+		}
+		response := CommandResponse{}
+		if json.Unmarshal(data, &response) != nil {
+			return false, "invalid command response"
+		}
+		return response.ResultCode == 0, response.Paras
+	})
+	subDevice.AddPropertiesSetHandler(func(request DevicePropertyDownRequest) bool {
+		data, err := broker.request(deviceId, LocalPropertiesSetTopic, request)
+		if err != nil {
+			glog.Warningf("forward properties set to sub device %s failed %v", deviceId, err)
+			return false
+		}
+		response := struct {
+			ResultCode byte `json:"result_code"`
+		}{}
+		return json.Unmarshal(data, &response) == nil && response.ResultCode == 0
+	})
+	subDevice.SetPropertyQueryHandler(func(query DevicePropertyQueryRequest) DevicePropertyEntry {
+		entry := DevicePropertyEntry{ServiceId: query.ServiceId}
+		data, err := broker.request(deviceId, LocalPropertiesGetTopic, query)
+		if err != nil {
+			glog.Warningf("forward properties query to sub device %s failed %v", deviceId, err)
+			return entry
+		}
+		json.Unmarshal(data, &entry)
+		return entry
+	})
+}
+
+// 写入超时后返回错误，避免一个不读取数据的子设备阻塞发给它的全部消息
+func (session *brokerSession) write(packet []byte) error {
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+	session.conn.SetWriteDeadline(time.Now().Add(session.writeTimeout))
+	_, err := session.conn.Write(packet)
+	return err
+}
+
+// 记录收到的QoS 2消息，消息第一次收到时返回true
+func (session *brokerSession) receive(packetId uint16) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.received[packetId] {
+		return false
+	}
+	session.received[packetId] = true
+	return true
+}
+
+func (session *brokerSession) release(packetId uint16) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	delete(session.received, packetId)
+}
+
+// 子设备只能订阅自己的topic，其他topic返回订阅失败
+func (session *brokerSession) subscribe(packetId uint16, filters []mqttTopicFilter) []byte {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	result := []byte{byte(packetId >> 8), byte(packetId)}
+	for _, filter := range filters {
+		if !strings.HasPrefix(filter.filter, "devices/"+session.deviceId+"/") {
+			result = append(result, 0x80)
+			continue
+		}
+		session.subscriptions[filter.filter] = 0
+		result = append(result, 0)
+	}
+	return result
+}
+
+func (session *brokerSession) unsubscribe(filters []mqttTopicFilter) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for _, filter := range filters {
+		delete(session.subscriptions, filter.filter)
+	}
+}
+
+func (session *brokerSession) subscribed(topic string) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	for filter := range session.subscriptions {
+		if mqttTopicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package iot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// 本地broker支持的MQTT 3.1.1控制报文类型
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttPubrec      byte = 5
+	mqttPubrel      byte = 6
+	mqttPubcomp     byte = 7
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// CONNACK返回码
+const (
+	mqttConnectAccepted            byte = 0
+	mqttConnectBadProtocol         byte = 1
+	mqttConnectBadUsernamePassword byte = 4
+	mqttConnectNotAuthorized       byte = 5
+)
+
+// 报文剩余长度上限，本地子设备的报文不需要更大的长度
+const mqttMaxPacketSize = 1 << 20
+
+type mqttPacket struct {
+	packetType byte
+	flags      byte
+	body       []byte
+}
+
+func readMqttPacket(reader *bufio.Reader) (*mqttPacket, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if multiplier > 128*128 {
+			return nil, &DeviceError{errorMsg: "mqtt remaining length is malformed"}
+		}
+	}
+	if length > mqttMaxPacketSize {
+		return nil, &DeviceError{errorMsg: "mqtt packet is too large"}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{packetType: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+func encodeMqttPacket(packetType, flags byte, body []byte) []byte {
+	packet := []byte{packetType<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// 按照MQTT格式读取报文中的字段
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *mqttReader) uint16() uint16 {
+	if reader.err != nil {
+		return 0
+	}
+	if len(reader.data) < 2 {
+		reader.err = &DeviceError{errorMsg: "mqtt packet is truncated"}
+		return 0
+	}
+	value := binary.BigEndian.Uint16(reader.data)
+	reader.data = reader.data[2:]
+	return value
+}
+
+func (reader *mqttReader) byte() byte {
+	if reader.err != nil {
+		return 0
+	}
+	if len(reader.data) < 1 {
+		reader.err = &DeviceError{errorMsg: "mqtt packet is truncated"}
+		return 0
+	}
+	value := reader.data[0]
+	reader.data = reader.data[1:]
+	return value
+}
+
+func (reader *mqttReader) bytes() []byte {
+	length := int(reader.uint16())
+	if reader.err != nil {
+		return nil
+	}
+	if len(reader.data) < length {
+		reader.err = &DeviceError{errorMsg: "mqtt packet is truncated"}
+		return nil
+	}
+	value := reader.data[:length]
+	reader.data = reader.data[length:]
+	return value
+}
+
+func (reader *mqttReader) string() string {
+	return string(reader.bytes())
+}
+
+func appendMqttString(data []byte, value string) []byte {
+	data = append(data, byte(len(value)>>8), byte(len(value)))
+	return append(data, value...)
+}
+
+type mqttConnectPacket struct {
+	protocolLevel byte
+	keepAlive     uint16
+	clientId      string
+	username      string
+	password      string
+}
+
+func parseMqttConnect(body []byte) (*mqttConnectPacket, error) {
+	reader := &mqttReader{data: body}
+	protocol := reader.string()
+	connect := &mqttConnectPacket{protocolLevel: reader.byte()}
+	flags := reader.byte()
+	connect.keepAlive = reader.uint16()
+	connect.clientId = reader.string()
+	if flags&0x04 != 0 {
+		reader.string() // will topic
+		reader.bytes()  // will message
+	}
+	if flags&0x80 != 0 {
+		connect.username = reader.string()
+	}
+	if flags&0x40 != 0 {
+		connect.password = reader.string()
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if protocol != "MQTT" && protocol != "MQIsdp" {
+		return nil, &DeviceError{errorMsg: "unknown mqtt protocol " + protocol}
+	}
+	return connect, nil
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	qos      byte
+	packetId uint16
+	payload  []byte
+}
+
+func parseMqttPublish(packet *mqttPacket) (*mqttPublishPacket, error) {
+	reader := &mqttReader{data: packet.body}
+	publish := &mqttPublishPacket{
+		topic: reader.string(),
+		qos:   (packet.flags >> 1) & 0x03,
+	}
+	if publish.qos > 0 {
+		publish.packetId = reader.uint16()
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	publish.payload = reader.data
+	return publish, nil
+}
+
+type mqttTopicFilter struct {
+	filter string
+	qos    byte
+}
+
+// 解析SUBSCRIBE和UNSUBSCRIBE报文，UNSUBSCRIBE报文没有QoS
+func parseMqttSubscribe(body []byte, withQos bool) (uint16, []mqttTopicFilter, error) {
+	reader := &mqttReader{data: body}
+	packetId := reader.uint16()
+	var filters []mqttTopicFilter
+	for reader.err == nil && len(reader.data) > 0 {
+		filter := mqttTopicFilter{filter: reader.string()}
+		if withQos {
+			filter.qos = reader.byte()
+		}
+		filters = append(filters, filter)
+	}
+	if reader.err != nil {
+		return 0, nil, reader.err
+	}
+	return packetId, filters, nil
+}
+
+// 判断topic是否匹配订阅的topic filter，支持+和#通配符
+func mqttTopicMatch(filter, topic string) bool {
+	for {
+		filterLevel, filterRest, filterMore := cutMqttLevel(filter)
+		topicLevel, topicRest, topicMore := cutMqttLevel(topic)
+		if filterLevel == "#" {
+			return true
+		}
+		if filterLevel != "+" && filterLevel != topicLevel {
+			return false
+		}
+		if !filterMore || !topicMore {
+			return !filterMore && !topicMore || (filterMore && filterRest == "#")
+		}
+		filter, topic = filterRest, topicRest
+	}
+}
+
+func cutMqttLevel(topic string) (string, string, bool) {
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '/' {
+			return topic[:i], topic[i+1:], true
+		}
+	}
+	return topic, "", false
+}
@@ -0,0 +1,217 @@
+package iot
+
+import (
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+func startLocalBroker(t *testing.T) (*LocalBroker, *iotDevice, *fakeClient) {
+	device, client := createFakeIotDevice()
+	device.base.subDeviceBatcher.interval = 10 * time.Millisecond
+	broker := NewLocalBroker(device, LocalBrokerConfig{
+		Address:        "127.0.0.1:0",
+		Credentials:    map[string]string{"sub-1": "secret", "sub-2": "secret"},
+		RequestTimeout: time.Second,
+	})
+	if err := broker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return broker, device, client
+}
+
+func connectLocalBroker(broker *LocalBroker, username, password string) (mqtt.Client, error) {
+	options := mqtt.NewClientOptions()
+	options.AddBroker("tcp://" + broker.Addr().String())
+	options.SetClientID(username)
+	options.SetUsername(username)
+	options.SetPassword(password)
+	options.SetAutoReconnect(false)
+	options.SetConnectRetry(false)
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	token.WaitTimeout(time.Second)
+	return client, token.Error()
+}
+
+func TestLocalBroker_RejectWrongPassword(t *testing.T) {
+	broker, _, _ := startLocalBroker(t)
+	defer broker.Stop()
+
+	if _, err := connectLocalBroker(broker, "sub-1", "wrong"); err == nil {
+		t.Errorf("connect with wrong password must be rejected")
+	}
+	if _, err := connectLocalBroker(broker, "unknown", "secret"); err == nil {
+		t.Errorf("connect with unknown device must be rejected")
+	}
+	client, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Disconnect(0)
+}
+
+func TestLocalBroker_ReportProperties(t *testing.T) {
+	broker, device, client := startLocalBroker(t)
+	defer broker.Stop()
+	sub, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+
+	sub.Publish(formatTopic(LocalPropertiesReportTopic, "sub-1"), 1, false, Interface2JsonString(DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+	})).WaitTimeout(time.Second)
+	// 不能冒充其他子设备上报
+	sub.Publish(formatTopic(LocalPropertiesReportTopic, "sub-2"), 1, false, Interface2JsonString(DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 2}}},
+	})).WaitTimeout(time.Second)
+
+	time.Sleep(100 * time.Millisecond)
+	service := DevicesService{}
+	if !lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service) {
+		t.Fatalf("sub device properties must be reported by gateway")
+	}
+	if len(service.Devices) != 1 || service.Devices[0].DeviceId != "sub-1" {
+		t.Errorf("only sub-1 properties must be reported %s", Interface2JsonString(service))
+	}
+}
+
+func TestLocalBroker_PublishQos2(t *testing.T) {
+	broker, device, client := startLocalBroker(t)
+	defer broker.Stop()
+	sub, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+
+	token := sub.Publish(formatTopic(LocalPropertiesReportTopic, "sub-1"), 2, false, Interface2JsonString(DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+	}))
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("qos 2 publish must complete %v", token.Error())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	service := DevicesService{}
+	if !lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service) || len(service.Devices) != 1 {
+		t.Errorf("qos 2 properties must be reported by gateway")
+	}
+}
+
+func TestLocalBroker_AckAfterForward(t *testing.T) {
+	broker, _, client := startLocalBroker(t)
+	defer broker.Stop()
+	client.lock.Lock()
+	client.publishErr = func(topic string, payload []byte) error {
+		return &DeviceError{errorMsg: "connection lost"}
+	}
+	client.lock.Unlock()
+	sub, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+
+	properties := Interface2JsonString(DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+	})
+	for _, qos := range []byte{1, 2} {
+		if sub.Publish(formatTopic(LocalPropertiesReportTopic, "sub-1"), qos, false, properties).WaitTimeout(200 * time.Millisecond) {
+			t.Errorf("qos %d publish must not be acknowledged when gateway report failed", qos)
+		}
+	}
+}
+
+func TestLocalBroker_CommandRoundTrip(t *testing.T) {
+	broker, device, client := startLocalBroker(t)
+	defer broker.Stop()
+	sub, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+
+	token := sub.Subscribe("devices/sub-1/commands/#", 0, func(c mqtt.Client, message mqtt.Message) {
+		command := Command{}
+		json.Unmarshal(message.Payload(), &command)
+		response := CommandResponse{Paras: command.CommandName + " done"}
+		c.Publish(formatTopic(LocalCommandResponseTopic, "sub-1")+getTopicRequestId(message.Topic()), 0, false,
+			Interface2JsonString(response))
+	})
+	token.WaitTimeout(time.Second)
+
+	responses := make(chan CommandResponse, 1)
+	client.onPublish = func(topic string, payload []byte) {
+		response := CommandResponse{}
+		json.Unmarshal(payload, &response)
+		responses <- response
+	}
+	device.base.createCommandMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=1",
+		payload: []byte(Interface2JsonString(Command{ObjectDeviceId: "sub-1", CommandName: "reboot"})),
+	})
+
+	select {
+	case response := <-responses:
+		if response.ResultCode != 0 || response.Paras != "reboot done" {
+			t.Errorf("command response must come from sub device %s", Interface2JsonString(response))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("gateway must respond command")
+	}
+
+	// 子设备断开后命令执行失败
+	sub.Disconnect(0)
+	time.Sleep(50 * time.Millisecond)
+	device.base.createCommandMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=2",
+		payload: []byte(Interface2JsonString(Command{ObjectDeviceId: "sub-1", CommandName: "reboot"})),
+	})
+	select {
+	case response := <-responses:
+		if response.ResultCode == 0 {
+			t.Errorf("command to offline sub device must fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("gateway must respond command")
+	}
+}
+
+func TestLocalBroker_SubscribeAcl(t *testing.T) {
+	broker, _, _ := startLocalBroker(t)
+	defer broker.Stop()
+	sub, err := connectLocalBroker(broker, "sub-1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+
+	token := sub.Subscribe("devices/sub-2/#", 0, nil)
+	token.WaitTimeout(time.Second)
+	result := token.(*mqtt.SubscribeToken).Result()
+	if result["devices/sub-2/#"] != 0x80 {
+		t.Errorf("subscribe other sub device topic must be rejected but is %v", result)
+	}
+}
+
+func TestMqttTopicMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"devices/sub-1/#", "devices/sub-1/commands/request_id=1", true},
+		{"devices/sub-1/#", "devices/sub-1", true},
+		{"devices/+/messages/down", "devices/sub-1/messages/down", true},
+		{"devices/+/messages/down", "devices/sub-1/messages/up", false},
+		{"devices/sub-1/commands", "devices/sub-1/commands/request_id=1", false},
+	}
+	for _, c := range cases {
+		if mqttTopicMatch(c.filter, c.topic) != c.match {
+			t.Errorf("match %s with %s must be %v", c.filter, c.topic, c.match)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package iot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHttpIngestPollTimeout    = 30 * time.Second
+	defaultHttpIngestCommandTimeout = 15 * time.Second
+	maxHttpIngestPollTimeout        = 5 * time.Minute
+	httpIngestCommandQueueSize      = 16
+	maxHttpIngestBodySize           = 1 << 20
+)
+
+type HttpIngestConfig struct {
+	Address        string            // 监听地址，如:8080
+	Credentials    map[string]string // 子设备ID -> 密码，子设备使用HTTP Basic认证，用户名为子设备ID
+	PollTimeout    time.Duration     // 长轮询没有命令时的等待时间，默认30秒，请求可以通过timeout参数（秒）指定
+	CommandTimeout time.Duration     // 命令等待子设备取走并响应的时间，默认15秒，需要小于平台同步命令的超时时间（20秒）
+}
+
+// 网关本地的HTTP服务，供只能发送HTTP请求的子设备接入。接口与平台HTTP接口保持一致：
+//
+//	POST /v5/devices/{device_id}/sys/properties/report 上报属性，body为DeviceProperties
+//	POST /v5/devices/{device_id}/sys/messages/up 上报消息，body为Message
+//	GET  /v5/devices/{device_id}/sys/commands 长轮询获取平台下发的命令，没有命令时返回204
+//	POST /v5/devices/{device_id}/sys/commands/response/request_id={request_id} 响应命令，body为CommandResponse
+type HttpIngestServer struct {
+	device Device
+	config HttpIngestConfig
+
+	lock     sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	queues   map[string]chan httpIngestCommand // 子设备ID -> 待取走的命令
+	pending  map[string]chan CommandResponse   // request_id -> 子设备响应
+}
+
+type httpIngestCommand struct {
+	RequestId string  `json:"request_id"`
+	Command   Command `json:"command"`
+}
+
+func NewHttpIngestServer(device Device, config HttpIngestConfig) *HttpIngestServer {
+	if config.PollTimeout <= 0 {
+		config.PollTimeout = defaultHttpIngestPollTimeout
+	}
+	if config.CommandTimeout <= 0 {
+		config.CommandTimeout = defaultHttpIngestCommandTimeout
+	}
+
+	return &HttpIngestServer{
+		device:  device,
+		config:  config,
+		queues:  map[string]chan httpIngestCommand{},
+		pending: map[string]chan CommandResponse{},
+	}
+}
+
+// 开始监听子设备请求
+func (server *HttpIngestServer) Start() error {
+	listener, err := net.Listen("tcp", server.config.Address)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: server}
+	for deviceId := range server.config.Credentials {
+		server.queue(deviceId)
+	}
+
+	server.lock.Lock()
+	server.listener = listener
+	server.server = httpServer
+	server.lock.Unlock()
+
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			glog.Warningf("http ingest server stopped %v", err)
+		}
+	}()
+	return nil
+}
+
+// 监听地址，Start之后有效
+func (server *HttpIngestServer) Addr() net.Addr {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+func (server *HttpIngestServer) Stop() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.server != nil {
+		server.server.Close()
+		server.server = nil
+		server.listener = nil
+	}
+}
+
+func (server *HttpIngestServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) < 5 || parts[0] != "v5" || parts[1] != "devices" || parts[3] != "sys" {
+		http.NotFound(writer, request)
+		return
+	}
+	deviceId := parts[2]
+
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="gateway"`)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if expected, exist := server.config.Credentials[username]; !exist || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		glog.Warningf("sub device %s request http ingest server with wrong credential", username)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if username != deviceId {
+		glog.Warningf("sub device %s request resource of sub device %s", username, deviceId)
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	resource := strings.Join(parts[4:], "/")
+	switch {
+	case resource == "properties/report" && request.Method == http.MethodPost:
+		server.reportProperties(writer, request, deviceId)
+	case resource == "messages/up" && request.Method == http.MethodPost:
+		server.sendMessage(writer, request, deviceId)
+	case resource == "commands" && request.Method == http.MethodGet:
+		server.pollCommand(writer, request, deviceId)
+	case strings.HasPrefix(resource, "commands/response/request_id=") && request.Method == http.MethodPost:
+		server.respondCommand(writer, request, getTopicRequestId(resource))
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (server *HttpIngestServer) reportProperties(writer http.ResponseWriter, request *http.Request, deviceId string) {
+	properties := DeviceProperties{}
+	if !readHttpIngestBody(writer, request, &properties) {
+		return
+	}
+
+	ok := server.device.BatchReportSubDevicesProperties(DevicesService{
+		Devices: []DeviceService{{DeviceId: deviceId, Services: properties.Services}},
+	})
+	writeHttpIngestResult(writer, ok)
+}
+
+func (server *HttpIngestServer) sendMessage(writer http.ResponseWriter, request *http.Request, deviceId string) {
+	message := Message{}
+	if !readHttpIngestBody(writer, request, &message) {
+		return
+	}
+
+	writeHttpIngestResult(writer, server.device.SubDevice(deviceId).SendMessage(message))
+}
+
+// 长轮询获取命令，没有命令时等待到超时后返回204。已经超时的命令平台已经收到失败的响应，丢弃不再下发
+func (server *HttpIngestServer) pollCommand(writer http.ResponseWriter, request *http.Request, deviceId string) {
+	timeout := server.config.PollTimeout
+	if value := request.URL.Query().Get("timeout"); len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxHttpIngestPollTimeout {
+			timeout = maxHttpIngestPollTimeout
+		}
+	}
+
+	queue := server.queue(deviceId)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case command := <-queue:
+			if !server.isPending(command.RequestId) {
+				glog.Warningf("drop expired command %s of sub device %s", command.RequestId, deviceId)
+				continue
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			writer.Write([]byte(Interface2JsonString(command)))
+		case <-timer.C:
+			writer.WriteHeader(http.StatusNoContent)
+		case <-request.Context().Done():
+		}
+		return
+	}
+}
+
+func (server *HttpIngestServer) isPending(requestId string) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	_, ok := server.pending[requestId]
+	return ok
+}
+
+func (server *HttpIngestServer) respondCommand(writer http.ResponseWriter, request *http.Request, requestId string) {
+	response := CommandResponse{}
+	if !readHttpIngestBody(writer, request, &response) {
+		return
+	}
+
+	server.lock.Lock()
+	result, ok := server.pending[requestId]
+	delete(server.pending, requestId)
+	server.lock.Unlock()
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	result <- response
+	writer.WriteHeader(http.StatusOK)
+}
+
+// 子设备的命令队列，创建队列时注册子设备的命令处理函数
+func (server *HttpIngestServer) queue(deviceId string) chan httpIngestCommand {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if queue, ok := server.queues[deviceId]; ok {
+		return queue
+	}
+
+	queue := make(chan httpIngestCommand, httpIngestCommandQueueSize)
+	server.queues[deviceId] = queue
+	server.device.SubDevice(deviceId).AddCommandHandler(func(command Command) (bool, interface{}) {
+		return server.executeCommand(queue, command)
+	})
+	return queue
+}
+
+// 命令放入队列等待子设备取走，子设备在超时时间内响应后返回子设备的响应
+func (server *HttpIngestServer) executeCommand(queue chan httpIngestCommand, command Command) (bool, interface{}) {
+	requestId := uuid.NewV4().String()
+	result := make(chan CommandResponse, 1)
+	server.lock.Lock()
+	server.pending[requestId] = result
+	server.lock.Unlock()
+	defer func() {
+		server.lock.Lock()
+		delete(server.pending, requestId)
+		server.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(server.config.CommandTimeout)
+	defer timer.Stop()
+	select {
+	case queue <- httpIngestCommand{RequestId: requestId, Command: command}:
+	default:
+		glog.Warningf("command queue of sub device %s is full", command.ObjectDeviceId)
+		return false, "command queue is full"
+	}
+
+	select {
+	case response := <-result:
+		return response.ResultCode == 0, response.Paras
+	case <-timer.C:
+		glog.Warningf("wait sub device %s command response timeout", command.ObjectDeviceId)
+		return false, "wait command response timeout"
+	}
+}
+
+func readHttpIngestBody(writer http.ResponseWriter, request *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxHttpIngestBodySize))
+	if err != nil || json.Unmarshal(body, v) != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeHttpIngestResult(writer http.ResponseWriter, ok bool) {
+	if ok {
+		writer.WriteHeader(http.StatusOK)
+	} else {
+		writer.WriteHeader(http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,163 @@
+package iot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func startHttpIngestServer(t *testing.T) (*HttpIngestServer, *iotDevice, *fakeClient) {
+	device, client := createFakeIotDevice()
+	server := NewHttpIngestServer(device, HttpIngestConfig{
+		Address:        "127.0.0.1:0",
+		Credentials:    map[string]string{"sub-1": "secret", "sub-2": "secret"},
+		CommandTimeout: time.Second,
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return server, device, client
+}
+
+func httpIngestRequest(t *testing.T, server *HttpIngestServer, method, path, username string, body interface{}) *http.Response {
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader([]byte(Interface2JsonString(body)))
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	request, _ := http.NewRequest(method, "http://"+server.Addr().String()+path, reader)
+	request.SetBasicAuth(username, "secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestHttpIngestServer_ReportProperties(t *testing.T) {
+	server, device, client := startHttpIngestServer(t)
+	defer server.Stop()
+
+	response := httpIngestRequest(t, server, http.MethodPost, "/v5/devices/sub-1/sys/properties/report", "sub-1", DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+	})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("report properties must succeed but status is %d", response.StatusCode)
+	}
+	service := DevicesService{}
+	if !lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service) ||
+		service.Devices[0].DeviceId != "sub-1" {
+		t.Errorf("sub device properties must be reported by gateway")
+	}
+
+	response = httpIngestRequest(t, server, http.MethodPost, "/v5/devices/sub-1/sys/messages/up", "sub-1", Message{Content: "hello"})
+	message := Message{}
+	if response.StatusCode != http.StatusOK ||
+		!lastPublished(t, client, formatTopic(MessageUpTopic, device.base.Id), &message) || message.ObjectDeviceId != "sub-1" {
+		t.Errorf("sub device message must be sent by gateway")
+	}
+}
+
+func TestHttpIngestServer_Authenticate(t *testing.T) {
+	server, _, client := startHttpIngestServer(t)
+	defer server.Stop()
+
+	request, _ := http.NewRequest(http.MethodPost, "http://"+server.Addr().String()+"/v5/devices/sub-1/sys/messages/up",
+		bytes.NewReader([]byte(Interface2JsonString(Message{Content: "hello"}))))
+	request.SetBasicAuth("sub-1", "wrong")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request with wrong password must be rejected but status is %d", response.StatusCode)
+	}
+
+	response = httpIngestRequest(t, server, http.MethodPost, "/v5/devices/sub-2/sys/messages/up", "sub-1", Message{Content: "hello"})
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("sub device must not send message of other sub device but status is %d", response.StatusCode)
+	}
+	if len(client.messages()) != 0 {
+		t.Errorf("rejected request must not be published")
+	}
+}
+
+func TestHttpIngestServer_LongPollCommand(t *testing.T) {
+	server, device, client := startHttpIngestServer(t)
+	defer server.Stop()
+
+	response := httpIngestRequest(t, server, http.MethodGet, "/v5/devices/sub-1/sys/commands?timeout=0", "sub-1", nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("poll without command must return 204 but is %d", response.StatusCode)
+	}
+
+	responses := make(chan CommandResponse, 1)
+	client.onPublish = func(topic string, payload []byte) {
+		response := CommandResponse{}
+		json.Unmarshal(payload, &response)
+		responses <- response
+	}
+	go device.base.createCommandMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=1",
+		payload: []byte(Interface2JsonString(Command{ObjectDeviceId: "sub-1", CommandName: "reboot"})),
+	})
+
+	response = httpIngestRequest(t, server, http.MethodGet, "/v5/devices/sub-1/sys/commands?timeout=2", "sub-1", nil)
+	body, _ := ioutil.ReadAll(response.Body)
+	command := httpIngestCommand{}
+	if err := json.Unmarshal(body, &command); err != nil || command.Command.CommandName != "reboot" {
+		t.Fatalf("poll must return pending command %s", string(body))
+	}
+
+	response = httpIngestRequest(t, server, http.MethodPost, "/v5/devices/sub-1/sys/commands/response/request_id="+command.RequestId,
+		"sub-1", CommandResponse{Paras: "rebooted"})
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("respond command must succeed but status is %d", response.StatusCode)
+	}
+	select {
+	case result := <-responses:
+		if result.ResultCode != 0 || result.Paras != "rebooted" {
+			t.Errorf("command response must come from sub device %s", Interface2JsonString(result))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("gateway must respond command")
+	}
+}
+
+func TestHttpIngestServer_DropExpiredCommand(t *testing.T) {
+	device, client := createFakeIotDevice()
+	server := NewHttpIngestServer(device, HttpIngestConfig{
+		Address:        "127.0.0.1:0",
+		Credentials:    map[string]string{"sub-1": "secret"},
+		CommandTimeout: 50 * time.Millisecond,
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	responses := make(chan CommandResponse, 1)
+	client.onPublish = func(topic string, payload []byte) {
+		response := CommandResponse{}
+		json.Unmarshal(payload, &response)
+		responses <- response
+	}
+	device.base.createCommandMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=1",
+		payload: []byte(Interface2JsonString(Command{ObjectDeviceId: "sub-1", CommandName: "open_valve"})),
+	})
+	if result := <-responses; result.ResultCode == 0 {
+		t.Fatalf("command without sub device response must fail")
+	}
+
+	// 平台已经收到失败响应的命令不能再下发给子设备
+	response := httpIngestRequest(t, server, http.MethodGet, "/v5/devices/sub-1/sys/commands?timeout=1", "sub-1", nil)
+	if response.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(response.Body)
+		t.Errorf("expired command must not be polled %s", string(body))
+	}
+}
@@ -0,0 +1,188 @@
+package iot
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus功能码
+const (
+	modbusReadCoils              byte = 0x01
+	modbusReadDiscreteInputs     byte = 0x02
+	modbusReadHoldingRegisters   byte = 0x03
+	modbusReadInputRegisters     byte = 0x04
+	modbusWriteSingleCoil        byte = 0x05
+	modbusWriteMultipleRegisters byte = 0x10
+)
+
+// 没有设置超时时间时单次Modbus请求的超时时间
+const defaultModbusTimeout = 3 * time.Second
+
+// Modbus从站返回的异常响应
+type ModbusError struct {
+	Function      byte
+	ExceptionCode byte
+}
+
+func (err *ModbusError) Error() string {
+	return fmt.Sprintf("modbus function 0x%02x exception 0x%02x", err.Function, err.ExceptionCode)
+}
+
+// Modbus TCP客户端，同一个连接上的请求串行执行，请求失败后关闭连接，下次请求时重新连接
+type modbusClient struct {
+	address string
+
+	lock          sync.Mutex
+	conn          net.Conn
+	transactionId uint16
+}
+
+func newModbusClient(address string) *modbusClient {
+	return &modbusClient{address: address}
+}
+
+func (client *modbusClient) readBits(ctx context.Context, unitId, function byte, address, quantity uint16) ([]bool, error) {
+	request := make([]byte, 5)
+	request[0] = function
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], quantity)
+
+	response, err := client.request(ctx, unitId, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || int(response[1]) != (int(quantity)+7)/8 || len(response) != 2+int(response[1]) {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("modbus function 0x%02x response length %d is invalid", function, len(response))}
+	}
+
+	bits := make([]bool, quantity)
+	for i := range bits {
+		bits[i] = response[2+i/8]&(1<<uint(i%8)) != 0
+	}
+	return bits, nil
+}
+
+// 读取寄存器，返回按照大端序排列的寄存器数据
+func (client *modbusClient) readRegisters(ctx context.Context, unitId, function byte, address, quantity uint16) ([]byte, error) {
+	request := make([]byte, 5)
+	request[0] = function
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], quantity)
+
+	response, err := client.request(ctx, unitId, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || int(response[1]) != 2*int(quantity) || len(response) != 2+int(response[1]) {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("modbus function 0x%02x response length %d is invalid", function, len(response))}
+	}
+	return response[2:], nil
+}
+
+func (client *modbusClient) writeSingleCoil(ctx context.Context, unitId byte, address uint16, value bool) error {
+	request := make([]byte, 5)
+	request[0] = modbusWriteSingleCoil
+	binary.BigEndian.PutUint16(request[1:], address)
+	if value {
+		binary.BigEndian.PutUint16(request[3:], 0xFF00)
+	}
+
+	_, err := client.request(ctx, unitId, request)
+	return err
+}
+
+func (client *modbusClient) writeRegisters(ctx context.Context, unitId byte, address uint16, data []byte) error {
+	request := make([]byte, 6+len(data))
+	request[0] = modbusWriteMultipleRegisters
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], uint16(len(data)/2))
+	request[5] = byte(len(data))
+	copy(request[6:], data)
+
+	_, err := client.request(ctx, unitId, request)
+	return err
+}
+
+// 发送请求PDU并返回响应PDU
+func (client *modbusClient) request(ctx context.Context, unitId byte, pdu []byte) ([]byte, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultModbusTimeout)
+	}
+
+	if client.conn == nil {
+		dialer := net.Dialer{Deadline: deadline}
+		conn, err := dialer.DialContext(ctx, "tcp", client.address)
+		if err != nil {
+			return nil, err
+		}
+		client.conn = conn
+	}
+
+	response, err := client.exchange(deadline, unitId, pdu)
+	if err != nil {
+		if _, ok := err.(*ModbusError); !ok {
+			client.conn.Close()
+			client.conn = nil
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+func (client *modbusClient) exchange(deadline time.Time, unitId byte, pdu []byte) ([]byte, error) {
+	if err := client.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	client.transactionId++
+	frame := make([]byte, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], client.transactionId)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unitId
+	copy(frame[7:], pdu)
+	if _, err := client.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(client.conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 254 {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("modbus response length %d is invalid", length)}
+	}
+	response := make([]byte, length-1)
+	if _, err := io.ReadFull(client.conn, response); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:]) != client.transactionId {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("modbus transaction id %d mismatch", binary.BigEndian.Uint16(header[0:]))}
+	}
+
+	if response[0] == pdu[0]|0x80 {
+		return nil, &ModbusError{Function: pdu[0], ExceptionCode: response[1]}
+	}
+	if response[0] != pdu[0] {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("modbus response function 0x%02x mismatch", response[0])}
+	}
+	return response, nil
+}
+
+func (client *modbusClient) close() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
@@ -0,0 +1,441 @@
+package iot
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Modbus数据区
+const (
+	ModbusCoil            = "coil"
+	ModbusDiscreteInput   = "discrete_input"
+	ModbusHoldingRegister = "holding_register"
+	ModbusInputRegister   = "input_register"
+)
+
+// 多寄存器数据的字节序，A为最高字节
+const (
+	ModbusByteOrderABCD = "ABCD" // 大端，默认
+	ModbusByteOrderDCBA = "DCBA" // 小端
+	ModbusByteOrderBADC = "BADC" // 大端，寄存器内字节交换
+	ModbusByteOrderCDAB = "CDAB" // 小端，寄存器内字节交换
+)
+
+// Modbus设备映射文件，描述Modbus设备的寄存器与产品模型属性之间的映射关系
+type ModbusMapping struct {
+	Devices []ModbusDeviceMapping `json:"devices"`
+}
+
+type ModbusDeviceMapping struct {
+	NodeId       string                 `json:"node_id"`
+	ProductId    string                 `json:"product_id"`
+	Name         string                 `json:"name,omitempty"`
+	Address      string                 `json:"address"`       // 从站地址，如192.168.1.10:502
+	UnitId       byte                   `json:"unit_id"`       // 从站单元标识
+	PollInterval int                    `json:"poll_interval"` // 读取属性的间隔，单位秒，0表示使用运行时的间隔
+	Services     []ModbusServiceMapping `json:"services"`
+	Commands     []ModbusCommandMapping `json:"commands,omitempty"`
+}
+
+type ModbusServiceMapping struct {
+	ServiceId  string                  `json:"service_id"`
+	Properties []ModbusPropertyMapping `json:"properties"`
+}
+
+type ModbusPropertyMapping struct {
+	Name      string  `json:"name"`
+	Area      string  `json:"area"`    // 数据区，默认保持寄存器
+	Address   uint16  `json:"address"` // 起始地址，从0开始
+	Type      string  `json:"type"`    // bool、int16、uint16、int32、uint32、float32、int64、uint64、float64，默认uint16
+	Scale     float64 `json:"scale"`   // 属性值 = 原始值 * Scale + Offset，默认为1
+	Offset    float64 `json:"offset"`
+	ByteOrder string  `json:"byte_order"` // 多寄存器数据的字节序，默认ABCD
+	Writable  bool    `json:"writable"`   // 是否允许平台设置，只有线圈和保持寄存器可写
+}
+
+// 平台命令转换为寄存器写入
+type ModbusCommandMapping struct {
+	ServiceId   string               `json:"service_id"`
+	CommandName string               `json:"command_name"`
+	Writes      []ModbusCommandWrite `json:"writes"`
+}
+
+// 命令写入的属性，值为命令参数Paras中的字段，没有设置Paras时写入固定值Value
+type ModbusCommandWrite struct {
+	Property string      `json:"property"`
+	Paras    string      `json:"paras,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// 从文件加载Modbus设备映射
+func LoadModbusMapping(path string) (ModbusMapping, error) {
+	mapping := ModbusMapping{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return mapping, err
+	}
+	if err := json.Unmarshal(content, &mapping); err != nil {
+		return mapping, err
+	}
+	return mapping, mapping.validate()
+}
+
+func (mapping ModbusMapping) validate() error {
+	nodes := map[string]bool{}
+	for _, device := range mapping.Devices {
+		if len(device.NodeId) == 0 || len(device.Address) == 0 {
+			return &DeviceError{errorMsg: "modbus device must have node id and address"}
+		}
+		if nodes[device.NodeId] {
+			return &DeviceError{errorMsg: "duplicate modbus node " + device.NodeId}
+		}
+		nodes[device.NodeId] = true
+		for _, service := range device.Services {
+			for _, property := range service.Properties {
+				if _, err := property.registers(); err != nil {
+					return err
+				}
+				switch property.ByteOrder {
+				case "", ModbusByteOrderABCD, ModbusByteOrderDCBA, ModbusByteOrderBADC, ModbusByteOrderCDAB:
+				default:
+					return &DeviceError{errorMsg: "modbus property " + property.Name + " has unknown byte order " + property.ByteOrder}
+				}
+				if property.Writable && property.area() != ModbusCoil && property.area() != ModbusHoldingRegister {
+					return &DeviceError{errorMsg: "modbus property " + property.Name + " in " + property.area() + " is read only"}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (property ModbusPropertyMapping) area() string {
+	if len(property.Area) == 0 {
+		return ModbusHoldingRegister
+	}
+	return property.Area
+}
+
+func (property ModbusPropertyMapping) scale() float64 {
+	if property.Scale == 0 {
+		return 1
+	}
+	return property.Scale
+}
+
+// 属性占用的寄存器数量，线圈和离散输入为1位
+func (property ModbusPropertyMapping) registers() (uint16, error) {
+	area := property.area()
+	if area == ModbusCoil || area == ModbusDiscreteInput {
+		if len(property.Type) > 0 && property.Type != "bool" {
+			return 0, &DeviceError{errorMsg: "modbus property " + property.Name + " in " + area + " must be bool"}
+		}
+		return 1, nil
+	}
+	if area != ModbusHoldingRegister && area != ModbusInputRegister {
+		return 0, &DeviceError{errorMsg: "unknown modbus area " + area}
+	}
+
+	switch property.Type {
+	case "", "int16", "uint16":
+		return 1, nil
+	case "int32", "uint32", "float32":
+		return 2, nil
+	case "int64", "uint64", "float64":
+		return 4, nil
+	}
+	return 0, &DeviceError{errorMsg: "unknown modbus type " + property.Type + " of property " + property.Name}
+}
+
+// 将寄存器数据从映射的字节序转换为大端序，转换是自身的逆运算，也用于写入前的转换
+func reorderModbusBytes(data []byte, byteOrder string) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	switch byteOrder {
+	case ModbusByteOrderDCBA:
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	case ModbusByteOrderBADC:
+		for i := 0; i+1 < len(result); i += 2 {
+			result[i], result[i+1] = result[i+1], result[i]
+		}
+	case ModbusByteOrderCDAB:
+		words := len(result) / 2
+		for i := 0; i < words/2; i++ {
+			j := words - 1 - i
+			result[2*i], result[2*j] = result[2*j], result[2*i]
+			result[2*i+1], result[2*j+1] = result[2*j+1], result[2*i+1]
+		}
+	}
+	return result
+}
+
+// 将寄存器数据解码为属性值
+func (property ModbusPropertyMapping) decode(data []byte) float64 {
+	data = reorderModbusBytes(data, property.ByteOrder)
+	var raw float64
+	switch property.Type {
+	case "int16":
+		raw = float64(int16(binary.BigEndian.Uint16(data)))
+	case "", "uint16":
+		raw = float64(binary.BigEndian.Uint16(data))
+	case "int32":
+		raw = float64(int32(binary.BigEndian.Uint32(data)))
+	case "uint32":
+		raw = float64(binary.BigEndian.Uint32(data))
+	case "float32":
+		raw = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case "int64":
+		raw = float64(int64(binary.BigEndian.Uint64(data)))
+	case "uint64":
+		raw = float64(binary.BigEndian.Uint64(data))
+	case "float64":
+		raw = math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return raw*property.scale() + property.Offset
+}
+
+// 将属性值编码为寄存器数据
+func (property ModbusPropertyMapping) encode(value float64) []byte {
+	raw := (value - property.Offset) / property.scale()
+	var data []byte
+	switch property.Type {
+	case "int16":
+		data = make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(int16(math.Round(raw))))
+	case "", "uint16":
+		data = make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(math.Round(raw)))
+	case "int32":
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(int32(math.Round(raw))))
+	case "uint32":
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(math.Round(raw)))
+	case "float32":
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, math.Float32bits(float32(raw)))
+	case "int64":
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(int64(math.Round(raw))))
+	case "uint64":
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(math.Round(raw)))
+	case "float64":
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, math.Float64bits(raw))
+	}
+	return reorderModbusBytes(data, property.ByteOrder)
+}
+
+// Modbus TCP南向适配器，根据映射文件读写寄存器和线圈，同一个从站地址的设备共享连接
+type ModbusAdapter struct {
+	devices map[string]ModbusDeviceMapping
+	order   []string
+	clients map[string]*modbusClient // 从站地址 -> 客户端
+}
+
+func NewModbusAdapter(mapping ModbusMapping) (*ModbusAdapter, error) {
+	if err := mapping.validate(); err != nil {
+		return nil, err
+	}
+
+	adapter := &ModbusAdapter{
+		devices: map[string]ModbusDeviceMapping{},
+		clients: map[string]*modbusClient{},
+	}
+	for _, device := range mapping.Devices {
+		adapter.devices[device.NodeId] = device
+		adapter.order = append(adapter.order, device.NodeId)
+		if _, ok := adapter.clients[device.Address]; !ok {
+			adapter.clients[device.Address] = newModbusClient(device.Address)
+		}
+	}
+	return adapter, nil
+}
+
+func (adapter *ModbusAdapter) Name() string {
+	return "modbus-tcp"
+}
+
+// 映射文件中的设备
+func (adapter *ModbusAdapter) Discover(ctx context.Context) ([]DeviceInfo, error) {
+	var devices []DeviceInfo
+	for _, nodeId := range adapter.order {
+		device := adapter.devices[nodeId]
+		devices = append(devices, DeviceInfo{
+			NodeId:    device.NodeId,
+			ProductId: device.ProductId,
+			Name:      device.Name,
+		})
+	}
+	return devices, nil
+}
+
+func (adapter *ModbusAdapter) PollInterval(nodeId string) time.Duration {
+	return time.Duration(adapter.devices[nodeId].PollInterval) * time.Second
+}
+
+func (adapter *ModbusAdapter) ReadProperties(ctx context.Context, nodeId string) ([]DevicePropertyEntry, error) {
+	device, err := adapter.device(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	eventTime := GetEventTimeStamp()
+	var services []DevicePropertyEntry
+	for _, service := range device.Services {
+		properties := map[string]interface{}{}
+		for _, property := range service.Properties {
+			value, err := adapter.read(ctx, device, property)
+			if err != nil {
+				return nil, err
+			}
+			properties[property.Name] = value
+		}
+		services = append(services, DevicePropertyEntry{
+			ServiceId:  service.ServiceId,
+			Properties: properties,
+			EventTime:  eventTime,
+		})
+	}
+	return services, nil
+}
+
+func (adapter *ModbusAdapter) WriteProperties(ctx context.Context, nodeId string, services []DevicePropertyDownRequestEntry) error {
+	device, err := adapter.device(nodeId)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range services {
+		properties, ok := service.Properties.(map[string]interface{})
+		if !ok {
+			return &DeviceError{errorMsg: "properties of service " + service.ServiceId + " is invalid"}
+		}
+		for name, value := range properties {
+			property, ok := device.property(service.ServiceId, name)
+			if !ok || !property.Writable {
+				return &DeviceError{errorMsg: "property " + service.ServiceId + "." + name + " is not writable"}
+			}
+			if err := adapter.write(ctx, device, property, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (adapter *ModbusAdapter) ExecuteCommand(ctx context.Context, nodeId string, command Command) (interface{}, error) {
+	device, err := adapter.device(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mapping := range device.Commands {
+		if mapping.ServiceId != command.ServiceId || mapping.CommandName != command.CommandName {
+			continue
+		}
+		paras, _ := command.Paras.(map[string]interface{})
+		for _, write := range mapping.Writes {
+			property, ok := device.property(command.ServiceId, write.Property)
+			if !ok {
+				return nil, &DeviceError{errorMsg: "command " + command.CommandName + " write unknown property " + write.Property}
+			}
+			value := write.Value
+			if len(write.Paras) > 0 {
+				if value, ok = paras[write.Paras]; !ok {
+					return nil, &DeviceError{errorMsg: "command " + command.CommandName + " missing paras " + write.Paras}
+				}
+			}
+			if err := adapter.write(ctx, device, property, value); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, &DeviceError{errorMsg: "unknown command " + command.ServiceId + "." + command.CommandName}
+}
+
+// 关闭全部从站连接
+func (adapter *ModbusAdapter) Close() {
+	for _, client := range adapter.clients {
+		client.close()
+	}
+}
+
+func (adapter *ModbusAdapter) device(nodeId string) (ModbusDeviceMapping, error) {
+	device, ok := adapter.devices[nodeId]
+	if !ok {
+		return device, &DeviceError{errorMsg: "unknown modbus node " + nodeId}
+	}
+	return device, nil
+}
+
+func (device ModbusDeviceMapping) property(serviceId, name string) (ModbusPropertyMapping, bool) {
+	for _, service := range device.Services {
+		if service.ServiceId != serviceId {
+			continue
+		}
+		for _, property := range service.Properties {
+			if property.Name == name {
+				return property, true
+			}
+		}
+	}
+	return ModbusPropertyMapping{}, false
+}
+
+func (adapter *ModbusAdapter) read(ctx context.Context, device ModbusDeviceMapping, property ModbusPropertyMapping) (interface{}, error) {
+	client := adapter.clients[device.Address]
+	quantity, _ := property.registers()
+	switch property.area() {
+	case ModbusCoil, ModbusDiscreteInput:
+		function := modbusReadCoils
+		if property.area() == ModbusDiscreteInput {
+			function = modbusReadDiscreteInputs
+		}
+		bits, err := client.readBits(ctx, device.UnitId, function, property.Address, 1)
+		if err != nil {
+			return nil, err
+		}
+		return bits[0], nil
+	default:
+		function := modbusReadHoldingRegisters
+		if property.area() == ModbusInputRegister {
+			function = modbusReadInputRegisters
+		}
+		data, err := client.readRegisters(ctx, device.UnitId, function, property.Address, quantity)
+		if err != nil {
+			return nil, err
+		}
+		return property.decode(data), nil
+	}
+}
+
+func (adapter *ModbusAdapter) write(ctx context.Context, device ModbusDeviceMapping, property ModbusPropertyMapping, value interface{}) error {
+	client := adapter.clients[device.Address]
+	if property.area() == ModbusCoil {
+		on, ok := value.(bool)
+		if !ok {
+			number, isNumber := toFloat64(value)
+			if !isNumber {
+				return &DeviceError{errorMsg: fmt.Sprintf("value %v of property %s is not bool", value, property.Name)}
+			}
+			on = number != 0
+		}
+		return client.writeSingleCoil(ctx, device.UnitId, property.Address, on)
+	}
+
+	number, ok := toFloat64(value)
+	if !ok {
+		return &DeviceError{errorMsg: fmt.Sprintf("value %v of property %s is not number", value, property.Name)}
+	}
+	return client.writeRegisters(ctx, device.UnitId, property.Address, property.encode(number))
+}
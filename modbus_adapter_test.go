@@ -0,0 +1,298 @@
+package iot
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 进程内的Modbus TCP从站，地址超过寄存器数量时返回非法地址异常
+type modbusServer struct {
+	listener net.Listener
+
+	lock      sync.Mutex
+	coils     [64]bool
+	registers [64]uint16
+}
+
+func newModbusServer(t *testing.T) *modbusServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &modbusServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *modbusServer) address() string {
+	return server.listener.Addr().String()
+}
+
+func (server *modbusServer) close() {
+	server.listener.Close()
+}
+
+func (server *modbusServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		response := server.handle(pdu)
+		frame := make([]byte, 7+len(response))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(response)+1))
+		frame[6] = header[6]
+		copy(frame[7:], response)
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (server *modbusServer) handle(pdu []byte) []byte {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	function := pdu[0]
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:]))
+	switch function {
+	case modbusReadCoils, modbusReadDiscreteInputs:
+		if address+quantity > len(server.coils) {
+			return []byte{function | 0x80, 0x02}
+		}
+		data := make([]byte, (quantity+7)/8)
+		for i := 0; i < quantity; i++ {
+			if server.coils[address+i] {
+				data[i/8] |= 1 << uint(i%8)
+			}
+		}
+		return append([]byte{function, byte(len(data))}, data...)
+	case modbusReadHoldingRegisters, modbusReadInputRegisters:
+		if address+quantity > len(server.registers) {
+			return []byte{function | 0x80, 0x02}
+		}
+		data := make([]byte, 2*quantity)
+		for i := 0; i < quantity; i++ {
+			binary.BigEndian.PutUint16(data[2*i:], server.registers[address+i])
+		}
+		return append([]byte{function, byte(len(data))}, data...)
+	case modbusWriteSingleCoil:
+		server.coils[address] = quantity == 0xFF00
+		return pdu[:5]
+	case modbusWriteMultipleRegisters:
+		for i := 0; i < quantity; i++ {
+			server.registers[address+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+		}
+		return pdu[:5]
+	}
+	return []byte{function | 0x80, 0x01}
+}
+
+func createModbusMapping(address string) ModbusMapping {
+	return ModbusMapping{
+		Devices: []ModbusDeviceMapping{
+			{
+				NodeId:       "meter-1",
+				ProductId:    "meter",
+				Address:      address,
+				UnitId:       1,
+				PollInterval: 5,
+				Services: []ModbusServiceMapping{
+					{
+						ServiceId: "meter",
+						Properties: []ModbusPropertyMapping{
+							{Name: "voltage", Address: 0, Type: "float32", ByteOrder: ModbusByteOrderCDAB, Writable: true},
+							{Name: "temperature", Area: ModbusInputRegister, Address: 2, Type: "int16", Scale: 0.1},
+							{Name: "switch", Area: ModbusCoil, Address: 3, Writable: true},
+						},
+					},
+				},
+				Commands: []ModbusCommandMapping{
+					{
+						ServiceId:   "meter",
+						CommandName: "turn",
+						Writes:      []ModbusCommandWrite{{Property: "switch", Paras: "on"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestModbusAdapter_ReadProperties(t *testing.T) {
+	server := newModbusServer(t)
+	defer server.close()
+	bits := math.Float32bits(220.5)
+	server.registers[0] = uint16(bits)
+	server.registers[1] = uint16(bits >> 16)
+	server.registers[2] = uint16(0xFFFF - 254) // -25.5
+	server.coils[3] = true
+
+	adapter, err := NewModbusAdapter(createModbusMapping(server.address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adapter.Close()
+
+	services, err := adapter.ReadProperties(context.Background(), "meter-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := services[0].Properties.(map[string]interface{})
+	if properties["voltage"] != float64(220.5) {
+		t.Errorf("voltage must be 220.5 but is %v", properties["voltage"])
+	}
+	if math.Abs(properties["temperature"].(float64)+25.5) > 1e-9 {
+		t.Errorf("temperature must be -25.5 but is %v", properties["temperature"])
+	}
+	if properties["switch"] != true {
+		t.Errorf("switch must be on")
+	}
+	if adapter.PollInterval("meter-1") != 5*time.Second {
+		t.Errorf("poll interval must be read from mapping")
+	}
+}
+
+func TestModbusAdapter_WritePropertiesAndCommand(t *testing.T) {
+	server := newModbusServer(t)
+	defer server.close()
+	adapter, _ := NewModbusAdapter(createModbusMapping(server.address()))
+	defer adapter.Close()
+
+	err := adapter.WriteProperties(context.Background(), "meter-1", []DevicePropertyDownRequestEntry{
+		{ServiceId: "meter", Properties: map[string]interface{}{"voltage": float64(230)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := math.Float32bits(230)
+	if server.registers[0] != uint16(bits) || server.registers[1] != uint16(bits>>16) {
+		t.Errorf("voltage must be written in CDAB order,registers = %v", server.registers[:2])
+	}
+
+	if err := adapter.WriteProperties(context.Background(), "meter-1", []DevicePropertyDownRequestEntry{
+		{ServiceId: "meter", Properties: map[string]interface{}{"temperature": float64(1)}},
+	}); err == nil {
+		t.Errorf("read only property must not be written")
+	}
+
+	if _, err := adapter.ExecuteCommand(context.Background(), "meter-1", Command{
+		ServiceId:   "meter",
+		CommandName: "turn",
+		Paras:       map[string]interface{}{"on": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !server.coils[3] {
+		t.Errorf("command must turn on the coil")
+	}
+}
+
+func TestModbusAdapter_Exception(t *testing.T) {
+	server := newModbusServer(t)
+	defer server.close()
+	mapping := createModbusMapping(server.address())
+	mapping.Devices[0].Services[0].Properties[0].Address = 100
+	adapter, _ := NewModbusAdapter(mapping)
+	defer adapter.Close()
+
+	_, err := adapter.ReadProperties(context.Background(), "meter-1")
+	if modbusErr, ok := err.(*ModbusError); !ok || modbusErr.ExceptionCode != 0x02 {
+		t.Fatalf("read illegal address must return modbus exception but is %v", err)
+	}
+
+	// 异常响应不影响后续请求
+	mapping.Devices[0].Services[0].Properties[0].Address = 0
+	adapter.devices["meter-1"] = mapping.Devices[0]
+	if _, err := adapter.ReadProperties(context.Background(), "meter-1"); err != nil {
+		t.Errorf("read after exception failed %v", err)
+	}
+}
+
+func TestLoadModbusMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modbus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.json")
+
+	mapping := createModbusMapping("127.0.0.1:502")
+	ioutil.WriteFile(path, []byte(Interface2JsonString(mapping)), 0644)
+	loaded, err := LoadModbusMapping(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Devices) != 1 || loaded.Devices[0].Services[0].Properties[1].Area != ModbusInputRegister {
+		t.Errorf("load mapping failed %s", Interface2JsonString(loaded))
+	}
+
+	mapping.Devices[0].Services[0].Properties[1].Writable = true
+	ioutil.WriteFile(path, []byte(Interface2JsonString(mapping)), 0644)
+	if _, err := LoadModbusMapping(path); err == nil {
+		t.Errorf("writable input register must be rejected")
+	}
+
+	mapping.Devices[0].Services[0].Properties[1].Writable = false
+	mapping.Devices[0].Services[0].Properties[1].ByteOrder = "CBAD"
+	ioutil.WriteFile(path, []byte(Interface2JsonString(mapping)), 0644)
+	if _, err := LoadModbusMapping(path); err == nil {
+		t.Errorf("unknown byte order must be rejected")
+	}
+}
+
+func TestModbusAdapter_Runtime(t *testing.T) {
+	server := newModbusServer(t)
+	defer server.close()
+	server.registers[2] = 250
+	adapter, _ := NewModbusAdapter(createModbusMapping(server.address()))
+	defer adapter.Close()
+
+	device, client := createFakeIotDevice()
+	runtime := NewAdapterRuntime(device, AdapterRuntimeConfig{})
+	runtime.AddAdapter(adapter)
+	runtime.bind(adapter, "meter-1", "meter_meter-1")
+
+	now := time.Now()
+	runtime.poll(now)
+	runtime.poll(now.Add(time.Second))
+	if len(client.messages()) != 1 {
+		t.Fatalf("meter must be polled every 5 seconds,messages = %d", len(client.messages()))
+	}
+	service := DevicesService{}
+	lastPublished(t, client, formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id), &service)
+	properties := service.Devices[0].Services[0].Properties.(map[string]interface{})
+	if properties["temperature"] != float64(25) {
+		t.Errorf("temperature must be 25 but is %v", properties["temperature"])
+	}
+
+	runtime.poll(now.Add(5 * time.Second))
+	if len(client.messages()) != 2 {
+		t.Errorf("meter must be polled again after 5 seconds")
+	}
+}
@@ -21,6 +21,15 @@ type DevicePropertyQueryHandler func(query DevicePropertyQueryRequest) DevicePro
 // 设备执行软件/固件升级.upgradeType = 0 软件升级，upgradeType = 1 固件升级
 type DeviceUpgradeHandler func(upgradeType byte, info UpgradeInfo) UpgradeProgress
 
+// 设备执行软件/固件升级，升级过程中使用reporter多次上报升级进度，返回值为最终的升级状态
+type DeviceUpgradeProgressHandler func(upgradeType byte, info UpgradeInfo, reporter UpgradeProgressReporter) UpgradeProgress
+
+// 设备连接（包括重连）平台成功
+type ConnectHandler func()
+
+// 网关子设备有上行活动（上报属性或者消息）
+type SubDeviceActivityHandler func(deviceId string)
+
 // 设备上报软固件版本,第一个返回值为软件版本，第二个返回值为固件版本
 type SwFwVersionReporter func() (string, string)
 
@@ -32,6 +41,7 @@ type UpgradeInfo struct {
 	AccessToken string `json:"access_token"` //软固件包url下载地址的临时token
 	Expires     string `json:"expires"`      //access_token的超期时间
 	Sign        string `json:"sign"`         //软固件包MD5值
+	CustomInfo  string `json:"custom_info"`  //软固件包上传时用户自定义的信息，可以指定升级的组件
 }
 
 // 设备升级状态响应，用于设备向平台反馈进度，错误信息等
@@ -58,7 +68,7 @@ type UpgradeProgress struct {
 // 设备命令
 type Command struct {
 	ObjectDeviceId string      `json:"object_device_id"`
-	ServiceId      string      `json:"service_id""`
+	ServiceId      string      `json:"service_id"`
 	CommandName    string      `json:"command_name"`
 	Paras          interface{} `json:"paras"`
 }
@@ -88,7 +98,8 @@ type DataEntry struct {
 	ServiceId string      `json:"service_id"`
 	EventType string      `json:"event_type"`
 	EventTime string      `json:"event_time"`
-	Paras     interface{} `json:"paras"` // 不同类型的请求paras使用的结构体不同
+	EventId   string      `json:"event_id,omitempty"` // 事件ID，平台响应时携带请求的事件ID
+	Paras     interface{} `json:"paras"`              // 不同类型的请求paras使用的结构体不同
 }
 
 // 网关更新子设备状态
@@ -150,7 +161,7 @@ type DevicePropertyDownRequestEntry struct {
 // 平台设置设备属性==================================================
 type DevicePropertyQueryRequest struct {
 	ObjectDeviceId string `json:"object_device_id"`
-	ServiceId      string `json:"service_id"`
+	ServiceId      string `json:"service_id,omitempty"`
 }
 
 // 设备获取设备影子数据
@@ -294,6 +305,8 @@ type ReportDeviceInfoEventParas struct {
 	DeviceSdkVersion string `json:"device_sdk_version,omitempty"`
 	SwVersion        string `json:"sw_version,omitempty"`
 	FwVersion        string `json:"fw_version,omitempty"`
+
+	Components []ComponentVersion `json:"components,omitempty"` // 设置组件清单时上报各组件的版本
 }
 
 // 上报设备日志请求
@@ -0,0 +1,416 @@
+package iot
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 软固件升级结果码，与UpgradeProgress的ResultCode一致
+const (
+	UpgradeCodeSuccess         = 0
+	UpgradeCodeDeviceBusy      = 1
+	UpgradeCodePoorSignal      = 2
+	UpgradeCodeLatestVersion   = 3
+	UpgradeCodeLowBattery      = 4
+	UpgradeCodeNoSpace         = 5
+	UpgradeCodeDownloadTimeout = 6
+	UpgradeCodeCheckFailed     = 7
+	UpgradeCodeUnsupported     = 8
+	UpgradeCodeNoMemory        = 9
+	UpgradeCodeInstallFailed   = 10
+	UpgradeCodeInternalError   = 255
+)
+
+const (
+	defaultOtaProgressStep  = 10
+	defaultOtaRetries       = 3
+	defaultOtaRetryInterval = time.Second
+	defaultOtaTimeout       = 30 * time.Minute
+
+	// 下载完成时上报的进度，剩余进度留给安装过程
+	otaDownloadedProgress = 90
+)
+
+// 升级失败的原因，ResultCode为上报给平台的结果码
+type UpgradeError struct {
+	ResultCode  int
+	Description string
+}
+
+func (err *UpgradeError) Error() string {
+	return fmt.Sprintf("upgrade failed,result code %d,%s", err.ResultCode, err.Description)
+}
+
+// 安装校验通过的升级包，packagePath为升级包在本地的路径，安装完成后升级包被删除。
+// 返回UpgradeError时使用其中的结果码，返回其他错误时结果码为10
+type OtaInstallHandler func(upgradeType byte, info UpgradeInfo, packagePath string) error
+
+type OtaConfig struct {
+	DownloadDir   string        // 升级包下载目录，默认为系统临时目录
+	ProgressStep  int           // 升级进度每增加ProgressStep上报一次，默认10，同时受设备升级进度最小上报间隔的限制
+	Retries       int           // 下载中断后使用Range续传的最大次数，默认3
+	RetryInterval time.Duration // 续传的间隔时间，默认1秒
+	Timeout       time.Duration // 下载升级包的超时时间，默认30分钟
+	HttpClient    *http.Client  // 下载升级包使用的HTTP客户端，默认为http.DefaultClient
+	Install       OtaInstallHandler
+
+	// 设置后校验升级包的分离签名，签名文件默认从升级包地址的路径加上.sig下载，可以使用SignatureUrl指定
+	Keyring      *OtaKeyring
+	SignatureUrl func(info UpgradeInfo) string
+
+	// 设置后支持差分升级，差分包在当前镜像上生成新镜像后安装
+	Delta *OtaDeltaConfig
+
+	// 升级前检查和允许升级的时间段，不在时间段内时升级推迟到下一个时间段开始，为空时不限制
+	PreCheck OtaPreCheckConfig
+	Windows  []MaintenanceWindow
+}
+
+// 软固件升级引擎，接收平台下发的升级通知后下载升级包，校验文件大小和摘要，
+// 按照进度上报升级状态并调用安装函数安装升级包。同一时间只执行一个升级任务
+type OtaEngine struct {
+	device Device
+	config OtaConfig
+
+	now func() time.Time
+
+	lock     sync.Mutex
+	cancel   context.CancelFunc
+	done     chan struct{} // 当前升级任务结束时关闭
+	deferred bool          // 当前升级任务在等待维护时间段，可以被新的升级通知替换
+	replaced bool          // 当前升级任务已经被新的升级通知替换
+	stopped  bool
+}
+
+func NewOtaEngine(device Device, config OtaConfig) *OtaEngine {
+	if len(config.DownloadDir) == 0 {
+		config.DownloadDir = os.TempDir()
+	}
+	if config.ProgressStep <= 0 {
+		config.ProgressStep = defaultOtaProgressStep
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultOtaRetries
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultOtaRetryInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultOtaTimeout
+	}
+	if config.HttpClient == nil {
+		config.HttpClient = http.DefaultClient
+	}
+
+	return &OtaEngine{
+		device: device,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// 接管设备的软固件升级
+func (engine *OtaEngine) Start() {
+	engine.lock.Lock()
+	engine.stopped = false
+	engine.lock.Unlock()
+
+	engine.device.SetDeviceUpgradeProgressHandler(engine.handleUpgrade)
+}
+
+// 取消正在执行的升级任务，停止后拒绝新的升级通知
+func (engine *OtaEngine) Stop() {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.stopped = true
+	if engine.cancel != nil {
+		engine.cancel()
+	}
+}
+
+// 等待维护时间段的升级任务被新的升级通知取消并替换，已经开始下载的升级任务拒绝新的升级通知
+func (engine *OtaEngine) handleUpgrade(upgradeType byte, info UpgradeInfo, reporter UpgradeProgressReporter) UpgradeProgress {
+	engine.lock.Lock()
+	for engine.cancel != nil && engine.deferred && !engine.stopped {
+		glog.Infof("deferred upgrade is replaced by upgrade to version %s", info.Version)
+		engine.replaced = true
+		engine.cancel()
+		done := engine.done
+		engine.lock.Unlock()
+		<-done
+		engine.lock.Lock()
+	}
+	if engine.stopped || engine.cancel != nil {
+		engine.lock.Unlock()
+		glog.Warningf("device is upgrading,reject upgrade to version %s", info.Version)
+		return UpgradeProgress{ResultCode: UpgradeCodeDeviceBusy, Description: "another upgrade is in progress"}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	engine.cancel = cancel
+	engine.done = done
+	engine.lock.Unlock()
+
+	defer func() {
+		engine.lock.Lock()
+		engine.cancel = nil
+		engine.done = nil
+		engine.deferred = false
+		engine.replaced = false
+		engine.lock.Unlock()
+		cancel()
+		close(done)
+	}()
+	return engine.upgrade(ctx, upgradeType, info, reporter)
+}
+
+// 执行升级任务，返回最终的升级状态
+func (engine *OtaEngine) upgrade(ctx context.Context, upgradeType byte, info UpgradeInfo, reporter UpgradeProgressReporter) UpgradeProgress {
+	if err := engine.waitMaintenanceWindow(ctx, info, reporter); err == errUpgradeSuperseded {
+		// 新的升级任务已经开始上报，被替换的任务不再上报最终状态
+		return upgradeSuperseded
+	} else if err != nil {
+		return upgradeFailure(err, UpgradeCodeInternalError)
+	}
+	if err := engine.preCheck(OtaStageDownload, upgradeType, info); err != nil {
+		glog.Warningf("pre check before download version %s failed %v", info.Version, err)
+		return upgradeFailure(err, UpgradeCodeDeviceBusy)
+	}
+
+	reporter.Report(UpgradeProgress{Description: "downloading"})
+	reported := 0
+	onProgress := func(downloaded, total int64) {
+		if total <= 0 {
+			return
+		}
+		progress := int(downloaded * otaDownloadedProgress / total)
+		if progress >= reported+engine.config.ProgressStep && progress < otaDownloadedProgress {
+			reported = progress
+			reporter.Report(UpgradeProgress{Progress: progress, Description: "downloading"})
+		}
+	}
+	path, err := engine.download(ctx, upgradeType, info, onProgress)
+	if err == nil && engine.config.Delta != nil {
+		path, err = engine.resolveDelta(ctx, upgradeType, info, path, onProgress)
+	}
+	if err != nil {
+		glog.Warningf("download upgrade package of version %s failed %v", info.Version, err)
+		return upgradeFailure(err, UpgradeCodeDownloadTimeout)
+	}
+	defer os.Remove(path)
+
+	if err := engine.preCheck(OtaStageInstall, upgradeType, info); err != nil {
+		glog.Warningf("pre check before install version %s failed %v", info.Version, err)
+		return upgradeFailure(err, UpgradeCodeDeviceBusy)
+	}
+	reporter.Report(UpgradeProgress{Progress: otaDownloadedProgress, Description: "installing"})
+	if engine.config.Install != nil {
+		err := engine.config.Install(upgradeType, info, path)
+		if err == ErrUpgradeRebootRequired {
+			// 重启后由安装函数上报最终的升级状态
+			return UpgradeProgress{Progress: otaDownloadedProgress, Description: "rebooting"}
+		}
+		if err != nil {
+			glog.Warningf("install upgrade package of version %s failed %v", info.Version, err)
+			return upgradeFailure(err, UpgradeCodeInstallFailed)
+		}
+	}
+
+	glog.Infof("upgrade to version %s success", info.Version)
+	return UpgradeProgress{ResultCode: UpgradeCodeSuccess, Progress: 100, Version: info.Version, Description: "upgrade success"}
+}
+
+func upgradeFailure(err error, code int) UpgradeProgress {
+	if upgradeErr, ok := err.(*UpgradeError); ok {
+		return UpgradeProgress{ResultCode: upgradeErr.ResultCode, Description: upgradeErr.Description}
+	}
+	return UpgradeProgress{ResultCode: code, Description: err.Error()}
+}
+
+// 下载升级包并校验，下载中断时从已下载的位置续传，返回校验通过的升级包路径
+func (engine *OtaEngine) download(ctx context.Context, upgradeType byte, info UpgradeInfo, onProgress func(downloaded, total int64)) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, engine.config.Timeout)
+	defer cancel()
+
+	path := filepath.Join(engine.config.DownloadDir, otaPackageName(upgradeType, info))
+	partial := path + ".part"
+	for attempt := 0; ; attempt++ {
+		err := engine.downloadOnce(ctx, info, partial, onProgress)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*UpgradeError); ok {
+			os.Remove(partial)
+			return "", err
+		}
+		if ctx.Err() != nil || attempt >= engine.config.Retries {
+			return "", &UpgradeError{ResultCode: UpgradeCodeDownloadTimeout, Description: err.Error()}
+		}
+
+		glog.Warningf("download upgrade package interrupted,resume after %v: %v", engine.config.RetryInterval, err)
+		select {
+		case <-time.After(engine.config.RetryInterval):
+		case <-ctx.Done():
+			return "", &UpgradeError{ResultCode: UpgradeCodeDownloadTimeout, Description: ctx.Err().Error()}
+		}
+	}
+
+	if err := verifyOtaPackage(partial, info); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	if engine.config.Keyring != nil {
+		if err := engine.verifySignature(ctx, info, partial); err != nil {
+			os.Remove(partial)
+			return "", err
+		}
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// 从本地已下载的位置开始下载，服务端不支持Range时重新下载
+func (engine *OtaEngine) downloadOnce(ctx context.Context, info UpgradeInfo, partial string, onProgress func(downloaded, total int64)) error {
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return &UpgradeError{ResultCode: UpgradeCodeNoSpace, Description: err.Error()}
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if info.FileSize > 0 && offset >= int64(info.FileSize) {
+		if offset == int64(info.FileSize) {
+			return nil
+		}
+		offset = 0
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, info.Url, nil)
+	if err != nil {
+		return &UpgradeError{ResultCode: UpgradeCodeInternalError, Description: err.Error()}
+	}
+	if len(info.AccessToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+info.AccessToken)
+	}
+	if offset > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	response, err := engine.config.HttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(response.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-") {
+			file.Truncate(0)
+			return &DeviceError{errorMsg: "unexpected content range " + response.Header.Get("Content-Range")}
+		}
+	case http.StatusOK:
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 不知道文件大小时，已经下载完成的文件续传返回416
+		if info.FileSize <= 0 && offset > 0 {
+			return nil
+		}
+		file.Truncate(0)
+		return &DeviceError{errorMsg: "requested range not satisfiable"}
+	default:
+		return &DeviceError{errorMsg: fmt.Sprintf("download upgrade package failed,status code %d", response.StatusCode)}
+	}
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	total := int64(info.FileSize)
+	if total <= 0 && response.ContentLength > 0 {
+		total = offset + response.ContentLength
+	}
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			if _, err := file.Write(buffer[:n]); err != nil {
+				return &UpgradeError{ResultCode: UpgradeCodeNoSpace, Description: err.Error()}
+			}
+			offset += int64(n)
+			if info.FileSize > 0 && offset > int64(info.FileSize) {
+				return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: "package is larger than file size"}
+			}
+			onProgress(offset, total)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 本地升级包文件名，同一个升级包使用相同的文件名以便续传
+func otaPackageName(upgradeType byte, info UpgradeInfo) string {
+	digest := sha256.Sum256([]byte(info.Version + "|" + info.Sign + "|" + strconv.Itoa(info.FileSize)))
+	return fmt.Sprintf("ota_%d_%s.bin", upgradeType, hex.EncodeToString(digest[:8]))
+}
+
+// 校验升级包大小和摘要，Sign为32位时使用MD5，为64位时使用SHA256
+func verifyOtaPackage(path string, info UpgradeInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var digest hash.Hash
+	switch len(info.Sign) {
+	case 0:
+	case 2 * md5.Size:
+		digest = md5.New()
+	case 2 * sha256.Size:
+		digest = sha256.New()
+	default:
+		return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: "unsupported package sign " + info.Sign}
+	}
+
+	var size int64
+	if digest != nil {
+		size, err = io.Copy(digest, file)
+	} else {
+		size, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.FileSize > 0 && size != int64(info.FileSize) {
+		return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: fmt.Sprintf("package size %d mismatch file size %d", size, info.FileSize)}
+	}
+	if digest != nil && !strings.EqualFold(hex.EncodeToString(digest.Sum(nil)), info.Sign) {
+		return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: "package sign mismatch"}
+	}
+	return nil
+}
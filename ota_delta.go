@@ -0,0 +1,254 @@
+package iot
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	otaDeltaMagic  = "OTADELTA"
+	bsdiffMagic    = "BSDIFF40"
+	bsdiffHeadSize = 32
+
+	// 差分包元数据的最大字节数
+	maxOtaDeltaMetadataSize = 64 * 1024
+)
+
+// 差分升级配置。差分包格式为：8字节"OTADELTA"，4字节大端序元数据长度，JSON格式的元数据，
+// 以及BSDIFF40格式的补丁。元数据包括目标镜像的大小和SHA256摘要，可选的基础镜像摘要和完整升级包地址
+type OtaDeltaConfig struct {
+	// 当前安装的镜像路径，补丁应用在该镜像上生成新镜像
+	BaseImage func(upgradeType byte, info UpgradeInfo) (string, error)
+
+	// 差分升级失败时下载的完整升级包，返回false时不回退。为nil时使用元数据中的完整升级包地址
+	FullPackage func(info UpgradeInfo) (UpgradeInfo, bool)
+}
+
+type otaDeltaMetadata struct {
+	BaseSha256   string `json:"base_sha256,omitempty"`
+	TargetSha256 string `json:"target_sha256"`
+	TargetSize   int64  `json:"target_size"`
+	FullUrl      string `json:"full_url,omitempty"`
+}
+
+// 读取差分包的元数据，不是差分包时返回nil，offset为补丁在文件中的起始位置
+func readOtaDeltaHeader(file *os.File) (*otaDeltaMetadata, int64, error) {
+	header := make([]byte, len(otaDeltaMagic)+4)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:len(otaDeltaMagic)]) != otaDeltaMagic {
+		return nil, 0, nil
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[len(otaDeltaMagic):]))
+	if length > maxOtaDeltaMetadataSize {
+		return nil, 0, &DeviceError{errorMsg: "delta metadata is too large"}
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, int64(len(header))); err != nil {
+		return nil, 0, err
+	}
+	metadata := &otaDeltaMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, 0, err
+	}
+	if len(metadata.TargetSha256) != 2*sha256.Size || metadata.TargetSize <= 0 {
+		return nil, 0, &DeviceError{errorMsg: "delta metadata has no target digest"}
+	}
+	return metadata, int64(len(header)) + length, nil
+}
+
+// 升级包为差分包时生成新镜像并校验目标摘要，失败时下载完整升级包。返回需要安装的升级包路径
+func (engine *OtaEngine) resolveDelta(ctx context.Context, upgradeType byte, info UpgradeInfo, path string,
+	onProgress func(downloaded, total int64)) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	metadata, offset, err := readOtaDeltaHeader(file)
+	if metadata == nil && err == nil {
+		file.Close()
+		return path, nil
+	}
+
+	image := strings.TrimSuffix(path, ".bin") + ".image"
+	if err == nil {
+		err = engine.applyDelta(upgradeType, info, file, offset, metadata, image)
+	}
+	file.Close()
+	os.Remove(path)
+	if err == nil {
+		return image, nil
+	}
+
+	glog.Warningf("apply delta package of version %s failed %v,fall back to full package", info.Version, err)
+	full, ok := engine.fullPackage(info, metadata)
+	if !ok {
+		return "", &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: "apply delta package failed: " + err.Error()}
+	}
+	return engine.download(ctx, upgradeType, full, onProgress)
+}
+
+func (engine *OtaEngine) fullPackage(info UpgradeInfo, metadata *otaDeltaMetadata) (UpgradeInfo, bool) {
+	if engine.config.Delta.FullPackage != nil {
+		return engine.config.Delta.FullPackage(info)
+	}
+	if metadata == nil || len(metadata.FullUrl) == 0 {
+		return UpgradeInfo{}, false
+	}
+
+	full := info
+	full.Url = metadata.FullUrl
+	full.FileSize = int(metadata.TargetSize)
+	full.Sign = metadata.TargetSha256
+	return full, true
+}
+
+// 在当前镜像上应用补丁生成新镜像，新镜像的大小和摘要与元数据一致时才返回成功
+func (engine *OtaEngine) applyDelta(upgradeType byte, info UpgradeInfo, patch *os.File, offset int64,
+	metadata *otaDeltaMetadata, image string) error {
+	if engine.config.Delta.BaseImage == nil {
+		return &DeviceError{errorMsg: "base image is not configured"}
+	}
+	basePath, err := engine.config.Delta.BaseImage(upgradeType, info)
+	if err != nil {
+		return err
+	}
+	base, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	if len(metadata.BaseSha256) > 0 {
+		digest := sha256.New()
+		if _, err := io.Copy(digest, base); err != nil {
+			return err
+		}
+		if !strings.EqualFold(hex.EncodeToString(digest.Sum(nil)), metadata.BaseSha256) {
+			return &DeviceError{errorMsg: "base image does not match delta package"}
+		}
+	}
+	baseInfo, err := base.Stat()
+	if err != nil {
+		return err
+	}
+	patchInfo, err := patch.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(image, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(out, digest))
+	size, err := applyBsdiff(base, baseInfo.Size(), io.NewSectionReader(patch, offset, patchInfo.Size()-offset), writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	out.Close()
+	if err == nil && (size != metadata.TargetSize || !strings.EqualFold(hex.EncodeToString(digest.Sum(nil)), metadata.TargetSha256)) {
+		err = &DeviceError{errorMsg: "patched image does not match target digest"}
+	}
+	if err != nil {
+		os.Remove(image)
+		return err
+	}
+	return nil
+}
+
+// 应用BSDIFF40格式的补丁，新镜像顺序写入out，返回新镜像的大小
+func applyBsdiff(old io.ReaderAt, oldSize int64, patch *io.SectionReader, out io.Writer) (int64, error) {
+	header := make([]byte, bsdiffHeadSize)
+	if _, err := patch.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	if string(header[:8]) != bsdiffMagic {
+		return 0, &DeviceError{errorMsg: "patch is not bsdiff format"}
+	}
+	ctrlLen := bsdiffOfftin(header[8:])
+	diffLen := bsdiffOfftin(header[16:])
+	newSize := bsdiffOfftin(header[24:])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || bsdiffHeadSize+ctrlLen+diffLen > patch.Size() {
+		return 0, &DeviceError{errorMsg: "bsdiff header is corrupted"}
+	}
+
+	ctrl := bzip2.NewReader(io.NewSectionReader(patch, bsdiffHeadSize, ctrlLen))
+	diff := bzip2.NewReader(io.NewSectionReader(patch, bsdiffHeadSize+ctrlLen, diffLen))
+	extra := bzip2.NewReader(io.NewSectionReader(patch, bsdiffHeadSize+ctrlLen+diffLen, patch.Size()))
+
+	var newPos, oldPos int64
+	triple := make([]byte, 24)
+	buffer := make([]byte, 32*1024)
+	oldBuffer := make([]byte, 32*1024)
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, triple); err != nil {
+			return newPos, err
+		}
+		add, copyLen, seek := bsdiffOfftin(triple), bsdiffOfftin(triple[8:]), bsdiffOfftin(triple[16:])
+		if add < 0 || copyLen < 0 || newPos+add+copyLen > newSize {
+			return newPos, &DeviceError{errorMsg: "bsdiff control data is corrupted"}
+		}
+
+		// diff块的字节与旧镜像对应位置的字节相加
+		for add > 0 {
+			n := int64(len(buffer))
+			if add < n {
+				n = add
+			}
+			if _, err := io.ReadFull(diff, buffer[:n]); err != nil {
+				return newPos, err
+			}
+			for i := range oldBuffer[:n] {
+				oldBuffer[i] = 0
+			}
+			if oldPos < oldSize && oldPos+n > 0 {
+				start, end := oldPos, oldPos+n
+				if start < 0 {
+					start = 0
+				}
+				if end > oldSize {
+					end = oldSize
+				}
+				if _, err := old.ReadAt(oldBuffer[start-oldPos:end-oldPos], start); err != nil && err != io.EOF {
+					return newPos, err
+				}
+			}
+			for i := int64(0); i < n; i++ {
+				buffer[i] += oldBuffer[i]
+			}
+			if _, err := out.Write(buffer[:n]); err != nil {
+				return newPos, err
+			}
+			add -= n
+			newPos += n
+			oldPos += n
+		}
+
+		// extra块的字节直接写入
+		if _, err := io.CopyN(out, extra, copyLen); err != nil {
+			return newPos, err
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+	return newPos, nil
+}
+
+// bsdiff使用的符号-数值表示的小端序整数
+func bsdiffOfftin(buf []byte) int64 {
+	value := int64(binary.LittleEndian.Uint64(buf) & 0x7FFFFFFFFFFFFFFF)
+	if buf[7]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
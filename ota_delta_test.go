@@ -0,0 +1,136 @@
+package iot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	deltaBaseImage   = []byte(strings.Repeat("firmware image version 1.0 ", 8))
+	deltaTargetImage = []byte(strings.Repeat("firmware image version 2.0 ", 8) + "new feature")
+)
+
+// 使用bsdiff生成的deltaBaseImage到deltaTargetImage的补丁
+func deltaPatch(t *testing.T) []byte {
+	patch, err := base64.StdEncoding.DecodeString("QlNESUZGNDArAAAAAAAAAC8AAAAAAAAA4wAAAAAAAABCWmg5MUFZJlNZ2KC4QwAABcACSAgAQCAAMM00GMilrji7kinChIbFBcIYQlpoOTFBWSZTWbIG4iUAAAHgAGAACQAgADDNNBCmlMsA5dwHi7kinChIWQNxEoBCWmg5MUFZJlNZZqCULgAAAxGAQAAjARaAIAAxBkxBAwmkBbRnQeLuSKcKEgzUEoXA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch
+}
+
+func createDeltaPackage(t *testing.T, metadata otaDeltaMetadata) []byte {
+	data := []byte(Interface2JsonString(metadata))
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+
+	content := append([]byte(otaDeltaMagic), length...)
+	content = append(content, data...)
+	return append(content, deltaPatch(t)...)
+}
+
+func sha256Hex(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func TestApplyBsdiff(t *testing.T) {
+	apply := func(patch []byte, out io.Writer) (int64, error) {
+		base := bytes.NewReader(deltaBaseImage)
+		return applyBsdiff(base, base.Size(), io.NewSectionReader(bytes.NewReader(patch), 0, int64(len(patch))), out)
+	}
+
+	out := &bytes.Buffer{}
+	size, err := apply(deltaPatch(t), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(deltaTargetImage)) || !bytes.Equal(out.Bytes(), deltaTargetImage) {
+		t.Errorf("patched image must be target image but is %q", out.String())
+	}
+
+	patch := deltaPatch(t)
+	if _, err := apply(patch[:len(patch)-40], &bytes.Buffer{}); err == nil {
+		t.Errorf("corrupted patch must be rejected")
+	}
+}
+
+func TestOtaEngine_Delta(t *testing.T) {
+	var lock sync.Mutex
+	packages := map[string][]byte{"/full.bin": deltaTargetImage}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		lock.Lock()
+		content, ok := packages[request.URL.Path]
+		lock.Unlock()
+		if ok {
+			writer.Write(content)
+			return
+		}
+		writer.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		name    string
+		base    []byte
+		fullUrl string
+		code    int
+	}{
+		{"patched", deltaBaseImage, server.URL + "/full.bin", UpgradeCodeSuccess},
+		{"fall back to full package", []byte("other image"), server.URL + "/full.bin", UpgradeCodeSuccess},
+		{"no full package", []byte("other image"), "", UpgradeCodeCheckFailed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			delta := createDeltaPackage(t, otaDeltaMetadata{
+				BaseSha256:   sha256Hex(deltaBaseImage),
+				TargetSha256: sha256Hex(deltaTargetImage),
+				TargetSize:   int64(len(deltaTargetImage)),
+				FullUrl:      c.fullUrl,
+			})
+			lock.Lock()
+			packages["/delta.bin"] = delta
+			lock.Unlock()
+
+			var installed []byte
+			device, client := createFakeIotDevice()
+			engine, dir := createOtaEngine(t, device, func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+				installed, _ = ioutil.ReadFile(packagePath)
+				return nil
+			})
+			defer os.RemoveAll(dir)
+			defer engine.Stop()
+			basePath := filepath.Join(dir, "current.img")
+			ioutil.WriteFile(basePath, c.base, 0644)
+			engine.config.Delta = &OtaDeltaConfig{
+				BaseImage: func(upgradeType byte, info UpgradeInfo) (string, error) {
+					return basePath, nil
+				},
+			}
+
+			info := createOtaUpgradeInfo(server.URL+"/delta.bin", delta)
+			device.base.upgradeDevice(1, &info)
+			progresses := waitUpgradeResult(t, client)
+			if last := progresses[len(progresses)-1]; last.ResultCode != c.code {
+				t.Fatalf("delta upgrade must report result code %d but is %+v", c.code, last)
+			}
+			if c.code == UpgradeCodeSuccess && !bytes.Equal(installed, deltaTargetImage) {
+				t.Errorf("target image must be installed but is %q", installed)
+			}
+			if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+				t.Errorf("downloaded and patched packages must be removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package iot
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"time"
+)
+
+// 升级前检查的阶段
+const (
+	OtaStageDownload = "download" // 下载升级包之前
+	OtaStageInstall  = "install"  // 安装升级包之前
+)
+
+// 自定义的升级前检查，返回UpgradeError时使用其中的结果码，返回其他错误时结果码为1
+type OtaPreCheck func(stage string, upgradeType byte, info UpgradeInfo) error
+
+// 升级前检查，在下载和安装之前执行，检查不通过时拒绝升级并上报对应的结果码。未设置的检查不执行
+type OtaPreCheckConfig struct {
+	Busy         func() bool                     // 设备是否正在执行业务，返回true时结果码为1
+	BatteryLevel func() int                      // 设备电量百分比，低于MinBattery时结果码为4
+	MinBattery   int                             // 升级需要的最低电量百分比
+	FreeStorage  func(dir string) (int64, error) // 目录所在磁盘的剩余空间，下载前少于升级包大小加MinStorage、安装前少于MinStorage时结果码为5
+	MinStorage   int64                           // 升级需要额外保留的磁盘空间
+	FreeMemory   func() int64                    // 设备剩余内存，少于MinMemory时结果码为9
+	MinMemory    int64                           // 升级需要的最少内存
+	Custom       []OtaPreCheck
+}
+
+// 等待维护时间段的升级任务被新的升级通知替换，被替换的任务不上报最终状态
+var errUpgradeSuperseded = &DeviceError{errorMsg: "deferred upgrade is replaced"}
+
+const upgradeCodeSuperseded = -1
+
+var upgradeSuperseded = UpgradeProgress{ResultCode: upgradeCodeSuperseded, Description: "upgrade is replaced"}
+
+// 允许升级的时间段，Start和End为从0点开始的时间，End不大于Start时时间段跨越0点
+type MaintenanceWindow struct {
+	Start    time.Duration
+	End      time.Duration
+	Weekdays []time.Weekday // 时间段开始的星期，为空时每天
+	Location *time.Location // 时间段使用的时区，默认为本地时区
+}
+
+// 执行升级前检查
+func (engine *OtaEngine) preCheck(stage string, upgradeType byte, info UpgradeInfo) error {
+	config := engine.config.PreCheck
+	if config.Busy != nil && config.Busy() {
+		return &UpgradeError{ResultCode: UpgradeCodeDeviceBusy, Description: "device is busy"}
+	}
+	if config.BatteryLevel != nil {
+		if level := config.BatteryLevel(); level < config.MinBattery {
+			return &UpgradeError{ResultCode: UpgradeCodeLowBattery, Description: fmt.Sprintf("battery level %d%% is lower than %d%%", level, config.MinBattery)}
+		}
+	}
+	if config.FreeStorage != nil {
+		required := config.MinStorage
+		if stage == OtaStageDownload {
+			required += int64(info.FileSize)
+		}
+		free, err := config.FreeStorage(engine.config.DownloadDir)
+		if err != nil {
+			return &UpgradeError{ResultCode: UpgradeCodeNoSpace, Description: err.Error()}
+		}
+		if free < required {
+			return &UpgradeError{ResultCode: UpgradeCodeNoSpace, Description: fmt.Sprintf("free storage %d is less than %d", free, required)}
+		}
+	}
+	if config.FreeMemory != nil {
+		if free := config.FreeMemory(); free < config.MinMemory {
+			return &UpgradeError{ResultCode: UpgradeCodeNoMemory, Description: fmt.Sprintf("free memory %d is less than %d", free, config.MinMemory)}
+		}
+	}
+	for _, check := range config.Custom {
+		if err := check(stage, upgradeType, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 不在允许升级的时间段内时上报deferred并等待到下一个时间段开始
+func (engine *OtaEngine) waitMaintenanceWindow(ctx context.Context, info UpgradeInfo, reporter UpgradeProgressReporter) error {
+	delay, ok := maintenanceWindowDelay(engine.config.Windows, engine.now())
+	if !ok {
+		return &UpgradeError{ResultCode: UpgradeCodeInternalError, Description: "no maintenance window is available"}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	glog.Infof("upgrade to version %s is deferred for %s", info.Version, delay)
+	reporter.Report(UpgradeProgress{Description: "deferred"})
+	engine.setDeferred(true)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	// 时间段开始的同时被取消时不再升级
+	engine.lock.Lock()
+	engine.deferred = false
+	canceled, replaced := ctx.Err() != nil, engine.replaced
+	engine.lock.Unlock()
+	if replaced {
+		return errUpgradeSuperseded
+	}
+	if canceled {
+		return &UpgradeError{ResultCode: UpgradeCodeInternalError, Description: "deferred upgrade is canceled"}
+	}
+	return nil
+}
+
+func (engine *OtaEngine) setDeferred(deferred bool) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.deferred = deferred
+}
+
+// 距离下一个允许升级的时间段的等待时间，当前在时间段内时返回0，没有时间段时返回0
+func maintenanceWindowDelay(windows []MaintenanceWindow, now time.Time) (time.Duration, bool) {
+	if len(windows) == 0 {
+		return 0, true
+	}
+
+	var delay time.Duration
+	found := false
+	for _, window := range windows {
+		location := window.Location
+		if location == nil {
+			location = time.Local
+		}
+		local := now.In(location)
+		length := window.End - window.Start
+		if length <= 0 {
+			length += 24 * time.Hour
+		}
+
+		// 前一天开始的时间段可能跨越0点，一周之内一定有下一个时间段
+		for day := -1; day <= 7; day++ {
+			start := time.Date(local.Year(), local.Month(), local.Day()+day, 0, 0, 0, 0, location).Add(window.Start)
+			if !window.allowed(start.Weekday()) || !start.Add(length).After(now) {
+				continue
+			}
+			if !start.After(now) {
+				return 0, true
+			}
+			if !found || start.Sub(now) < delay {
+				delay = start.Sub(now)
+				found = true
+			}
+			break
+		}
+	}
+	return delay, found
+}
+
+func (window MaintenanceWindow) allowed(weekday time.Weekday) bool {
+	if len(window.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range window.Weekdays {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package iot
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowDelay(t *testing.T) {
+	// 2021-03-01是星期一
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	night := MaintenanceWindow{Start: 22 * time.Hour, End: 4 * time.Hour, Location: time.UTC}
+	for _, c := range []struct {
+		name    string
+		windows []MaintenanceWindow
+		now     time.Time
+		delay   time.Duration
+		ok      bool
+	}{
+		{"no window", nil, now, 0, true},
+		{"before window", []MaintenanceWindow{night}, now, 10 * time.Hour, true},
+		{"in window", []MaintenanceWindow{night}, now.Add(11 * time.Hour), 0, true},
+		{"in window across midnight", []MaintenanceWindow{night}, now.Add(-9 * time.Hour), 0, true},
+		{"next window", []MaintenanceWindow{night, {Start: 13 * time.Hour, End: 14 * time.Hour, Location: time.UTC}}, now, time.Hour, true},
+		{"weekday", []MaintenanceWindow{{Start: 2 * time.Hour, End: 3 * time.Hour, Weekdays: []time.Weekday{time.Wednesday}, Location: time.UTC}}, now, 38 * time.Hour, true},
+		{"invalid weekday", []MaintenanceWindow{{Start: time.Hour, End: 2 * time.Hour, Weekdays: []time.Weekday{7}}}, now, 0, false},
+	} {
+		delay, ok := maintenanceWindowDelay(c.windows, c.now)
+		if delay != c.delay || ok != c.ok {
+			t.Errorf("%s: delay must be %s %v but is %s %v", c.name, c.delay, c.ok, delay, ok)
+		}
+	}
+}
+
+func TestOtaEngine_PreCheck(t *testing.T) {
+	content := []byte("firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	for _, c := range []struct {
+		name      string
+		preCheck  OtaPreCheckConfig
+		code      int
+		installed bool
+	}{
+		{"busy", OtaPreCheckConfig{Busy: func() bool { return true }}, UpgradeCodeDeviceBusy, false},
+		{"low battery", OtaPreCheckConfig{BatteryLevel: func() int { return 10 }, MinBattery: 20}, UpgradeCodeLowBattery, false},
+		{"no space", OtaPreCheckConfig{FreeStorage: func(dir string) (int64, error) { return int64(len(content)), nil }, MinStorage: 1}, UpgradeCodeNoSpace, false},
+		{"no memory", OtaPreCheckConfig{FreeMemory: func() int64 { return 1 }, MinMemory: 1024}, UpgradeCodeNoMemory, false},
+		{"custom install check", OtaPreCheckConfig{Custom: []OtaPreCheck{func(stage string, upgradeType byte, info UpgradeInfo) error {
+			if stage == OtaStageInstall {
+				return errors.New("device is running task")
+			}
+			return nil
+		}}}, UpgradeCodeDeviceBusy, false},
+		{"passed", OtaPreCheckConfig{BatteryLevel: func() int { return 80 }, MinBattery: 20}, UpgradeCodeSuccess, true},
+	} {
+		installed := false
+		device, client := createFakeIotDevice()
+		engine, dir := createOtaEngine(t, device, func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+			installed = true
+			return nil
+		})
+		engine.config.PreCheck = c.preCheck
+
+		info := createOtaUpgradeInfo(server.URL, content)
+		device.base.upgradeDevice(1, &info)
+		progresses := waitUpgradeResult(t, client)
+		if last := progresses[len(progresses)-1]; last.ResultCode != c.code || installed != c.installed {
+			t.Errorf("%s: pre check must report result code %d but is %+v", c.name, c.code, last)
+		}
+		engine.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOtaEngine_Deferred(t *testing.T) {
+	content := []byte("firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	device, client := createFakeIotDevice()
+	engine, dir := createOtaEngine(t, device, nil)
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+	engine.config.Windows = []MaintenanceWindow{{Start: 2 * time.Hour, End: 4 * time.Hour, Location: time.UTC}}
+	engine.now = func() time.Time {
+		return time.Date(2021, 3, 1, 2, 0, 0, 0, time.UTC).Add(-50 * time.Millisecond)
+	}
+
+	info := createOtaUpgradeInfo(server.URL, content)
+	device.base.upgradeDevice(1, &info)
+	progresses := waitUpgradeResult(t, client)
+	if progresses[0].Description != "deferred" {
+		t.Errorf("upgrade out of maintenance window must be deferred %+v", progresses[0])
+	}
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeSuccess {
+		t.Errorf("deferred upgrade must be executed in maintenance window %+v", last)
+	}
+}
+
+func TestOtaEngine_ReplaceDeferred(t *testing.T) {
+	content := []byte("firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	device, client := createFakeIotDevice()
+	engine, dir := createOtaEngine(t, device, nil)
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+	engine.config.Windows = []MaintenanceWindow{{Start: 2 * time.Hour, End: 4 * time.Hour, Location: time.UTC}}
+	// 第一个升级通知在时间段之前收到，第二个升级通知在时间段内收到
+	var calls int32
+	engine.now = func() time.Time {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return time.Date(2021, 3, 1, 1, 0, 0, 0, time.UTC)
+		}
+		return time.Date(2021, 3, 1, 3, 0, 0, 0, time.UTC)
+	}
+
+	first := createOtaUpgradeInfo(server.URL, content)
+	first.Version = "v1.5"
+	device.base.upgradeDevice(1, &first)
+	deadline := time.Now().Add(time.Second)
+	for len(upgradeProgresses(client)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	second := createOtaUpgradeInfo(server.URL, content)
+	device.base.upgradeDevice(1, &second)
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		progresses := upgradeProgresses(client)
+		if last := progresses[len(progresses)-1]; last.Progress == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 等待被替换的任务结束
+	time.Sleep(50 * time.Millisecond)
+
+	progresses := upgradeProgresses(client)
+	if progresses[0].Description != "deferred" {
+		t.Errorf("first upgrade must be deferred %+v", progresses[0])
+	}
+	for _, progress := range progresses {
+		if progress.ResultCode != UpgradeCodeSuccess {
+			t.Errorf("replaced upgrade must not report failure %+v", progress)
+		}
+	}
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeSuccess || last.Version != "v2.0" {
+		t.Errorf("deferred upgrade must be replaced by new upgrade %+v", progresses)
+	}
+}
@@ -0,0 +1,186 @@
+package iot
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 签名文件的最大字节数
+const maxOtaSignatureSize = 64 * 1024
+
+// 校验升级包签名的公钥，每个公钥使用唯一的ID标识。轮换公钥时先添加新公钥，
+// 使用旧公钥签名的升级包全部发布完成后再删除旧公钥
+type OtaKeyring struct {
+	lock sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+func NewOtaKeyring() *OtaKeyring {
+	return &OtaKeyring{keys: map[string]crypto.PublicKey{}}
+}
+
+// 添加公钥，支持*ecdsa.PublicKey、*rsa.PublicKey和ed25519.PublicKey
+func (keyring *OtaKeyring) Add(keyId string, key crypto.PublicKey) error {
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return &DeviceError{errorMsg: fmt.Sprintf("unsupported public key type %T", key)}
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+	keyring.keys[keyId] = key
+	return nil
+}
+
+// 添加PEM格式（PKIX）的公钥
+func (keyring *OtaKeyring) AddPEM(keyId string, data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return &DeviceError{errorMsg: "public key " + keyId + " is not pem encoded"}
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	return keyring.Add(keyId, key)
+}
+
+func (keyring *OtaKeyring) Remove(keyId string) {
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+	delete(keyring.keys, keyId)
+}
+
+// 校验对SHA256摘要的签名。keyId为空时依次尝试全部公钥
+func (keyring *OtaKeyring) Verify(digest, signature []byte, keyId string) error {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	if len(keyId) > 0 {
+		key, ok := keyring.keys[keyId]
+		if !ok {
+			return &DeviceError{errorMsg: "unknown signature key " + keyId}
+		}
+		if !verifyOtaSignature(key, digest, signature) {
+			return &DeviceError{errorMsg: "signature verification failed with key " + keyId}
+		}
+		return nil
+	}
+
+	for _, key := range keyring.keys {
+		if verifyOtaSignature(key, digest, signature) {
+			return nil
+		}
+	}
+	return &DeviceError{errorMsg: "signature verification failed"}
+}
+
+// ECDSA使用ASN.1格式的签名，RSA支持PKCS#1 v1.5和PSS签名，Ed25519将摘要作为消息签名
+func verifyOtaSignature(key crypto.PublicKey, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest, signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, digest, signature, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, digest, signature)
+	}
+	return false
+}
+
+// 分离的签名文件，可以是JSON格式{"key_id":"","signature":"base64"}、base64文本或者签名的原始字节
+type otaSignature struct {
+	KeyId     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+func parseOtaSignature(data []byte) (string, []byte) {
+	signature := otaSignature{}
+	if json.Unmarshal(data, &signature) == nil && len(signature.Signature) > 0 {
+		if decoded, err := base64.StdEncoding.DecodeString(signature.Signature); err == nil {
+			return signature.KeyId, decoded
+		}
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		return "", decoded
+	}
+	return "", data
+}
+
+// 签名文件的默认地址，为升级包地址的路径加上.sig
+func defaultOtaSignatureUrl(info UpgradeInfo) string {
+	u, err := url.Parse(info.Url)
+	if err != nil {
+		return info.Url + ".sig"
+	}
+	u.Path += ".sig"
+	u.RawPath = ""
+	return u.String()
+}
+
+// 下载签名文件并校验升级包签名，校验失败时返回结果码7
+func (engine *OtaEngine) verifySignature(ctx context.Context, info UpgradeInfo, path string) error {
+	signatureUrl := defaultOtaSignatureUrl(info)
+	if engine.config.SignatureUrl != nil {
+		signatureUrl = engine.config.SignatureUrl(info)
+	}
+
+	data, err := engine.fetchSignature(ctx, info, signatureUrl)
+	if err != nil {
+		return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: "download package signature failed: " + err.Error()}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return err
+	}
+
+	keyId, signature := parseOtaSignature(data)
+	if err := engine.config.Keyring.Verify(digest.Sum(nil), signature, keyId); err != nil {
+		return &UpgradeError{ResultCode: UpgradeCodeCheckFailed, Description: err.Error()}
+	}
+	return nil
+}
+
+func (engine *OtaEngine) fetchSignature(ctx context.Context, info UpgradeInfo, signatureUrl string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, signatureUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.AccessToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+info.AccessToken)
+	}
+
+	response, err := engine.config.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &DeviceError{errorMsg: fmt.Sprintf("status code %d", response.StatusCode)}
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, maxOtaSignatureSize))
+}
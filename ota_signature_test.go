@@ -0,0 +1,123 @@
+package iot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func signOtaDigest(t *testing.T, key crypto.Signer, digest []byte) []byte {
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	signature, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestOtaKeyring_Verify(t *testing.T) {
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	digest := sha256.Sum256([]byte("firmware"))
+
+	keyring := NewOtaKeyring()
+	der, _ := x509.MarshalPKIXPublicKey(ecdsaKey.Public())
+	if err := keyring.AddPEM("ecdsa", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})); err != nil {
+		t.Fatal(err)
+	}
+	keyring.Add("rsa", rsaKey.Public())
+	keyring.Add("ed25519", ed25519Key.Public())
+
+	for _, key := range []crypto.Signer{ecdsaKey, rsaKey, ed25519Key} {
+		signature := signOtaDigest(t, key, digest[:])
+		if err := keyring.Verify(digest[:], signature, ""); err != nil {
+			t.Errorf("%T signature must be verified %v", key, err)
+		}
+		other := sha256.Sum256([]byte("other"))
+		if keyring.Verify(other[:], signature, "") == nil {
+			t.Errorf("%T signature of other package must be rejected", key)
+		}
+	}
+	if keyring.Verify(digest[:], signOtaDigest(t, rsaKey, digest[:]), "ecdsa") == nil {
+		t.Errorf("signature must be verified with specified key only")
+	}
+}
+
+func TestOtaKeyring_Rotation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	digest := sha256.Sum256([]byte("firmware"))
+	keyring := NewOtaKeyring()
+	keyring.Add("2020", oldKey.Public())
+
+	signature := signOtaDigest(t, newKey, digest[:])
+	if keyring.Verify(digest[:], signature, "") == nil {
+		t.Errorf("signature of new key must be rejected before rotation")
+	}
+	keyring.Add("2021", newKey.Public())
+	if err := keyring.Verify(digest[:], signature, "2021"); err != nil {
+		t.Errorf("signature of new key must be verified after rotation %v", err)
+	}
+	keyring.Remove("2020")
+	if keyring.Verify(digest[:], signOtaDigest(t, oldKey, digest[:]), "") == nil {
+		t.Errorf("signature of removed key must be rejected")
+	}
+}
+
+func TestOtaEngine_Signature(t *testing.T) {
+	content := []byte("firmware")
+	digest := sha256.Sum256(content)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	signature := signOtaDigest(t, key, digest[:])
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch request.URL.Path {
+		case "/package.bin":
+			writer.Write(content)
+		case "/package.bin.sig":
+			writer.Write([]byte(`{"key_id":"device","signature":"` + base64.StdEncoding.EncodeToString(signature) + `"}`))
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		key  ed25519.PrivateKey
+		code int
+	}{{key, UpgradeCodeSuccess}, {otherKey, UpgradeCodeCheckFailed}} {
+		device, client := createFakeIotDevice()
+		engine, dir := createOtaEngine(t, device, nil)
+		engine.config.Keyring = NewOtaKeyring()
+		engine.config.Keyring.Add("device", c.key.Public())
+
+		info := createOtaUpgradeInfo(server.URL+"/package.bin", content)
+		device.base.upgradeDevice(1, &info)
+		progresses := waitUpgradeResult(t, client)
+		if last := progresses[len(progresses)-1]; last.ResultCode != c.code {
+			t.Errorf("signature verification must report result code %d but is %+v", c.code, last)
+		}
+		engine.Stop()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,349 @@
+package iot
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 安装函数返回该错误表示升级包已经安装，需要重启后确认升级结果，OtaEngine不会上报升级成功
+var ErrUpgradeRebootRequired = &DeviceError{errorMsg: "upgrade is waiting for reboot"}
+
+const defaultSlotConfirmTimeout = 5 * time.Minute
+
+// A/B分区升级的阶段
+const (
+	slotPhaseRebooting   = "rebooting"    // 新分区已经安装并切换，等待重启
+	slotPhaseConfirming  = "confirming"   // 已经从新分区启动，等待确认
+	slotPhaseRollingBack = "rolling_back" // 确认超时，已经切换回原分区，等待重启
+	slotPhaseReporting   = "reporting"    // 升级结束，等待向平台上报结果
+	slotPhaseVersion     = "version"      // 升级结果已经上报，等待上报软固件版本
+)
+
+// 设备A/B分区的操作，由设备根据bootloader实现
+type SlotManager interface {
+	// 当前启动的分区
+	ActiveSlot() (string, error)
+
+	// 分区列表，A/B升级需要两个分区
+	Slots() []string
+
+	// 将升级包写入未启动的分区
+	Install(slot string, packagePath string) error
+
+	// 设置下次启动的分区
+	Switch(slot string) error
+
+	// 确认当前分区可以正常运行，bootloader不再回退
+	Confirm(slot string) error
+
+	// 重启设备
+	Reboot() error
+}
+
+type ABSlotConfig struct {
+	StatePath      string        // 保存升级状态的文件，重启后恢复升级状态
+	ConfirmTimeout time.Duration // 从新分区启动后等待确认的时间，超时后回退到原分区，默认5分钟
+	Manager        SlotManager
+	HealthCheck    func() error // 从新分区启动后检查设备状态，返回nil时自动确认，为nil时需要调用Confirm
+}
+
+// 升级过程中保存到磁盘的状态
+type slotUpgradeState struct {
+	Phase       string           `json:"phase"`
+	UpgradeType byte             `json:"upgrade_type"`
+	Version     string           `json:"version"`
+	FromSlot    string           `json:"from_slot"`
+	ToSlot      string           `json:"to_slot"`
+	Deadline    time.Time        `json:"deadline,omitempty"`
+	Report      *UpgradeProgress `json:"report,omitempty"`
+}
+
+// A/B分区升级：升级包安装到未启动的分区，切换分区后重启，从新分区启动后在超时时间内确认，
+// 否则回退到原分区并上报结果码10。升级状态保存在磁盘上，重启并连接平台后上报最终升级状态和软固件版本
+type ABSlotUpgrader struct {
+	device Device
+	config ABSlotConfig
+	now    func() time.Time
+
+	lock  sync.Mutex
+	state *slotUpgradeState
+	timer *time.Timer
+}
+
+func NewABSlotUpgrader(device Device, config ABSlotConfig) *ABSlotUpgrader {
+	if config.ConfirmTimeout <= 0 {
+		config.ConfirmTimeout = defaultSlotConfirmTimeout
+	}
+
+	return &ABSlotUpgrader{
+		device: device,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// 恢复升级状态，设备启动后调用
+func (upgrader *ABSlotUpgrader) Start() error {
+	state, err := upgrader.load()
+	if err != nil {
+		return err
+	}
+
+	upgrader.lock.Lock()
+	upgrader.state = state
+	if state != nil {
+		if err := upgrader.resume(); err != nil {
+			upgrader.lock.Unlock()
+			return err
+		}
+	}
+	phase := upgrader.phase()
+	upgrader.lock.Unlock()
+
+	upgrader.device.AddConnectHandler(upgrader.report)
+	if phase == slotPhaseConfirming && upgrader.config.HealthCheck != nil {
+		go func() {
+			if err := upgrader.config.HealthCheck(); err != nil {
+				glog.Warningf("health check after upgrade failed %v", err)
+				return
+			}
+			if err := upgrader.Confirm(); err != nil {
+				glog.Warningf("confirm upgrade failed %v", err)
+			}
+		}()
+	}
+	if upgrader.device.IsConnected() {
+		go upgrader.report()
+	}
+	return nil
+}
+
+func (upgrader *ABSlotUpgrader) Stop() {
+	upgrader.lock.Lock()
+	defer upgrader.lock.Unlock()
+	if upgrader.timer != nil {
+		upgrader.timer.Stop()
+		upgrader.timer = nil
+	}
+}
+
+// 根据重启后启动的分区继续升级流程
+func (upgrader *ABSlotUpgrader) resume() error {
+	state := upgrader.state
+	switch state.Phase {
+	case slotPhaseRebooting:
+		active, err := upgrader.config.Manager.ActiveSlot()
+		if err != nil {
+			return err
+		}
+		if active != state.ToSlot {
+			glog.Warningf("device boot from slot %s instead of upgraded slot %s", active, state.ToSlot)
+			return upgrader.finish(UpgradeProgress{ResultCode: UpgradeCodeInstallFailed, Description: "upgraded slot failed to boot"})
+		}
+		state.Phase = slotPhaseConfirming
+		state.Deadline = upgrader.now().Add(upgrader.config.ConfirmTimeout)
+		if err := upgrader.save(); err != nil {
+			return err
+		}
+		upgrader.startTimer()
+	case slotPhaseConfirming:
+		// 确认前设备异常重启，bootloader可能已经回退到原分区
+		active, err := upgrader.config.Manager.ActiveSlot()
+		if err != nil {
+			return err
+		}
+		if active != state.ToSlot {
+			glog.Warningf("device boot from slot %s before upgraded slot %s confirmed", active, state.ToSlot)
+			return upgrader.finish(UpgradeProgress{ResultCode: UpgradeCodeInstallFailed, Description: "upgraded slot failed to boot"})
+		}
+		upgrader.startTimer()
+	case slotPhaseRollingBack:
+		return upgrader.finish(UpgradeProgress{ResultCode: UpgradeCodeInstallFailed, Description: "upgrade not confirmed in time,rolled back"})
+	}
+	return nil
+}
+
+func (upgrader *ABSlotUpgrader) startTimer() {
+	remaining := upgrader.state.Deadline.Sub(upgrader.now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	upgrader.timer = time.AfterFunc(remaining, upgrader.rollback)
+}
+
+// 将升级包安装到未启动的分区并切换分区后重启，可以作为OtaConfig的Install
+func (upgrader *ABSlotUpgrader) Install(upgradeType byte, info UpgradeInfo, packagePath string) error {
+	upgrader.lock.Lock()
+	defer upgrader.lock.Unlock()
+	if upgrader.state != nil {
+		return &UpgradeError{ResultCode: UpgradeCodeDeviceBusy, Description: "previous upgrade is not finished"}
+	}
+
+	manager := upgrader.config.Manager
+	active, err := manager.ActiveSlot()
+	if err != nil {
+		return err
+	}
+	target := ""
+	for _, slot := range manager.Slots() {
+		if slot != active {
+			target = slot
+		}
+	}
+	if len(target) == 0 {
+		return &UpgradeError{ResultCode: UpgradeCodeUnsupported, Description: "no inactive slot to install"}
+	}
+
+	if err := manager.Install(target, packagePath); err != nil {
+		return err
+	}
+	upgrader.state = &slotUpgradeState{
+		Phase:       slotPhaseRebooting,
+		UpgradeType: upgradeType,
+		Version:     info.Version,
+		FromSlot:    active,
+		ToSlot:      target,
+	}
+	if err := upgrader.save(); err != nil {
+		upgrader.state = nil
+		return err
+	}
+
+	if err := manager.Switch(target); err != nil {
+		upgrader.clear()
+		return err
+	}
+	glog.Infof("upgrade package of version %s installed to slot %s,reboot now", info.Version, target)
+	if err := manager.Reboot(); err != nil {
+		manager.Switch(active)
+		upgrader.clear()
+		return err
+	}
+	return ErrUpgradeRebootRequired
+}
+
+// 确认新分区运行正常，升级成功
+func (upgrader *ABSlotUpgrader) Confirm() error {
+	upgrader.lock.Lock()
+	defer upgrader.lock.Unlock()
+	if upgrader.phase() != slotPhaseConfirming {
+		return &DeviceError{errorMsg: "no upgrade is waiting for confirm"}
+	}
+
+	if err := upgrader.config.Manager.Confirm(upgrader.state.ToSlot); err != nil {
+		return err
+	}
+	if upgrader.timer != nil {
+		upgrader.timer.Stop()
+		upgrader.timer = nil
+	}
+	glog.Infof("upgrade to version %s confirmed", upgrader.state.Version)
+	if err := upgrader.finish(UpgradeProgress{ResultCode: UpgradeCodeSuccess, Progress: 100, Version: upgrader.state.Version, Description: "upgrade success"}); err != nil {
+		return err
+	}
+	if upgrader.device.IsConnected() {
+		go upgrader.report()
+	}
+	return nil
+}
+
+// 确认超时，切换回原分区并重启
+func (upgrader *ABSlotUpgrader) rollback() {
+	upgrader.lock.Lock()
+	defer upgrader.lock.Unlock()
+	upgrader.timer = nil
+	if upgrader.phase() != slotPhaseConfirming {
+		return
+	}
+
+	glog.Warningf("upgrade to version %s not confirmed in time,roll back to slot %s", upgrader.state.Version, upgrader.state.FromSlot)
+	if err := upgrader.config.Manager.Switch(upgrader.state.FromSlot); err != nil {
+		glog.Errorf("roll back to slot %s failed %v", upgrader.state.FromSlot, err)
+		return
+	}
+	upgrader.state.Phase = slotPhaseRollingBack
+	if err := upgrader.save(); err != nil {
+		glog.Errorf("save upgrade state failed %v", err)
+	}
+	if err := upgrader.config.Manager.Reboot(); err != nil {
+		glog.Errorf("reboot after roll back failed %v", err)
+	}
+}
+
+// 记录需要上报的最终升级状态
+func (upgrader *ABSlotUpgrader) finish(progress UpgradeProgress) error {
+	upgrader.state.Phase = slotPhaseReporting
+	upgrader.state.Report = &progress
+	return upgrader.save()
+}
+
+// 连接平台后上报最终升级状态和软固件版本，全部上报成功后清除升级状态
+func (upgrader *ABSlotUpgrader) report() {
+	upgrader.lock.Lock()
+	defer upgrader.lock.Unlock()
+	if upgrader.phase() == slotPhaseReporting {
+		if !upgrader.device.ReportUpgradeProgress(*upgrader.state.Report) {
+			glog.Warningf("report upgrade result failed,retry after reconnect")
+			return
+		}
+		upgrader.state.Phase = slotPhaseVersion
+		if err := upgrader.save(); err != nil {
+			glog.Warningf("save upgrade state failed %v", err)
+		}
+	}
+	if upgrader.phase() != slotPhaseVersion {
+		return
+	}
+
+	if !upgrader.device.ReportVersion() {
+		glog.Warningf("report version after upgrade failed,retry after reconnect")
+		return
+	}
+	upgrader.clear()
+}
+
+func (upgrader *ABSlotUpgrader) phase() string {
+	if upgrader.state == nil {
+		return ""
+	}
+	return upgrader.state.Phase
+}
+
+func (upgrader *ABSlotUpgrader) clear() {
+	upgrader.state = nil
+	if err := os.Remove(upgrader.config.StatePath); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("remove upgrade state failed %v", err)
+	}
+}
+
+func (upgrader *ABSlotUpgrader) load() (*slotUpgradeState, error) {
+	data, err := ioutil.ReadFile(upgrader.config.StatePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &slotUpgradeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// 先写入临时文件再重命名，避免掉电时状态文件损坏
+func (upgrader *ABSlotUpgrader) save() error {
+	temp := upgrader.config.StatePath + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(temp), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(temp, []byte(Interface2JsonString(upgrader.state)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, upgrader.config.StatePath)
+}
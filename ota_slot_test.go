@@ -0,0 +1,305 @@
+package iot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 内存中的A/B分区，reboot模拟设备重启后从下次启动的分区启动
+type memorySlotManager struct {
+	lock      sync.Mutex
+	active    string
+	next      string
+	installed map[string]string
+	confirmed string
+	reboots   int
+}
+
+func newMemorySlotManager() *memorySlotManager {
+	return &memorySlotManager{active: "a", next: "a", installed: map[string]string{}}
+}
+
+func (manager *memorySlotManager) ActiveSlot() (string, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.active, nil
+}
+
+func (manager *memorySlotManager) Slots() []string {
+	return []string{"a", "b"}
+}
+
+func (manager *memorySlotManager) Install(slot string, packagePath string) error {
+	data, err := ioutil.ReadFile(packagePath)
+	if err != nil {
+		return err
+	}
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.installed[slot] = string(data)
+	return nil
+}
+
+func (manager *memorySlotManager) Switch(slot string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.next = slot
+	return nil
+}
+
+func (manager *memorySlotManager) Confirm(slot string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.confirmed = slot
+	return nil
+}
+
+func (manager *memorySlotManager) Reboot() error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.reboots++
+	return nil
+}
+
+func (manager *memorySlotManager) reboot() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.active = manager.next
+}
+
+func (manager *memorySlotManager) rebootCount() int {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	return manager.reboots
+}
+
+// 设备上报的软固件版本
+func reportedVersions(client *fakeClient) []string {
+	var versions []string
+	for _, message := range client.messages() {
+		data := struct {
+			Services []struct {
+				EventType string `json:"event_type"`
+				Paras     struct {
+					SwVersion string `json:"sw_version"`
+				} `json:"paras"`
+			} `json:"services"`
+		}{}
+		json.Unmarshal(message.payload, &data)
+		for _, service := range data.Services {
+			if service.EventType == "version_report" {
+				versions = append(versions, service.Paras.SwVersion)
+			}
+		}
+	}
+	return versions
+}
+
+func installSlotPackage(t *testing.T, upgrader *ABSlotUpgrader) {
+	packagePath := filepath.Join(filepath.Dir(upgrader.config.StatePath), "package.bin")
+	ioutil.WriteFile(packagePath, []byte("v2.0"), 0644)
+	if err := upgrader.Install(1, UpgradeInfo{Version: "v2.0"}, packagePath); err != ErrUpgradeRebootRequired {
+		t.Fatalf("install must wait for reboot but is %v", err)
+	}
+}
+
+func TestABSlotUpgrader_Confirm(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "slot")
+	defer os.RemoveAll(dir)
+	manager := newMemorySlotManager()
+	config := ABSlotConfig{StatePath: filepath.Join(dir, "state.json"), Manager: manager}
+
+	device, _ := createFakeIotDevice()
+	upgrader := NewABSlotUpgrader(device, config)
+	if err := upgrader.Start(); err != nil {
+		t.Fatal(err)
+	}
+	installSlotPackage(t, upgrader)
+	if manager.installed["b"] != "v2.0" || manager.next != "b" || manager.rebootCount() != 1 {
+		t.Fatalf("package must be installed to inactive slot and reboot")
+	}
+
+	// 重启后从新分区启动并确认
+	manager.reboot()
+	device, client := createFakeIotDevice()
+	device.SetSwFwVersionReporter(func() (string, string) {
+		return "v2.0", "v2.0"
+	})
+	upgrader = NewABSlotUpgrader(device, config)
+	if err := upgrader.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer upgrader.Stop()
+	if err := upgrader.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	progresses := waitUpgradeResult(t, client)
+
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeSuccess || last.Version != "v2.0" {
+		t.Errorf("upgrade success must be reported after confirm %+v", last)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if versions := reportedVersions(client); len(versions) != 1 || versions[0] != "v2.0" {
+		t.Errorf("new version must be reported after upgrade %v", versions)
+	}
+	if manager.confirmed != "b" {
+		t.Errorf("new slot must be confirmed")
+	}
+	if _, err := os.Stat(config.StatePath); !os.IsNotExist(err) {
+		t.Errorf("upgrade state must be removed after report")
+	}
+}
+
+func TestABSlotUpgrader_Rollback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "slot")
+	defer os.RemoveAll(dir)
+	manager := newMemorySlotManager()
+	config := ABSlotConfig{StatePath: filepath.Join(dir, "state.json"), Manager: manager, ConfirmTimeout: 50 * time.Millisecond}
+
+	device, _ := createFakeIotDevice()
+	upgrader := NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	installSlotPackage(t, upgrader)
+
+	// 从新分区启动后没有确认
+	manager.reboot()
+	device, _ = createFakeIotDevice()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	deadline := time.Now().Add(time.Second)
+	for manager.rebootCount() != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	upgrader.Stop()
+	if manager.rebootCount() != 2 || manager.next != "a" {
+		t.Fatalf("device must roll back to original slot and reboot")
+	}
+
+	// 回退后从原分区启动，连接平台后上报升级失败
+	manager.reboot()
+	device, client := createFakeIotDevice()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	progresses := waitUpgradeResult(t, client)
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeInstallFailed {
+		t.Errorf("roll back must report result code 10 %+v", last)
+	}
+}
+
+func TestABSlotUpgrader_ResumeConfirmDeadline(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "slot")
+	defer os.RemoveAll(dir)
+	manager := newMemorySlotManager()
+	config := ABSlotConfig{StatePath: filepath.Join(dir, "state.json"), Manager: manager, ConfirmTimeout: time.Hour}
+
+	device, _ := createFakeIotDevice()
+	upgrader := NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	installSlotPackage(t, upgrader)
+	manager.reboot()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	upgrader.Stop()
+
+	// 确认前进程重启，确认期限已过时立即回退
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.now = func() time.Time {
+		return time.Now().Add(2 * time.Hour)
+	}
+	upgrader.Start()
+	defer upgrader.Stop()
+	deadline := time.Now().Add(time.Second)
+	for manager.rebootCount() != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if manager.next != "a" {
+		t.Errorf("expired confirm deadline must roll back after restart")
+	}
+}
+
+func TestABSlotUpgrader_RetryVersionReport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "slot")
+	defer os.RemoveAll(dir)
+	manager := newMemorySlotManager()
+	config := ABSlotConfig{StatePath: filepath.Join(dir, "state.json"), Manager: manager, ConfirmTimeout: time.Hour}
+
+	device, client := createFakeIotDevice()
+	device.SetSwFwVersionReporter(func() (string, string) {
+		return "v2.0", ""
+	})
+	upgrader := NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	installSlotPackage(t, upgrader)
+	manager.reboot()
+
+	client.lock.Lock()
+	client.publishErr = func(topic string, payload []byte) error {
+		if strings.Contains(string(payload), "version_report") {
+			return &DeviceError{errorMsg: "publish failed"}
+		}
+		return nil
+	}
+	client.lock.Unlock()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	defer upgrader.Stop()
+	if err := upgrader.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	upgrader.report()
+	if len(upgradeProgresses(client)) != 1 {
+		t.Fatalf("upgrade result must be reported")
+	}
+	if _, err := os.Stat(config.StatePath); err != nil {
+		t.Fatalf("upgrade state must be kept when version report failed")
+	}
+
+	// 重新连接平台后只补报软固件版本
+	client.lock.Lock()
+	client.publishErr = nil
+	client.lock.Unlock()
+	upgrader.report()
+	if len(upgradeProgresses(client)) != 1 || len(reportedVersions(client)) != 1 {
+		t.Errorf("only version must be reported again,progresses %d", len(upgradeProgresses(client)))
+	}
+	if _, err := os.Stat(config.StatePath); !os.IsNotExist(err) {
+		t.Errorf("upgrade state must be removed after version reported")
+	}
+}
+
+func TestABSlotUpgrader_ResumeAfterBootloaderFallback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "slot")
+	defer os.RemoveAll(dir)
+	manager := newMemorySlotManager()
+	config := ABSlotConfig{StatePath: filepath.Join(dir, "state.json"), Manager: manager, ConfirmTimeout: 50 * time.Millisecond}
+
+	device, client := createFakeIotDevice()
+	upgrader := NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	installSlotPackage(t, upgrader)
+	manager.reboot()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	upgrader.Stop()
+
+	// 确认前设备崩溃，bootloader回退到原分区
+	manager.Switch("a")
+	manager.reboot()
+	upgrader = NewABSlotUpgrader(device, config)
+	upgrader.Start()
+	defer upgrader.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if manager.rebootCount() != 1 {
+		t.Errorf("device must not reboot again after bootloader fell back,reboots %d", manager.rebootCount())
+	}
+	progresses := upgradeProgresses(client)
+	if len(progresses) == 0 || progresses[len(progresses)-1].ResultCode != UpgradeCodeInstallFailed {
+		t.Errorf("failed upgrade must be reported %+v", progresses)
+	}
+}
@@ -0,0 +1,217 @@
+package iot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 模拟升级包下载服务，interrupt为true时第一次下载只返回一半内容后断开连接
+func newOtaPackageServer(t *testing.T, content []byte, interrupt bool) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if atomic.AddInt32(&requests, 1) == 1 && interrupt {
+			writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			writer.Write(content[:len(content)/2])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(writer, request, "package.bin", time.Now(), bytes.NewReader(content))
+	}))
+	return server, &requests
+}
+
+func createOtaUpgradeInfo(url string, content []byte) UpgradeInfo {
+	digest := sha256.Sum256(content)
+	return UpgradeInfo{
+		Version:     "v2.0",
+		Url:         url,
+		FileSize:    len(content),
+		AccessToken: "token",
+		Sign:        hex.EncodeToString(digest[:]),
+	}
+}
+
+func createOtaEngine(t *testing.T, device *iotDevice, install OtaInstallHandler) (*OtaEngine, string) {
+	device.base.upgradeProgressInterval = time.Nanosecond
+	dir, err := ioutil.TempDir("", "ota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewOtaEngine(device, OtaConfig{
+		DownloadDir:   dir,
+		ProgressStep:  20,
+		RetryInterval: 10 * time.Millisecond,
+		Install:       install,
+	})
+	engine.Start()
+	return engine, dir
+}
+
+// 设备上报的升级状态
+func upgradeProgresses(client *fakeClient) []UpgradeProgress {
+	var progresses []UpgradeProgress
+	for _, message := range client.messages() {
+		data := struct {
+			Services []struct {
+				EventType string          `json:"event_type"`
+				Paras     UpgradeProgress `json:"paras"`
+			} `json:"services"`
+		}{}
+		if json.Unmarshal(message.payload, &data) != nil {
+			continue
+		}
+		for _, service := range data.Services {
+			if service.EventType == "upgrade_progress_report" {
+				progresses = append(progresses, service.Paras)
+			}
+		}
+	}
+	return progresses
+}
+
+// 等待升级结束，返回全部升级状态
+func waitUpgradeResult(t *testing.T, client *fakeClient) []UpgradeProgress {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		progresses := upgradeProgresses(client)
+		if len(progresses) > 0 {
+			last := progresses[len(progresses)-1]
+			if last.ResultCode != 0 || last.Progress == 100 {
+				return progresses
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("upgrade must finish")
+	return nil
+}
+
+func TestOtaEngine_UpgradeWithResume(t *testing.T) {
+	content := bytes.Repeat([]byte("firmware"), 25000)
+	server, requests := newOtaPackageServer(t, content, true)
+	defer server.Close()
+
+	device, client := createFakeIotDevice()
+	var installed []byte
+	engine, dir := createOtaEngine(t, device, func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+		installed, _ = ioutil.ReadFile(packagePath)
+		return nil
+	})
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+
+	info := createOtaUpgradeInfo(server.URL, content)
+	device.base.upgradeDevice(1, &info)
+	progresses := waitUpgradeResult(t, client)
+
+	last := progresses[len(progresses)-1]
+	if last.ResultCode != UpgradeCodeSuccess || last.Version != "v2.0" {
+		t.Errorf("upgrade must success %+v", last)
+	}
+	if !bytes.Equal(installed, content) {
+		t.Errorf("install handler must receive verified package")
+	}
+	if atomic.LoadInt32(requests) != 2 {
+		t.Errorf("interrupted download must be resumed once but requests = %d", atomic.LoadInt32(requests))
+	}
+
+	steps := 0
+	for _, progress := range progresses {
+		if progress.Description == "downloading" && progress.Progress > 0 {
+			steps++
+		}
+	}
+	if steps < 2 || steps > 4 {
+		t.Errorf("download progress must be reported every 20 percent but reported %d times", steps)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("package must be removed after install")
+	}
+}
+
+func TestOtaEngine_SignMismatch(t *testing.T) {
+	content := []byte("firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	device, client := createFakeIotDevice()
+	installed := false
+	engine, dir := createOtaEngine(t, device, func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+		installed = true
+		return nil
+	})
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+
+	info := createOtaUpgradeInfo(server.URL, []byte("other"))
+	info.FileSize = len(content)
+	device.base.upgradeDevice(0, &info)
+	progresses := waitUpgradeResult(t, client)
+
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeCheckFailed {
+		t.Errorf("sign mismatch must report result code 7 but is %+v", last)
+	}
+	if installed {
+		t.Errorf("package with wrong sign must not be installed")
+	}
+}
+
+func TestOtaEngine_InstallFailed(t *testing.T) {
+	content := []byte("firmware")
+	server, _ := newOtaPackageServer(t, content, false)
+	defer server.Close()
+
+	device, client := createFakeIotDevice()
+	engine, dir := createOtaEngine(t, device, func(upgradeType byte, info UpgradeInfo, packagePath string) error {
+		return os.ErrPermission
+	})
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+
+	info := createOtaUpgradeInfo(server.URL, content)
+	device.base.upgradeDevice(0, &info)
+	progresses := waitUpgradeResult(t, client)
+
+	if last := progresses[len(progresses)-1]; last.ResultCode != UpgradeCodeInstallFailed {
+		t.Errorf("install failure must report result code 10 but is %+v", last)
+	}
+}
+
+func TestOtaEngine_Busy(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	device, client := createFakeIotDevice()
+	engine, dir := createOtaEngine(t, device, nil)
+	defer os.RemoveAll(dir)
+	defer engine.Stop()
+
+	info := createOtaUpgradeInfo(server.URL, []byte("firmware"))
+	device.base.upgradeDevice(0, &info)
+	for len(upgradeProgresses(client)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	device.base.upgradeDevice(0, &info)
+
+	progresses := waitUpgradeResult(t, client)
+	if len(progresses) != 2 || progresses[1].ResultCode != UpgradeCodeDeviceBusy {
+		t.Errorf("upgrade during another upgrade must be rejected %+v", progresses)
+	}
+}
@@ -0,0 +1,248 @@
+package iot
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 属性上报过滤规则，用于减少模拟量抖动等无效上报。
+// 同时配置多个条件时，属性值需要满足全部条件才会上报，超过MaxSilence没有上报时强制上报。
+type PropertyFilter struct {
+	AbsoluteDeadband float64       // 数值属性与上次上报值的差值小于该值时不上报
+	PercentDeadband  float64       // 数值属性相对上次上报值的变化百分比（0-100）小于该值时不上报
+	MinInterval      time.Duration // 两次上报之间的最小间隔
+	MaxSilence       time.Duration // 超过该时间没有上报时，即使属性值没有变化也上报
+	ChangeOnly       bool          // 属性值（布尔、枚举等）与上次上报值相同时不上报
+}
+
+// 属性最后一次上报的值和时间
+type reportedProperty struct {
+	value interface{}
+	time  time.Time
+}
+
+type propertyFilters struct {
+	lock     sync.Mutex
+	filters  map[string]map[string]PropertyFilter              // serviceId -> property -> filter
+	reported map[string]map[string]map[string]reportedProperty // deviceId -> serviceId -> property -> 最后上报值
+	now      func() time.Time
+}
+
+func newPropertyFilters() *propertyFilters {
+	return &propertyFilters{
+		filters:  map[string]map[string]PropertyFilter{},
+		reported: map[string]map[string]map[string]reportedProperty{},
+		now:      time.Now,
+	}
+}
+
+func (pf *propertyFilters) set(serviceId, propertyName string, filter PropertyFilter) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	if _, ok := pf.filters[serviceId]; !ok {
+		pf.filters[serviceId] = map[string]PropertyFilter{}
+	}
+	pf.filters[serviceId][propertyName] = filter
+}
+
+// 过滤设备的属性，返回需要上报的属性以及上报成功后记录上报值的函数
+func (pf *propertyFilters) filter(deviceId string, entries []DevicePropertyEntry) ([]DevicePropertyEntry, func()) {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+
+	now := pf.now()
+	var result []DevicePropertyEntry
+	var passed []func()
+	for _, entry := range entries {
+		serviceFilters, ok := pf.filters[entry.ServiceId]
+		if !ok {
+			result = append(result, entry)
+			continue
+		}
+
+		// 属性不是json对象时无法按照属性过滤，原样上报
+		properties, ok := propertiesObject(entry.Properties)
+		if !ok {
+			result = append(result, entry)
+			continue
+		}
+		filtered := map[string]interface{}{}
+		for name, value := range properties {
+			filter, ok := serviceFilters[name]
+			if !ok {
+				filtered[name] = value
+				continue
+			}
+
+			last, reported := pf.lastReported(deviceId, entry.ServiceId, name)
+			if reported && !filter.accept(last, value, now) {
+				continue
+			}
+			filtered[name] = value
+			serviceId, propertyName, propertyValue := entry.ServiceId, name, value
+			passed = append(passed, func() {
+				pf.record(deviceId, serviceId, propertyName, reportedProperty{value: propertyValue, time: now})
+			})
+		}
+
+		if len(filtered) == 0 {
+			continue
+		}
+		result = append(result, DevicePropertyEntry{
+			ServiceId:  entry.ServiceId,
+			Properties: filtered,
+			EventTime:  entry.EventTime,
+		})
+	}
+
+	return result, func() {
+		pf.lock.Lock()
+		defer pf.lock.Unlock()
+		for _, record := range passed {
+			record()
+		}
+	}
+}
+
+// 不经过过滤直接上报属性时，返回上报成功后记录设置了过滤条件的属性上报值的函数
+func (pf *propertyFilters) pass(deviceId string, entries []DevicePropertyEntry) func() {
+	pf.lock.Lock()
+	now := pf.now()
+	var passed []reportedPropertyEntry
+	for _, entry := range entries {
+		serviceFilters, ok := pf.filters[entry.ServiceId]
+		if !ok {
+			continue
+		}
+		for name, value := range propertiesToMap(entry.Properties) {
+			if _, ok := serviceFilters[name]; ok {
+				passed = append(passed, reportedPropertyEntry{serviceId: entry.ServiceId, name: name, value: value})
+			}
+		}
+	}
+	pf.lock.Unlock()
+
+	return func() {
+		pf.lock.Lock()
+		defer pf.lock.Unlock()
+		for _, property := range passed {
+			pf.record(deviceId, property.serviceId, property.name, reportedProperty{value: property.value, time: now})
+		}
+	}
+}
+
+type reportedPropertyEntry struct {
+	serviceId string
+	name      string
+	value     interface{}
+}
+
+func (pf *propertyFilters) lastReported(deviceId, serviceId, propertyName string) (reportedProperty, bool) {
+	property, ok := pf.reported[deviceId][serviceId][propertyName]
+	return property, ok
+}
+
+func (pf *propertyFilters) record(deviceId, serviceId, propertyName string, property reportedProperty) {
+	if _, ok := pf.reported[deviceId]; !ok {
+		pf.reported[deviceId] = map[string]map[string]reportedProperty{}
+	}
+	if _, ok := pf.reported[deviceId][serviceId]; !ok {
+		pf.reported[deviceId][serviceId] = map[string]reportedProperty{}
+	}
+	pf.reported[deviceId][serviceId][propertyName] = property
+}
+
+// 判断属性值是否需要上报
+func (filter PropertyFilter) accept(last reportedProperty, value interface{}, now time.Time) bool {
+	elapsed := now.Sub(last.time)
+	if filter.MaxSilence > 0 && elapsed >= filter.MaxSilence {
+		return true
+	}
+	if filter.MinInterval > 0 && elapsed < filter.MinInterval {
+		return false
+	}
+
+	lastNumber, lastIsNumber := toFloat64(last.value)
+	number, isNumber := toFloat64(value)
+	if lastIsNumber && isNumber {
+		change := math.Abs(number - lastNumber)
+		if filter.AbsoluteDeadband > 0 && change < filter.AbsoluteDeadband {
+			return false
+		}
+		if filter.PercentDeadband > 0 {
+			if lastNumber == 0 {
+				return change != 0
+			}
+			if change/math.Abs(lastNumber)*100 < filter.PercentDeadband {
+				return false
+			}
+		}
+	}
+
+	if filter.ChangeOnly && reflect.DeepEqual(last.value, value) {
+		return false
+	}
+
+	return true
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// 属性为json对象，统一转换为map
+func propertiesToMap(properties interface{}) map[string]interface{} {
+	result, ok := propertiesObject(properties)
+	if !ok {
+		glog.Warningf("properties is not json object")
+		return map[string]interface{}{}
+	}
+	return result
+}
+
+// 属性转换为map，属性不是json对象时返回false
+func propertiesObject(properties interface{}) (map[string]interface{}, bool) {
+	if m, ok := properties.(map[string]interface{}); ok {
+		return m, true
+	}
+
+	var result map[string]interface{}
+	if properties == nil || json.Unmarshal([]byte(Interface2JsonString(properties)), &result) != nil || result == nil {
+		return nil, false
+	}
+	return result, true
+}
@@ -0,0 +1,174 @@
+package iot
+
+import (
+	"testing"
+	"time"
+)
+
+// 使用可控时钟的属性过滤器，每次过滤后记录上报值
+type filterTester struct {
+	filters *propertyFilters
+	now     time.Time
+}
+
+func newFilterTester(serviceId, propertyName string, filter PropertyFilter) *filterTester {
+	tester := &filterTester{
+		filters: newPropertyFilters(),
+		now:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tester.filters.now = func() time.Time {
+		return tester.now
+	}
+	tester.filters.set(serviceId, propertyName, filter)
+	return tester
+}
+
+// 上报属性值，返回是否通过过滤
+func (tester *filterTester) report(value interface{}, elapsed time.Duration) bool {
+	tester.now = tester.now.Add(elapsed)
+	entries, commit := tester.filters.filter("device", []DevicePropertyEntry{
+		{
+			ServiceId:  "sensor",
+			Properties: map[string]interface{}{"value": value},
+		},
+	})
+	commit()
+	return len(entries) == 1
+}
+
+func TestPropertyFilter_AbsoluteDeadband(t *testing.T) {
+	tester := newFilterTester("sensor", "value", PropertyFilter{AbsoluteDeadband: 0.5})
+
+	if !tester.report(20.0, 0) {
+		t.Errorf("first value must be reported")
+	}
+	if tester.report(20.3, time.Second) {
+		t.Errorf("value change less than deadband must be filtered")
+	}
+	if !tester.report(20.6, time.Second) {
+		t.Errorf("value change exceed deadband must be reported")
+	}
+}
+
+func TestPropertyFilter_PercentDeadband(t *testing.T) {
+	tester := newFilterTester("sensor", "value", PropertyFilter{PercentDeadband: 10})
+
+	tester.report(100, 0)
+	if tester.report(105, time.Second) {
+		t.Errorf("value change less than 10 percent must be filtered")
+	}
+	if !tester.report(111, time.Second) {
+		t.Errorf("value change exceed 10 percent must be reported")
+	}
+}
+
+func TestPropertyFilter_MinIntervalAndMaxSilence(t *testing.T) {
+	tester := newFilterTester("sensor", "value", PropertyFilter{
+		ChangeOnly:  true,
+		MinInterval: 10 * time.Second,
+		MaxSilence:  time.Minute,
+	})
+
+	tester.report("on", 0)
+	if tester.report("off", time.Second) {
+		t.Errorf("value reported in min interval must be filtered")
+	}
+	if !tester.report("off", 10*time.Second) {
+		t.Errorf("changed value after min interval must be reported")
+	}
+	if tester.report("off", 30*time.Second) {
+		t.Errorf("unchanged value must be filtered")
+	}
+	if !tester.report("off", 30*time.Second) {
+		t.Errorf("value must be reported when exceed max silence")
+	}
+}
+
+func TestPropertyFilter_UnfilteredProperties(t *testing.T) {
+	filters := newPropertyFilters()
+	filters.set("sensor", "value", PropertyFilter{ChangeOnly: true})
+
+	entries := []DevicePropertyEntry{
+		{
+			ServiceId: "sensor",
+			Properties: struct {
+				Value int `json:"value"`
+				Other int `json:"other"`
+			}{Value: 1, Other: 2},
+		},
+		{
+			ServiceId:  "other",
+			Properties: "raw",
+		},
+	}
+	result, commit := filters.filter("device", entries)
+	commit()
+	if len(result) != 2 {
+		t.Fatalf("all properties must be reported first time")
+	}
+
+	result, _ = filters.filter("device", entries)
+	if len(result) != 2 {
+		t.Fatalf("service with unfiltered properties must be reported")
+	}
+	properties := result[0].Properties.(map[string]interface{})
+	if _, ok := properties["value"]; ok {
+		t.Errorf("unchanged property must be filtered")
+	}
+	if _, ok := properties["other"]; !ok {
+		t.Errorf("property without filter must be reported")
+	}
+	if result[1].Properties != "raw" {
+		t.Errorf("service without filter must not be changed")
+	}
+}
+
+func TestPropertyFilter_NonObjectProperties(t *testing.T) {
+	filters := newPropertyFilters()
+	filters.set("sensor", "value", PropertyFilter{ChangeOnly: true})
+
+	entries := []DevicePropertyEntry{
+		{ServiceId: "sensor", Properties: "raw"},
+		{ServiceId: "sensor", Properties: []int{1, 2}},
+		{ServiceId: "sensor"},
+	}
+	for i := 0; i < 2; i++ {
+		result, commit := filters.filter("device", entries)
+		commit()
+		if len(result) != 3 || result[0].Properties != "raw" || result[2].Properties != nil {
+			t.Fatalf("properties which are not json object must be reported unchanged %s", Interface2JsonString(result))
+		}
+	}
+}
+
+func TestBaseIotDevice_FilterDevicesService(t *testing.T) {
+	device := createBaseIotDevice()
+	device.Client = &fakeClient{}
+	device.SetPropertyFilter("sensor", "value", PropertyFilter{ChangeOnly: true})
+
+	service := DevicesService{
+		Devices: []DeviceService{
+			{
+				DeviceId: "sub-1",
+				Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+			},
+		},
+	}
+
+	result, commits := device.filterDevicesService(service)
+	if len(result.Devices) != 1 {
+		t.Fatalf("sub device properties must be reported first time")
+	}
+
+	// 上报失败时不记录上报值
+	result, commits = device.filterDevicesService(service)
+	if len(result.Devices) != 1 {
+		t.Fatalf("sub device properties must be reported when last report failed")
+	}
+	commits["sub-1"]()
+
+	result, _ = device.filterDevicesService(service)
+	if len(result.Devices) != 0 {
+		t.Errorf("unchanged sub device properties must be filtered")
+	}
+}
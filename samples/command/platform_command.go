@@ -15,10 +15,8 @@ func main() {
 	device.Init()
 
 	// 添加用于处理平台下发命令的callback
-	commandProcessResult := false
 	device.AddCommandHandler(func(command iot.Command) (bool, interface{}) {
 		fmt.Println("I get command from platform")
-		commandProcessResult = true
 		return true, map[string]interface{}{
 			"cost_time": 12,
 		}
@@ -29,7 +29,4 @@ func main() {
 		fmt.Println(time.Now().String())
 		fmt.Println(client.IsConnected())
 	}
-	ch := make(chan struct{})
-	<-ch
-
 }
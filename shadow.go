@@ -0,0 +1,136 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+// 查询设备影子的默认超时时间，当context没有设置超时时间时使用
+const defaultShadowQueryTimeout = 10 * time.Second
+
+// 按照request id关联设备影子查询请求和平台响应
+type shadowQueries struct {
+	lock     sync.Mutex
+	handlers map[string]DevicePropertyQueryResponseHandler
+}
+
+func (sq *shadowQueries) add(requestId string, handler DevicePropertyQueryResponseHandler) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	if sq.handlers == nil {
+		sq.handlers = map[string]DevicePropertyQueryResponseHandler{}
+	}
+	sq.handlers[requestId] = handler
+}
+
+func (sq *shadowQueries) remove(requestId string) DevicePropertyQueryResponseHandler {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	handler := sq.handlers[requestId]
+	delete(sq.handlers, requestId)
+	return handler
+}
+
+// 发送设备影子查询请求，平台响应后调用handler
+func (device *baseIotDevice) queryShadow(query DevicePropertyQueryRequest, handler DevicePropertyQueryResponseHandler) (string, error) {
+	requestId := uuid.NewV4().String()
+	device.shadowQueries.add(requestId, handler)
+
+	topic := formatTopic(DeviceShadowQueryRequestTopic, device.Id) + requestId
+	if token := device.Client.Publish(topic, device.qos, false, Interface2JsonString(query)); token.Wait() && token.Error() != nil {
+		device.shadowQueries.remove(requestId)
+		glog.Warningf("device %s query device shadow data failed,request id = %s", device.Id, requestId)
+		return requestId, token.Error()
+	}
+
+	return requestId, nil
+}
+
+// 查询设备影子并等待平台响应，ctx没有设置超时时间时使用默认超时时间
+func (device *baseIotDevice) getShadow(ctx context.Context, serviceId string) (DevicePropertyQueryResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultShadowQueryTimeout)
+		defer cancel()
+	}
+
+	responses := make(chan DevicePropertyQueryResponse, 1)
+	query := DevicePropertyQueryRequest{
+		ObjectDeviceId: device.Id,
+		ServiceId:      serviceId,
+	}
+	requestId, err := device.queryShadow(query, func(response DevicePropertyQueryResponse) {
+		responses <- response
+	})
+	if err != nil {
+		return DevicePropertyQueryResponse{}, err
+	}
+
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-ctx.Done():
+		device.shadowQueries.remove(requestId)
+		glog.Warningf("device %s query device shadow timeout,request id = %s", device.Id, requestId)
+		return DevicePropertyQueryResponse{}, &DeviceError{
+			errorMsg: "query device shadow failed: " + ctx.Err().Error(),
+		}
+	}
+}
+
+func (device *baseIotDevice) createPropertiesQueryResponseMqttHandler() func(client mqtt.Client, message mqtt.Message) {
+	propertiesQueryResponseHandler := func(client mqtt.Client, message mqtt.Message) {
+		propertiesQueryResponse := &DevicePropertyQueryResponse{}
+		if json.Unmarshal(message.Payload(), propertiesQueryResponse) != nil {
+			glog.Warningf("device %s unmarshal property response failed,message %s", device.Id, Interface2JsonString(message))
+			return
+		}
+
+		requestId := getTopicRequestId(message.Topic())
+		handler := device.shadowQueries.remove(requestId)
+		if handler == nil {
+			glog.Warningf("device %s receive unknown shadow response,request id = %s", device.Id, requestId)
+			return
+		}
+		handler(*propertiesQueryResponse)
+	}
+
+	return propertiesQueryResponseHandler
+}
+
+// 设备影子异步查询结果
+type DeviceShadowAsyncResult struct {
+	baseAsyncResult
+	response DevicePropertyQueryResponse
+}
+
+// 平台返回的设备影子数据，在Wait返回并且Error为nil时有效
+func (result *DeviceShadowAsyncResult) Result() DevicePropertyQueryResponse {
+	result.m.RLock()
+	defer result.m.RUnlock()
+	return result.response
+}
+
+func (result *DeviceShadowAsyncResult) completeSuccess(response DevicePropertyQueryResponse) {
+	result.m.Lock()
+	defer result.m.Unlock()
+	result.response = response
+	result.flowComplete()
+}
+
+func (result *DeviceShadowAsyncResult) completeError(err error) {
+	result.setError(err)
+}
+
+func NewDeviceShadowAsyncResult() *DeviceShadowAsyncResult {
+	return &DeviceShadowAsyncResult{
+		baseAsyncResult: baseAsyncResult{
+			complete: make(chan struct{}),
+		},
+	}
+}
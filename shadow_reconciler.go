@@ -0,0 +1,188 @@
+package iot
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 设备影子中期望值与上报值不一致的服务
+type ShadowDelta struct {
+	ServiceId string
+	Desired   map[string]interface{} // 期望值与上报值不一致的属性
+	Reported  map[string]interface{} // 设备当前上报的全部属性
+	Version   int                    // 设备影子版本
+}
+
+// 设备应用影子期望值，返回设备实际生效的属性值，SDK将返回的属性值上报平台
+type ShadowDeltaHandler func(delta ShadowDelta) (map[string]interface{}, bool)
+
+type ShadowReconcilerConfig struct {
+	ServiceIds []string      // 需要同步的服务，为空时同步设备影子中的全部服务
+	Interval   time.Duration // 周期同步的时间间隔，小于等于0时只在设备连接平台时同步
+	Timeout    time.Duration // 单次查询设备影子的超时时间，默认10秒
+}
+
+// 设备影子同步器，设备连接平台时以及周期性的获取设备影子，
+// 对比期望值和上报值，调用ShadowDeltaHandler应用差异并上报应用后的属性值
+type ShadowReconciler struct {
+	device  Device
+	handler ShadowDeltaHandler
+	config  ShadowReconcilerConfig
+
+	lock     sync.Mutex
+	versions map[string]int // 每个服务已经同步成功的影子版本
+	running  bool
+	stop     chan struct{}
+}
+
+func NewShadowReconciler(device Device, handler ShadowDeltaHandler, config ShadowReconcilerConfig) *ShadowReconciler {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultShadowQueryTimeout
+	}
+
+	reconciler := &ShadowReconciler{
+		device:   device,
+		handler:  handler,
+		config:   config,
+		versions: map[string]int{},
+	}
+	device.AddConnectHandler(func() {
+		if reconciler.isRunning() {
+			reconciler.Reconcile()
+		}
+	})
+
+	return reconciler
+}
+
+// 启动周期同步，设备已经连接时立即同步一次
+func (reconciler *ShadowReconciler) Start() {
+	reconciler.lock.Lock()
+	if reconciler.running {
+		reconciler.lock.Unlock()
+		return
+	}
+	reconciler.running = true
+	reconciler.stop = make(chan struct{})
+	stop := reconciler.stop
+	reconciler.lock.Unlock()
+
+	go func() {
+		if reconciler.device.IsConnected() {
+			reconciler.Reconcile()
+		}
+		if reconciler.config.Interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(reconciler.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reconciler.Reconcile()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (reconciler *ShadowReconciler) Stop() {
+	reconciler.lock.Lock()
+	defer reconciler.lock.Unlock()
+	if !reconciler.running {
+		return
+	}
+	reconciler.running = false
+	close(reconciler.stop)
+}
+
+func (reconciler *ShadowReconciler) isRunning() bool {
+	reconciler.lock.Lock()
+	defer reconciler.lock.Unlock()
+	return reconciler.running
+}
+
+// 执行一次同步，所有服务同步成功返回true
+func (reconciler *ShadowReconciler) Reconcile() bool {
+	serviceIds := reconciler.config.ServiceIds
+	if len(serviceIds) == 0 {
+		serviceIds = []string{""}
+	}
+
+	result := true
+	for _, serviceId := range serviceIds {
+		ctx, cancel := context.WithTimeout(context.Background(), reconciler.config.Timeout)
+		response, err := reconciler.device.GetShadow(ctx, serviceId)
+		cancel()
+		if err != nil {
+			glog.Warningf("reconcile device shadow failed,service id = %s,err = %v", serviceId, err)
+			result = false
+			continue
+		}
+
+		for _, shadow := range response.Shadow {
+			result = reconciler.reconcileService(shadow) && result
+		}
+	}
+
+	return result
+}
+
+func (reconciler *ShadowReconciler) reconcileService(shadow DeviceShadowData) bool {
+	reconciler.lock.Lock()
+	version, ok := reconciler.versions[shadow.ServiceId]
+	reconciler.lock.Unlock()
+	if ok && shadow.Version <= version {
+		// 已经同步过该版本或者是过期的影子数据
+		return true
+	}
+
+	desired := propertiesToMap(shadow.Desired.Properties)
+	reported := propertiesToMap(shadow.Reported.Properties)
+	delta := map[string]interface{}{}
+	for name, value := range desired {
+		if reportedValue, ok := reported[name]; !ok || !reflect.DeepEqual(value, reportedValue) {
+			delta[name] = value
+		}
+	}
+
+	if len(delta) > 0 {
+		applied, success := reconciler.handler(ShadowDelta{
+			ServiceId: shadow.ServiceId,
+			Desired:   delta,
+			Reported:  reported,
+			Version:   shadow.Version,
+		})
+		if !success {
+			glog.Warningf("apply device shadow failed,service id = %s,version = %d", shadow.ServiceId, shadow.Version)
+			return false
+		}
+
+		properties := DeviceProperties{
+			Services: []DevicePropertyEntry{
+				{
+					ServiceId:  shadow.ServiceId,
+					Properties: applied,
+					EventTime:  GetEventTimeStamp(),
+				},
+			},
+		}
+		// 不经过属性过滤上报，避免应用后的值落在死区内没有上报导致影子无法收敛
+		if !reconciler.device.ReportPropertiesUnfiltered(properties) {
+			return false
+		}
+	}
+
+	reconciler.lock.Lock()
+	if current, exist := reconciler.versions[shadow.ServiceId]; !exist || shadow.Version > current {
+		reconciler.versions[shadow.ServiceId] = shadow.Version
+	}
+	reconciler.lock.Unlock()
+
+	return true
+}
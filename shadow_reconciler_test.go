@@ -0,0 +1,179 @@
+package iot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 设备最后一次发布到topic的消息
+func lastPublished(t *testing.T, client *fakeClient, topic string, v interface{}) bool {
+	messages := client.messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].topic == topic {
+			if err := json.Unmarshal(messages[i].payload, v); err != nil {
+				t.Fatalf("unmarshal published message failed %v", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// 平台对设备影子查询返回固定的影子数据
+func respondShadow(device *iotDevice, client *fakeClient, shadow func() []DeviceShadowData) {
+	responseHandler := device.base.createPropertiesQueryResponseMqttHandler()
+	queryTopic := formatTopic(DeviceShadowQueryRequestTopic, device.base.Id)
+	client.onPublish = func(topic string, payload []byte) {
+		if !strings.HasPrefix(topic, queryTopic) {
+			return
+		}
+		response := DevicePropertyQueryResponse{
+			ObjectDeviceId: device.base.Id,
+			Shadow:         shadow(),
+		}
+		go responseHandler(client, fakeMessage{
+			topic:   "$oc/devices/" + device.base.Id + "/sys/shadow/get/response/request_id=" + strings.TrimPrefix(topic, queryTopic),
+			payload: []byte(Interface2JsonString(response)),
+		})
+	}
+}
+
+func TestShadowReconciler_Reconcile(t *testing.T) {
+	device, client := createFakeIotDevice()
+	version := 3
+	respondShadow(device, client, func() []DeviceShadowData {
+		return []DeviceShadowData{
+			{
+				ServiceId: "light",
+				Desired: DeviceShadowPropertiesData{
+					Properties: map[string]interface{}{"switch": "on", "level": 5},
+				},
+				Reported: DeviceShadowPropertiesData{
+					Properties: map[string]interface{}{"switch": "off", "level": 5},
+				},
+				Version: version,
+			},
+		}
+	})
+
+	var deltas []ShadowDelta
+	reconciler := NewShadowReconciler(device, func(delta ShadowDelta) (map[string]interface{}, bool) {
+		deltas = append(deltas, delta)
+		return delta.Desired, true
+	}, ShadowReconcilerConfig{})
+
+	if !reconciler.Reconcile() {
+		t.Fatalf("reconcile device shadow failed")
+	}
+	if len(deltas) != 1 || len(deltas[0].Desired) != 1 || deltas[0].Desired["switch"] != "on" {
+		t.Fatalf("delta must only contains switch but is %s", Interface2JsonString(deltas))
+	}
+
+	var reported *DeviceProperties
+	for _, message := range client.messages() {
+		if message.topic == formatTopic(PropertiesUpTopic, device.base.Id) {
+			reported = &DeviceProperties{}
+			if err := json.Unmarshal(message.payload, reported); err != nil {
+				t.Fatalf("unmarshal reported properties failed %v", err)
+			}
+		}
+	}
+	if reported == nil || reported.Services[0].ServiceId != "light" {
+		t.Fatalf("reconciler must report applied properties")
+	}
+
+	// 同一版本的影子数据不再处理
+	reconciler.Reconcile()
+	if len(deltas) != 1 {
+		t.Errorf("same shadow version must not apply again")
+	}
+
+	// 过期的影子数据不处理
+	version = 2
+	reconciler.Reconcile()
+	if len(deltas) != 1 {
+		t.Errorf("stale shadow version must not apply")
+	}
+
+	version = 4
+	reconciler.Reconcile()
+	if len(deltas) != 2 {
+		t.Errorf("new shadow version must apply")
+	}
+}
+
+func TestShadowReconciler_ApplyFailed(t *testing.T) {
+	device, client := createFakeIotDevice()
+	respondShadow(device, client, func() []DeviceShadowData {
+		return []DeviceShadowData{
+			{
+				ServiceId: "light",
+				Desired: DeviceShadowPropertiesData{
+					Properties: map[string]interface{}{"switch": "on"},
+				},
+				Version: 1,
+			},
+		}
+	})
+
+	calls := 0
+	reconciler := NewShadowReconciler(device, func(delta ShadowDelta) (map[string]interface{}, bool) {
+		calls++
+		return nil, false
+	}, ShadowReconcilerConfig{})
+
+	if reconciler.Reconcile() {
+		t.Errorf("reconcile must failed when apply failed")
+	}
+
+	// 应用失败的版本下次继续同步
+	reconciler.Reconcile()
+	if calls != 2 {
+		t.Errorf("failed shadow version must retry")
+	}
+}
+
+func TestShadowReconciler_IgnorePropertyFilter(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.SetPropertyFilter("light", "level", PropertyFilter{AbsoluteDeadband: 5})
+	device.ReportProperties(DeviceProperties{Services: []DevicePropertyEntry{
+		{ServiceId: "light", Properties: map[string]interface{}{"level": 10}},
+	}})
+	respondShadow(device, client, func() []DeviceShadowData {
+		return []DeviceShadowData{
+			{
+				ServiceId: "light",
+				Desired: DeviceShadowPropertiesData{
+					Properties: map[string]interface{}{"level": 12},
+				},
+				Reported: DeviceShadowPropertiesData{
+					Properties: map[string]interface{}{"level": 10},
+				},
+				Version: 1,
+			},
+		}
+	})
+
+	reconciler := NewShadowReconciler(device, func(delta ShadowDelta) (map[string]interface{}, bool) {
+		return delta.Desired, true
+	}, ShadowReconcilerConfig{})
+	if !reconciler.Reconcile() {
+		t.Fatalf("reconcile device shadow failed")
+	}
+
+	reported := DeviceProperties{}
+	if !lastPublished(t, client, formatTopic(PropertiesUpTopic, device.base.Id), &reported) ||
+		propertiesToMap(reported.Services[0].Properties)["level"] != float64(12) {
+		t.Errorf("applied value inside deadband must be reported %+v", reported)
+	}
+
+	// 上报值记录到过滤器中，后续的上报和该值比较
+	device.ReportProperties(DeviceProperties{Services: []DevicePropertyEntry{
+		{ServiceId: "light", Properties: map[string]interface{}{"level": 15}},
+	}})
+	last := DeviceProperties{}
+	if lastPublished(t, client, formatTopic(PropertiesUpTopic, device.base.Id), &last); propertiesToMap(last.Services[0].Properties)["level"] != float64(12) {
+		t.Errorf("property within deadband of applied value must be filtered")
+	}
+}
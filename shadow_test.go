@@ -0,0 +1,83 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBaseIotDevice_GetShadow(t *testing.T) {
+	device := createBaseIotDevice()
+	client := &fakeClient{}
+	device.Client = client
+	responseHandler := device.createPropertiesQueryResponseMqttHandler()
+
+	// 平台按照请求的request id返回对应服务的影子数据
+	client.onPublish = func(topic string, payload []byte) {
+		requestId := strings.TrimPrefix(topic, formatTopic(DeviceShadowQueryRequestTopic, device.Id))
+		query := &DevicePropertyQueryRequest{}
+		if err := json.Unmarshal(payload, query); err != nil {
+			t.Errorf("unmarshal shadow query failed %v", err)
+			return
+		}
+		response := DevicePropertyQueryResponse{
+			ObjectDeviceId: query.ObjectDeviceId,
+			Shadow: []DeviceShadowData{
+				{
+					ServiceId: query.ServiceId,
+				},
+			},
+		}
+		go responseHandler(client, fakeMessage{
+			topic:   "$oc/devices/" + device.Id + "/sys/shadow/get/response/request_id=" + requestId,
+			payload: []byte(Interface2JsonString(response)),
+		})
+	}
+
+	wg := sync.WaitGroup{}
+	for _, serviceId := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(serviceId string) {
+			defer wg.Done()
+			response, err := device.getShadow(context.Background(), serviceId)
+			if err != nil {
+				t.Errorf("get shadow failed %v", err)
+				return
+			}
+			if len(response.Shadow) != 1 || response.Shadow[0].ServiceId != serviceId {
+				t.Errorf("shadow response must be %s but is %s", serviceId, Interface2JsonString(response))
+			}
+		}(serviceId)
+	}
+	wg.Wait()
+}
+
+func TestBaseIotDevice_GetShadowTimeout(t *testing.T) {
+	device := createBaseIotDevice()
+	device.Client = &fakeClient{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := device.getShadow(ctx, "a"); err == nil {
+		t.Errorf("get shadow must failed when platform not response")
+	}
+
+	if len(device.shadowQueries.handlers) != 0 {
+		t.Errorf("timeout shadow query must be removed")
+	}
+}
+
+func TestBaseIotDevice_UnknownShadowResponse(t *testing.T) {
+	device := createBaseIotDevice()
+	client := &fakeClient{}
+	device.Client = client
+
+	// 没有对应请求的响应直接丢弃
+	device.createPropertiesQueryResponseMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.Id + "/sys/shadow/get/response/request_id=unknown",
+		payload: []byte(`{"shadow":[]}`),
+	})
+}
@@ -0,0 +1,328 @@
+package iot
+
+import (
+	"sync"
+	"time"
+)
+
+// 平台下发给子设备的消息、命令和属性请求的handler
+type SubDeviceHandlers interface {
+	// 注册平台下发给子设备的消息handler，支持注册多个handler
+	AddMessageHandler(handler MessageHandler)
+
+	// 注册平台下发给子设备的命令handler
+	AddCommandHandler(handler CommandHandler)
+
+	// 注册平台设置子设备属性handler，支持注册多个handler
+	AddPropertiesSetHandler(handler DevicePropertiesSetHandler)
+
+	// 设置平台查询子设备属性handler
+	SetPropertyQueryHandler(handler DevicePropertyQueryHandler)
+}
+
+// 网关子设备，通过网关的MQTT连接收发子设备的消息、属性和命令，
+// SDK自动填充object_device_id，平台下发给子设备的请求回调子设备注册的handler
+type SubDevice interface {
+	SubDeviceHandlers
+
+	// 子设备ID
+	DeviceId() string
+
+	// 子设备上报消息
+	SendMessage(message Message) bool
+
+	// 子设备上报属性，网关配置了SubDeviceBatchInterval时多个子设备的属性合并上报
+	ReportProperties(properties DeviceProperties) bool
+}
+
+type subDeviceHandlers struct {
+	lock                  sync.RWMutex
+	messageHandlers       []MessageHandler
+	commandHandler        CommandHandler
+	propertiesSetHandlers []DevicePropertiesSetHandler
+	propertyQueryHandler  DevicePropertyQueryHandler
+}
+
+func (handlers *subDeviceHandlers) AddMessageHandler(handler MessageHandler) {
+	if handler == nil {
+		return
+	}
+	handlers.lock.Lock()
+	defer handlers.lock.Unlock()
+	handlers.messageHandlers = append(handlers.messageHandlers, handler)
+}
+
+func (handlers *subDeviceHandlers) AddCommandHandler(handler CommandHandler) {
+	if handler == nil {
+		return
+	}
+	handlers.lock.Lock()
+	defer handlers.lock.Unlock()
+	handlers.commandHandler = handler
+}
+
+func (handlers *subDeviceHandlers) AddPropertiesSetHandler(handler DevicePropertiesSetHandler) {
+	if handler == nil {
+		return
+	}
+	handlers.lock.Lock()
+	defer handlers.lock.Unlock()
+	handlers.propertiesSetHandlers = append(handlers.propertiesSetHandlers, handler)
+}
+
+func (handlers *subDeviceHandlers) SetPropertyQueryHandler(handler DevicePropertyQueryHandler) {
+	handlers.lock.Lock()
+	defer handlers.lock.Unlock()
+	handlers.propertyQueryHandler = handler
+}
+
+func (handlers *subDeviceHandlers) getMessageHandlers() []MessageHandler {
+	if handlers == nil {
+		return nil
+	}
+	handlers.lock.RLock()
+	defer handlers.lock.RUnlock()
+	return handlers.messageHandlers
+}
+
+func (handlers *subDeviceHandlers) getCommandHandler() CommandHandler {
+	if handlers == nil {
+		return nil
+	}
+	handlers.lock.RLock()
+	defer handlers.lock.RUnlock()
+	return handlers.commandHandler
+}
+
+func (handlers *subDeviceHandlers) getPropertiesSetHandlers() []DevicePropertiesSetHandler {
+	if handlers == nil {
+		return nil
+	}
+	handlers.lock.RLock()
+	defer handlers.lock.RUnlock()
+	return handlers.propertiesSetHandlers
+}
+
+func (handlers *subDeviceHandlers) getPropertyQueryHandler() DevicePropertyQueryHandler {
+	if handlers == nil {
+		return nil
+	}
+	handlers.lock.RLock()
+	defer handlers.lock.RUnlock()
+	return handlers.propertyQueryHandler
+}
+
+type subDevice struct {
+	*subDeviceHandlers
+	id      string
+	gateway *baseIotDevice
+}
+
+func (device *subDevice) DeviceId() string {
+	return device.id
+}
+
+func (device *subDevice) SendMessage(message Message) bool {
+	message.ObjectDeviceId = device.id
+	return device.gateway.sendMessage(message) == nil
+}
+
+func (device *subDevice) ReportProperties(properties DeviceProperties) bool {
+	return device.gateway.subDeviceBatcher.report(device.gateway, DeviceService{
+		DeviceId: device.id,
+		Services: properties.Services,
+	}) == nil
+}
+
+// 根据object_device_id查找平台下发请求的handler，查找顺序为子设备、子设备所属产品、未知子设备的兜底handler，
+// 都没有注册handler时由网关自身的handler处理
+type subDeviceRouter struct {
+	lock       sync.RWMutex
+	devices    map[string]*subDevice
+	products   map[string]*subDeviceHandlers
+	productIds map[string]string // 子设备ID到产品ID的映射
+	fallback   subDeviceHandlers
+}
+
+func (router *subDeviceRouter) getOrCreate(gateway *baseIotDevice, deviceId string) *subDevice {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.devices == nil {
+		router.devices = map[string]*subDevice{}
+	}
+	device, ok := router.devices[deviceId]
+	if !ok {
+		device = &subDevice{
+			subDeviceHandlers: &subDeviceHandlers{},
+			id:                deviceId,
+			gateway:           gateway,
+		}
+		router.devices[deviceId] = device
+	}
+	return device
+}
+
+func (router *subDeviceRouter) get(deviceId string) *subDevice {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	return router.devices[deviceId]
+}
+
+func (router *subDeviceRouter) product(productId string) *subDeviceHandlers {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.products == nil {
+		router.products = map[string]*subDeviceHandlers{}
+	}
+	handlers, ok := router.products[productId]
+	if !ok {
+		handlers = &subDeviceHandlers{}
+		router.products[productId] = handlers
+	}
+	return handlers
+}
+
+// 记录子设备所属的产品
+func (router *subDeviceRouter) addDevices(devices []DeviceInfo) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if router.productIds == nil {
+		router.productIds = map[string]string{}
+	}
+	for _, device := range devices {
+		if len(device.ProductId) > 0 {
+			router.productIds[device.DeviceId] = device.ProductId
+		}
+	}
+}
+
+func (router *subDeviceRouter) removeDevices(devices []DeviceInfo) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	for _, device := range devices {
+		delete(router.productIds, device.DeviceId)
+	}
+}
+
+// 子设备请求的handler，依次为子设备、产品和兜底handler，每类请求使用第一个注册了该类handler的候选
+func (router *subDeviceRouter) route(deviceId string) []*subDeviceHandlers {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	var handlers []*subDeviceHandlers
+	if device, ok := router.devices[deviceId]; ok {
+		handlers = append(handlers, device.subDeviceHandlers)
+	}
+	if productId, ok := router.productIds[deviceId]; ok {
+		if product, ok := router.products[productId]; ok {
+			handlers = append(handlers, product)
+		}
+	}
+	return append(handlers, &router.fallback)
+}
+
+// 合并多个子设备的属性上报请求，在interval时间内的请求合并为一次批量上报
+type subDeviceBatcher struct {
+	interval time.Duration
+
+	lock    sync.Mutex
+	pending []DeviceService
+	waiters []chan error
+}
+
+func (batcher *subDeviceBatcher) report(gateway *baseIotDevice, service DeviceService) error {
+	if batcher.interval <= 0 {
+		_, err := gateway.batchReportSubDevicesProperties(DevicesService{Devices: []DeviceService{service}})
+		return err
+	}
+
+	result := make(chan error, 1)
+	batcher.lock.Lock()
+	if len(batcher.pending) == 0 {
+		time.AfterFunc(batcher.interval, func() {
+			batcher.flushPending(gateway)
+		})
+	}
+	batcher.pending = append(batcher.pending, service)
+	batcher.waiters = append(batcher.waiters, result)
+	batcher.lock.Unlock()
+
+	return <-result
+}
+
+func (batcher *subDeviceBatcher) flushPending(gateway *baseIotDevice) {
+	batcher.lock.Lock()
+	pending, waiters := batcher.pending, batcher.waiters
+	batcher.pending, batcher.waiters = nil, nil
+	batcher.lock.Unlock()
+
+	// 每个子设备得到所在批次的上报结果
+	results, _ := gateway.batchReportSubDevicesProperties(DevicesService{Devices: pending})
+	errs := map[string]error{}
+	for _, result := range results {
+		for _, deviceId := range result.DeviceIds {
+			errs[deviceId] = result.Err
+		}
+	}
+	for i, waiter := range waiters {
+		waiter <- errs[pending[i].DeviceId]
+	}
+}
+
+// 获取子设备，不存在时创建
+func (device *baseIotDevice) subDevice(deviceId string) SubDevice {
+	return device.subDeviceRouter.getOrCreate(device, deviceId)
+}
+
+// 获取子设备产品的handler，产品下没有单独注册handler的子设备使用产品的handler
+func (device *baseIotDevice) subDeviceProduct(productId string) SubDeviceHandlers {
+	return device.subDeviceRouter.product(productId)
+}
+
+// 获取未知子设备的兜底handler，子设备和产品都没有注册同类handler的请求使用兜底handler
+func (device *baseIotDevice) subDeviceFallback() SubDeviceHandlers {
+	return &device.subDeviceRouter.fallback
+}
+
+// 平台下发请求的handler候选，请求发给网关自身时返回nil
+func (device *baseIotDevice) routeSubDevice(objectDeviceId string) []*subDeviceHandlers {
+	if len(objectDeviceId) == 0 || objectDeviceId == device.Id {
+		return nil
+	}
+	return device.subDeviceRouter.route(objectDeviceId)
+}
+
+func (device *baseIotDevice) getMessageHandlers(message Message) []MessageHandler {
+	for _, handlers := range device.routeSubDevice(message.ObjectDeviceId) {
+		if messageHandlers := handlers.getMessageHandlers(); len(messageHandlers) > 0 {
+			return messageHandlers
+		}
+	}
+	return device.messageHandlers
+}
+
+func (device *baseIotDevice) getCommandHandler(command Command) CommandHandler {
+	for _, handlers := range device.routeSubDevice(command.ObjectDeviceId) {
+		if handler := handlers.getCommandHandler(); handler != nil {
+			return handler
+		}
+	}
+	return device.commandHandler
+}
+
+func (device *baseIotDevice) getPropertiesSetHandlers(request DevicePropertyDownRequest) []DevicePropertiesSetHandler {
+	for _, handlers := range device.routeSubDevice(request.ObjectDeviceId) {
+		if setHandlers := handlers.getPropertiesSetHandlers(); len(setHandlers) > 0 {
+			return setHandlers
+		}
+	}
+	return device.propertiesSetHandlers
+}
+
+func (device *baseIotDevice) getPropertyQueryHandler(query DevicePropertyQueryRequest) DevicePropertyQueryHandler {
+	for _, handlers := range device.routeSubDevice(query.ObjectDeviceId) {
+		if handler := handlers.getPropertyQueryHandler(); handler != nil {
+			return handler
+		}
+	}
+	return device.propertyQueryHandler
+}
@@ -0,0 +1,188 @@
+package iot
+
+import (
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SubDeviceStatusOnline  = "ONLINE"
+	SubDeviceStatusOffline = "OFFLINE"
+)
+
+const (
+	defaultLivenessOfflineTimeout = 5 * time.Minute
+	defaultLivenessCheckInterval  = 10 * time.Second
+	defaultLivenessDebounce       = 10 * time.Second
+)
+
+type LivenessConfig struct {
+	OfflineTimeout time.Duration // 子设备超过该时间没有活动时标记为离线，默认5分钟
+	CheckInterval  time.Duration // 检查子设备状态的间隔，默认10秒
+	Debounce       time.Duration // 状态变化持续该时间后才上报，避免状态抖动，默认10秒，小于0时不去抖
+}
+
+type livenessState struct {
+	lastSeen     time.Time
+	reported     string // 已经上报给平台的状态
+	pending      string // 等待去抖的状态
+	pendingSince time.Time
+}
+
+// 子设备在线状态跟踪器，根据子设备最近一次活动时间判断子设备在线或者离线，
+// 状态变化经过去抖后通过网关批量上报子设备状态
+type SubDeviceLivenessTracker struct {
+	device Device
+	config LivenessConfig
+	now    func() time.Time
+
+	lock    sync.Mutex
+	states  map[string]*livenessState
+	running bool
+	stop    chan struct{}
+}
+
+// 创建子设备在线状态跟踪器，网关上报子设备属性或者消息时自动记录子设备活动
+func NewSubDeviceLivenessTracker(device Device, config LivenessConfig) *SubDeviceLivenessTracker {
+	if config.OfflineTimeout <= 0 {
+		config.OfflineTimeout = defaultLivenessOfflineTimeout
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultLivenessCheckInterval
+	}
+	if config.Debounce < 0 {
+		config.Debounce = 0
+	} else if config.Debounce == 0 {
+		config.Debounce = defaultLivenessDebounce
+	}
+
+	tracker := &SubDeviceLivenessTracker{
+		device: device,
+		config: config,
+		now:    time.Now,
+		states: map[string]*livenessState{},
+	}
+	device.AddSubDeviceActivityHandler(tracker.Heartbeat)
+	return tracker
+}
+
+// 记录子设备活动，子设备没有上行数据时可以定期调用作为心跳
+func (tracker *SubDeviceLivenessTracker) Heartbeat(deviceId string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	state, ok := tracker.states[deviceId]
+	if !ok {
+		state = &livenessState{}
+		tracker.states[deviceId] = state
+	}
+	state.lastSeen = tracker.now()
+}
+
+// 停止跟踪子设备，子设备删除后调用
+func (tracker *SubDeviceLivenessTracker) Remove(deviceId string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	delete(tracker.states, deviceId)
+}
+
+// 子设备已经上报给平台的状态，没有上报过时返回空字符串
+func (tracker *SubDeviceLivenessTracker) Status(deviceId string) string {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if state, ok := tracker.states[deviceId]; ok {
+		return state.reported
+	}
+	return ""
+}
+
+// 按照CheckInterval间隔检查并上报子设备状态
+func (tracker *SubDeviceLivenessTracker) Start() {
+	tracker.lock.Lock()
+	if tracker.running {
+		tracker.lock.Unlock()
+		return
+	}
+	tracker.running = true
+	tracker.stop = make(chan struct{})
+	stop := tracker.stop
+	tracker.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(tracker.config.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tracker.check()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (tracker *SubDeviceLivenessTracker) Stop() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if !tracker.running {
+		return
+	}
+	tracker.running = false
+	close(tracker.stop)
+}
+
+// 检查子设备状态，上报去抖后的状态变化，上报失败时下次检查重新上报
+func (tracker *SubDeviceLivenessTracker) check() {
+	statuses := tracker.transitions()
+	if len(statuses) == 0 {
+		return
+	}
+
+	if !tracker.device.UpdateSubDeviceState(SubDevicesStatus{DeviceStatuses: statuses}) {
+		glog.Warningf("update %d sub devices status failed", len(statuses))
+		return
+	}
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for _, status := range statuses {
+		if state, ok := tracker.states[status.DeviceId]; ok && state.pending == status.Status {
+			state.reported = status.Status
+			state.pending = ""
+		}
+	}
+}
+
+// 计算需要上报的状态变化，按照设备ID排序
+func (tracker *SubDeviceLivenessTracker) transitions() []DeviceStatus {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	now := tracker.now()
+	var statuses []DeviceStatus
+	for deviceId, state := range tracker.states {
+		status := SubDeviceStatusOnline
+		if now.Sub(state.lastSeen) >= tracker.config.OfflineTimeout {
+			status = SubDeviceStatusOffline
+		}
+
+		if status == state.reported {
+			state.pending = ""
+			continue
+		}
+		if status != state.pending {
+			state.pending = status
+			state.pendingSince = now
+		}
+		if now.Sub(state.pendingSince) >= tracker.config.Debounce {
+			statuses = append(statuses, DeviceStatus{DeviceId: deviceId, Status: status})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DeviceId < statuses[j].DeviceId
+	})
+	return statuses
+}
@@ -0,0 +1,126 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func publishedStatuses(t *testing.T, client *fakeClient) []DeviceStatus {
+	var statuses []DeviceStatus
+	for _, message := range client.messages() {
+		data := &struct {
+			Services []struct {
+				EventType string           `json:"event_type"`
+				Paras     SubDevicesStatus `json:"paras"`
+			} `json:"services"`
+		}{}
+		if err := json.Unmarshal(message.payload, data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Services) > 0 && data.Services[0].EventType == "sub_device_update_status" {
+			statuses = append(statuses, data.Services[0].Paras.DeviceStatuses...)
+		}
+	}
+	return statuses
+}
+
+func TestSubDeviceLivenessTracker_Transitions(t *testing.T) {
+	device, client := createFakeIotDevice()
+	now := time.Unix(1600000000, 0)
+	tracker := NewSubDeviceLivenessTracker(device, LivenessConfig{
+		OfflineTimeout: time.Minute,
+		Debounce:       10 * time.Second,
+	})
+	tracker.now = func() time.Time {
+		return now
+	}
+
+	// 子设备上报属性自动记录活动
+	device.SubDevice("sub-1").ReportProperties(DeviceProperties{
+		Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+	})
+	tracker.Heartbeat("sub-2")
+	tracker.check()
+	if len(publishedStatuses(t, client)) != 0 {
+		t.Fatalf("status must not be reported before debounce")
+	}
+
+	now = now.Add(10 * time.Second)
+	tracker.check()
+	statuses := publishedStatuses(t, client)
+	if len(statuses) != 2 || statuses[0].Status != SubDeviceStatusOnline || statuses[1].DeviceId != "sub-2" {
+		t.Fatalf("sub devices must be online,statuses = %s", Interface2JsonString(statuses))
+	}
+
+	// sub-2离线后短暂恢复，去抖期间不上报
+	tracker.Heartbeat("sub-1")
+	now = now.Add(time.Minute)
+	tracker.Heartbeat("sub-1")
+	tracker.check()
+	tracker.Heartbeat("sub-2")
+	tracker.check()
+	now = now.Add(10 * time.Second)
+	tracker.Heartbeat("sub-1")
+	tracker.check()
+	if statuses = publishedStatuses(t, client); len(statuses) != 2 {
+		t.Fatalf("flapping status must not be reported,statuses = %s", Interface2JsonString(statuses))
+	}
+
+	now = now.Add(time.Minute)
+	tracker.Heartbeat("sub-1")
+	tracker.check()
+	now = now.Add(10 * time.Second)
+	tracker.Heartbeat("sub-1")
+	tracker.check()
+	statuses = publishedStatuses(t, client)
+	if len(statuses) != 3 || statuses[2].DeviceId != "sub-2" || statuses[2].Status != SubDeviceStatusOffline {
+		t.Fatalf("sub-2 must be offline,statuses = %s", Interface2JsonString(statuses))
+	}
+	if tracker.Status("sub-2") != SubDeviceStatusOffline || tracker.Status("sub-1") != SubDeviceStatusOnline {
+		t.Errorf("tracker status is wrong")
+	}
+}
+
+func TestSubDeviceLivenessTracker_Batch(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.batchSubDeviceSize = 2
+	tracker := NewSubDeviceLivenessTracker(device, LivenessConfig{Debounce: -1})
+
+	for _, id := range []string{"sub-1", "sub-2", "sub-3"} {
+		tracker.Heartbeat(id)
+	}
+	tracker.check()
+
+	if len(client.messages()) != 2 || len(publishedStatuses(t, client)) != 3 {
+		t.Errorf("status must be reported in batches of batchSubDeviceSize")
+	}
+}
+
+func TestBatchReportSubDevicesProperties_ActivityAfterSuccess(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.SetPropertyFilter("sensor", "value", PropertyFilter{ChangeOnly: true})
+	properties := func(deviceId string, value int) DeviceService {
+		return DeviceService{
+			DeviceId: deviceId,
+			Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": value}}},
+		}
+	}
+	device.BatchReportSubDevicesProperties(DevicesService{Devices: []DeviceService{properties("sub-1", 1)}})
+
+	var active []string
+	device.AddSubDeviceActivityHandler(func(deviceId string) {
+		active = append(active, deviceId)
+	})
+	client.lock.Lock()
+	client.publishErr = func(topic string, payload []byte) error {
+		return &DeviceError{errorMsg: "connection lost"}
+	}
+	client.lock.Unlock()
+
+	// sub-1的属性没有变化被过滤，sub-2上报失败
+	device.BatchReportSubDevicesProperties(DevicesService{Devices: []DeviceService{properties("sub-1", 1), properties("sub-2", 1)}})
+	if len(active) != 1 || active[0] != "sub-1" {
+		t.Errorf("only filtered or reported sub devices are active,active = %v", active)
+	}
+}
@@ -0,0 +1,267 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+// 等待平台响应子设备管理请求的默认超时时间，当context没有设置超时时间时使用
+const defaultSubDeviceRequestTimeout = 10 * time.Second
+
+// 子设备管理请求对应的平台响应事件
+var subDeviceResponseEvents = map[string]string{
+	"add_sub_device_request":    "add_sub_device_response",
+	"delete_sub_device_request": "delete_sub_device_response",
+	"sub_device_update_status":  "sub_device_update_status_response",
+	"sub_device_sync_request":   "sub_device_sync_response",
+}
+
+// 平台处理失败的子设备
+type SubDeviceFailure struct {
+	DeviceId  string `json:"device_id,omitempty"`
+	NodeId    string `json:"node_id,omitempty"`
+	ProductId string `json:"product_id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	ErrorCode string `json:"error_code"`
+	ErrorMsg  string `json:"error_msg"`
+}
+
+// 平台对子设备新增、删除、状态更新和同步请求的处理结果，
+// 同步子设备列表时SuccessfulDevices为平台返回的子设备，Version为子设备列表版本号
+type SubDeviceResult struct {
+	SuccessfulDevices []DeviceInfo       `json:"successful_devices"`
+	FailedDevices     []SubDeviceFailure `json:"failed_devices"`
+	Version           int                `json:"version,omitempty"`
+}
+
+// 删除子设备响应中成功的设备只有设备ID，其他响应为设备信息
+func (result *SubDeviceResult) UnmarshalJSON(data []byte) error {
+	response := struct {
+		SuccessfulDevices []json.RawMessage  `json:"successful_devices"`
+		FailedDevices     []SubDeviceFailure `json:"failed_devices"`
+		Devices           []DeviceInfo       `json:"devices"`
+		Version           int                `json:"version"`
+	}{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return err
+	}
+
+	result.SuccessfulDevices = response.Devices
+	for _, raw := range response.SuccessfulDevices {
+		device := DeviceInfo{}
+		if err := json.Unmarshal(raw, &device.DeviceId); err != nil {
+			if err := json.Unmarshal(raw, &device); err != nil {
+				return err
+			}
+		}
+		result.SuccessfulDevices = append(result.SuccessfulDevices, device)
+	}
+	result.FailedDevices = response.FailedDevices
+	result.Version = response.Version
+	return nil
+}
+
+func (result *SubDeviceResult) merge(other SubDeviceResult) {
+	result.SuccessfulDevices = append(result.SuccessfulDevices, other.SuccessfulDevices...)
+	result.FailedDevices = append(result.FailedDevices, other.FailedDevices...)
+	if other.Version > result.Version {
+		result.Version = other.Version
+	}
+}
+
+type subDeviceRequest struct {
+	eventId   string
+	eventType string // 平台响应的事件类型
+	response  chan SubDeviceResult
+}
+
+// 按照event_id关联子设备管理请求和平台响应，平台响应没有携带event_id时按照请求顺序关联
+type subDeviceRequests struct {
+	lock     sync.Mutex
+	requests []*subDeviceRequest
+}
+
+func (sdr *subDeviceRequests) add(request *subDeviceRequest) {
+	sdr.lock.Lock()
+	defer sdr.lock.Unlock()
+	sdr.requests = append(sdr.requests, request)
+}
+
+func (sdr *subDeviceRequests) remove(eventId, eventType string) *subDeviceRequest {
+	sdr.lock.Lock()
+	defer sdr.lock.Unlock()
+	for i, request := range sdr.requests {
+		if request.eventId == eventId || (len(eventId) == 0 && request.eventType == eventType) {
+			sdr.requests = append(sdr.requests[:i], sdr.requests[i+1:]...)
+			return request
+		}
+	}
+	return nil
+}
+
+// 发送子设备管理请求并等待平台响应，ctx没有设置超时时间时使用默认超时时间
+func (device *baseIotDevice) requestSubDevices(ctx context.Context, eventType string, paras interface{}) (SubDeviceResult, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultSubDeviceRequestTimeout)
+		defer cancel()
+	}
+
+	request := &subDeviceRequest{
+		eventId:   uuid.NewV4().String(),
+		eventType: subDeviceResponseEvents[eventType],
+		response:  make(chan SubDeviceResult, 1),
+	}
+	device.subDeviceRequests.add(request)
+
+	data := Data{
+		ObjectDeviceId: device.Id,
+		Services: []DataEntry{
+			{
+				ServiceId: "$sub_device_manager",
+				EventType: eventType,
+				EventTime: GetEventTimeStamp(),
+				EventId:   request.eventId,
+				Paras:     paras,
+			},
+		},
+	}
+	if token := device.Client.Publish(formatTopic(DeviceToPlatformTopic, device.Id), device.qos, false, Interface2JsonString(data)); token.Wait() && token.Error() != nil {
+		device.subDeviceRequests.remove(request.eventId, request.eventType)
+		glog.Warningf("gateway %s send %s failed", device.Id, eventType)
+		return SubDeviceResult{}, token.Error()
+	}
+
+	select {
+	case result := <-request.response:
+		return result, nil
+	case <-ctx.Done():
+		device.subDeviceRequests.remove(request.eventId, request.eventType)
+		glog.Warningf("gateway %s wait %s timeout,event id = %s", device.Id, request.eventType, request.eventId)
+		return SubDeviceResult{}, &DeviceError{
+			errorMsg: "wait " + request.eventType + " failed: " + ctx.Err().Error(),
+		}
+	}
+}
+
+// 处理平台对子设备管理请求的响应，更新本地子设备列表并通知等待响应的请求
+func (device *baseIotDevice) handleSubDeviceResponse(entry DataEntry) {
+	result := SubDeviceResult{}
+	if json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), &result) != nil {
+		glog.Warningf("gateway %s unmarshal %s failed", device.Id, entry.EventType)
+		return
+	}
+
+	switch entry.EventType {
+	case "add_sub_device_response":
+		device.subDeviceRouter.addDevices(result.SuccessfulDevices)
+		if device.subDeviceRegistry != nil {
+			device.subDeviceRegistry.add(SubDeviceInfo{Devices: result.SuccessfulDevices})
+		}
+	case "delete_sub_device_response":
+		device.subDeviceRouter.removeDevices(result.SuccessfulDevices)
+		if device.subDeviceRegistry != nil {
+			device.subDeviceRegistry.remove(SubDeviceInfo{Devices: result.SuccessfulDevices})
+		}
+	}
+
+	request := device.subDeviceRequests.remove(entry.EventId, entry.EventType)
+	if request == nil {
+		glog.Infof("gateway %s receive %s without waiting request,event id = %s", device.Id, entry.EventType, entry.EventId)
+		return
+	}
+	request.response <- result
+}
+
+func (device *baseIotDevice) addSubDevices(ctx context.Context, deviceInfos []DeviceInfo) (SubDeviceResult, error) {
+	return device.requestSubDevices(ctx, "add_sub_device_request", struct {
+		Devices []DeviceInfo `json:"devices"`
+	}{
+		Devices: deviceInfos,
+	})
+}
+
+func (device *baseIotDevice) deleteSubDevices(ctx context.Context, deviceIds []string) (SubDeviceResult, error) {
+	return device.requestSubDevices(ctx, "delete_sub_device_request", struct {
+		Devices []string `json:"devices"`
+	}{
+		Devices: deviceIds,
+	})
+}
+
+// 网关更新子设备状态并等待平台响应，每批最多更新batchSubDeviceSize个子设备，返回全部批次的结果
+func (device *baseIotDevice) updateSubDeviceStateWithResult(ctx context.Context, subDevicesStatus SubDevicesStatus) (SubDeviceResult, error) {
+	result := SubDeviceResult{}
+	statuses := subDevicesStatus.DeviceStatuses
+	batchSize := device.subDeviceBatchSize()
+	for begin := 0; begin < len(statuses); begin += batchSize {
+		end := begin + batchSize
+		if end > len(statuses) {
+			end = len(statuses)
+		}
+
+		batchResult, err := device.requestSubDevices(ctx, "sub_device_update_status", SubDevicesStatus{
+			DeviceStatuses: statuses[begin:end],
+		})
+		if err != nil {
+			return result, err
+		}
+		result.merge(batchResult)
+
+		if device.subDeviceRegistry != nil {
+			var succeeded []DeviceStatus
+			for _, info := range batchResult.SuccessfulDevices {
+				succeeded = append(succeeded, DeviceStatus{DeviceId: info.DeviceId, Status: info.Status})
+			}
+			if err := device.subDeviceRegistry.updateStatus(succeeded); err != nil {
+				glog.Errorf("gateway %s save sub devices status failed %v", device.Id, err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (device *baseIotDevice) syncSubDevicesWithResult(ctx context.Context, version int) (SubDeviceResult, error) {
+	return device.requestSubDevices(ctx, "sub_device_sync_request", struct {
+		Version int `json:"version"`
+	}{
+		Version: version,
+	})
+}
+
+// 子设备管理请求的异步结果
+type SubDeviceAsyncResult struct {
+	baseAsyncResult
+	result SubDeviceResult
+}
+
+// 平台返回的处理结果，在Wait返回并且Error为nil时有效
+func (result *SubDeviceAsyncResult) Result() SubDeviceResult {
+	result.m.RLock()
+	defer result.m.RUnlock()
+	return result.result
+}
+
+func (result *SubDeviceAsyncResult) completeSuccess(subDeviceResult SubDeviceResult) {
+	result.m.Lock()
+	defer result.m.Unlock()
+	result.result = subDeviceResult
+	result.flowComplete()
+}
+
+func (result *SubDeviceAsyncResult) completeError(err error) {
+	result.setError(err)
+}
+
+func NewSubDeviceAsyncResult() *SubDeviceAsyncResult {
+	return &SubDeviceAsyncResult{
+		baseAsyncResult: baseAsyncResult{
+			complete: make(chan struct{}),
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// 模拟平台响应网关的子设备管理请求
+func respondSubDeviceRequest(device *iotDevice, client *fakeClient, respond func(entry DataEntry) (string, interface{})) {
+	handler := device.base.handlePlatformToDeviceData()
+	client.onPublish = func(topic string, payload []byte) {
+		request := Data{}
+		if json.Unmarshal(payload, &request) != nil || len(request.Services) == 0 {
+			return
+		}
+		eventType, paras := respond(request.Services[0])
+		response := Data{
+			Services: []DataEntry{
+				{
+					ServiceId: "$sub_device_manager",
+					EventType: eventType,
+					EventTime: GetEventTimeStamp(),
+					EventId:   request.Services[0].EventId,
+					Paras:     paras,
+				},
+			},
+		}
+		go handler(client, fakeMessage{
+			topic:   formatTopic(PlatformEventToDeviceTopic, device.base.Id),
+			payload: []byte(Interface2JsonString(response)),
+		})
+	}
+}
+
+func TestGateway_AddSubDevicesWithResult(t *testing.T) {
+	device, client := createFakeIotDevice()
+	registry, _ := NewSubDeviceRegistry("")
+	device.SetSubDeviceRegistry(registry)
+
+	respondSubDeviceRequest(device, client, func(entry DataEntry) (string, interface{}) {
+		if entry.EventType != "add_sub_device_request" || len(entry.EventId) == 0 {
+			t.Errorf("add sub devices request is wrong %s", Interface2JsonString(entry))
+		}
+		return "add_sub_device_response", map[string]interface{}{
+			"successful_devices": []DeviceInfo{{DeviceId: "sub-1", NodeId: "1", ProductId: "meter"}},
+			"failed_devices": []SubDeviceFailure{
+				{NodeId: "2", ProductId: "meter", ErrorCode: "IOTDA.014016", ErrorMsg: "node id exists"},
+			},
+		}
+	})
+
+	result, err := device.AddSubDevicesWithResult(context.Background(), []DeviceInfo{
+		{NodeId: "1", ProductId: "meter"},
+		{NodeId: "2", ProductId: "meter"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.SuccessfulDevices) != 1 || result.SuccessfulDevices[0].DeviceId != "sub-1" {
+		t.Errorf("successful devices are wrong %s", Interface2JsonString(result))
+	}
+	if len(result.FailedDevices) != 1 || result.FailedDevices[0].ErrorCode != "IOTDA.014016" {
+		t.Errorf("failed devices are wrong %s", Interface2JsonString(result))
+	}
+	if _, ok := registry.Get("sub-1"); !ok {
+		t.Errorf("added sub device must saved in registry")
+	}
+}
+
+func TestGateway_DeleteSubDevicesWithResult(t *testing.T) {
+	device, client := createFakeIotDevice()
+
+	respondSubDeviceRequest(device, client, func(entry DataEntry) (string, interface{}) {
+		return "delete_sub_device_response", map[string]interface{}{
+			"successful_devices": []string{"sub-1"},
+			"failed_devices":     []SubDeviceFailure{{DeviceId: "sub-2", ErrorCode: "IOTDA.014000", ErrorMsg: "not found"}},
+		}
+	})
+
+	result, err := device.DeleteSubDevicesWithResult(context.Background(), []string{"sub-1", "sub-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.SuccessfulDevices) != 1 || result.SuccessfulDevices[0].DeviceId != "sub-1" {
+		t.Errorf("successful devices are wrong %s", Interface2JsonString(result))
+	}
+	if len(result.FailedDevices) != 1 || result.FailedDevices[0].DeviceId != "sub-2" {
+		t.Errorf("failed devices are wrong %s", Interface2JsonString(result))
+	}
+	if len(device.base.subDeviceRequests.requests) != 0 {
+		t.Errorf("completed request must be removed")
+	}
+}
+
+func TestGateway_UpdateSubDeviceStateWithResultBatches(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.batchSubDeviceSize = 2
+
+	respondSubDeviceRequest(device, client, func(entry DataEntry) (string, interface{}) {
+		statuses := SubDevicesStatus{}
+		json.Unmarshal([]byte(Interface2JsonString(entry.Paras)), &statuses)
+		return "sub_device_update_status_response", map[string]interface{}{
+			"successful_devices": statuses.DeviceStatuses[:1],
+			"failed_devices": []SubDeviceFailure{
+				{DeviceId: statuses.DeviceStatuses[len(statuses.DeviceStatuses)-1].DeviceId, ErrorCode: "IOTDA.000000"},
+			},
+		}
+	})
+
+	result, err := device.UpdateSubDeviceStateWithResult(context.Background(), SubDevicesStatus{
+		DeviceStatuses: []DeviceStatus{
+			{DeviceId: "sub-1", Status: "ONLINE"},
+			{DeviceId: "sub-2", Status: "ONLINE"},
+			{DeviceId: "sub-3", Status: "OFFLINE"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.messages()) != 2 {
+		t.Errorf("status must be updated in 2 batches")
+	}
+	if len(result.SuccessfulDevices) != 2 || result.SuccessfulDevices[1].Status != "OFFLINE" {
+		t.Errorf("successful devices are wrong %s", Interface2JsonString(result))
+	}
+	if len(result.FailedDevices) != 2 {
+		t.Errorf("failed devices are wrong %s", Interface2JsonString(result))
+	}
+}
+
+func TestGateway_SyncSubDevicesWithResultTimeout(t *testing.T) {
+	device, _ := createFakeIotDevice()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := device.SyncSubDevicesWithResult(ctx, 1); err == nil {
+		t.Errorf("sync sub devices must fail when platform not response")
+	}
+	if len(device.base.subDeviceRequests.requests) != 0 {
+		t.Errorf("timeout request must be removed")
+	}
+}
+
+func TestAsyncGateway_SyncSubDevicesWithResult(t *testing.T) {
+	device, client := createFakeIotDevice()
+	async := &asyncDevice{base: device.base}
+
+	respondSubDeviceRequest(device, client, func(entry DataEntry) (string, interface{}) {
+		return "sub_device_sync_response", SubDeviceInfo{
+			Devices: []DeviceInfo{{DeviceId: "sub-1"}, {DeviceId: "sub-2"}},
+			Version: 9,
+		}
+	})
+
+	result := async.SyncSubDevicesWithResult(context.Background(), 0)
+	if !result.WaitTimeout(time.Second) || result.Error() != nil {
+		t.Fatalf("sync sub devices failed %v", result.Error())
+	}
+	if len(result.Result().SuccessfulDevices) != 2 || result.Result().Version != 9 {
+		t.Errorf("sync result is wrong %s", Interface2JsonString(result.Result()))
+	}
+}
@@ -0,0 +1,190 @@
+package iot
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 网关本地保存的子设备列表，根据平台的子设备新增、删除通知以及同步响应自动更新，
+// 设备连接平台后使用本地版本号同步子设备列表
+type SubDeviceRegistry struct {
+	path string
+
+	lock    sync.RWMutex
+	version int
+	devices map[string]DeviceInfo
+}
+
+// 持久化到文件的子设备列表
+type subDeviceRegistryData struct {
+	Version int          `json:"version"`
+	Devices []DeviceInfo `json:"devices"`
+}
+
+// 创建子设备列表并从文件加载已经保存的子设备，path为空时不持久化
+func NewSubDeviceRegistry(path string) (*SubDeviceRegistry, error) {
+	registry := &SubDeviceRegistry{
+		path:    path,
+		devices: map[string]DeviceInfo{},
+	}
+	if len(path) == 0 {
+		return registry, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := &subDeviceRegistryData{}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, err
+	}
+	registry.version = data.Version
+	for _, device := range data.Devices {
+		registry.devices[device.DeviceId] = device
+	}
+
+	return registry, nil
+}
+
+// 本地子设备列表的版本号
+func (registry *SubDeviceRegistry) Version() int {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return registry.version
+}
+
+func (registry *SubDeviceRegistry) Get(deviceId string) (DeviceInfo, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	device, ok := registry.devices[deviceId]
+	return device, ok
+}
+
+// 根据节点ID查找子设备，节点ID在网关下唯一
+func (registry *SubDeviceRegistry) FindByNodeId(nodeId string) (DeviceInfo, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	for _, device := range registry.devices {
+		if device.NodeId == nodeId {
+			return device, true
+		}
+	}
+	return DeviceInfo{}, false
+}
+
+// 返回按照设备ID排序的全部子设备
+func (registry *SubDeviceRegistry) List() []DeviceInfo {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	return registry.list()
+}
+
+func (registry *SubDeviceRegistry) list() []DeviceInfo {
+	devices := make([]DeviceInfo, 0, len(registry.devices))
+	for _, device := range registry.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceId < devices[j].DeviceId
+	})
+	return devices
+}
+
+// 新增或者更新子设备
+func (registry *SubDeviceRegistry) add(info SubDeviceInfo) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, device := range info.Devices {
+		if old, ok := registry.devices[device.DeviceId]; ok && len(device.Status) == 0 {
+			device.Status = old.Status
+		}
+		registry.devices[device.DeviceId] = device
+	}
+	registry.updateVersion(info.Version)
+	return registry.save()
+}
+
+func (registry *SubDeviceRegistry) remove(info SubDeviceInfo) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, device := range info.Devices {
+		delete(registry.devices, device.DeviceId)
+	}
+	registry.updateVersion(info.Version)
+	return registry.save()
+}
+
+// 使用平台同步响应返回的子设备列表更新本地列表，返回本地存在但平台已经删除的子设备。
+// 平台的版本号比本地新时以返回的列表为准，否则平台没有新的变化，只合并返回的子设备
+func (registry *SubDeviceRegistry) sync(info SubDeviceInfo) ([]DeviceInfo, error) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	var removed []DeviceInfo
+	if info.Version > registry.version {
+		synced := map[string]bool{}
+		for _, device := range info.Devices {
+			synced[device.DeviceId] = true
+		}
+		for id, device := range registry.devices {
+			if !synced[id] {
+				removed = append(removed, device)
+				delete(registry.devices, id)
+			}
+		}
+	}
+	for _, device := range info.Devices {
+		if old, ok := registry.devices[device.DeviceId]; ok && len(device.Status) == 0 {
+			device.Status = old.Status
+		}
+		registry.devices[device.DeviceId] = device
+	}
+	registry.updateVersion(info.Version)
+	return removed, registry.save()
+}
+
+// 更新子设备状态，ONLINE或者OFFLINE，不存在的子设备忽略
+func (registry *SubDeviceRegistry) updateStatus(statuses []DeviceStatus) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, status := range statuses {
+		device, ok := registry.devices[status.DeviceId]
+		if !ok {
+			continue
+		}
+		device.Status = status.Status
+		registry.devices[status.DeviceId] = device
+	}
+	return registry.save()
+}
+
+func (registry *SubDeviceRegistry) updateVersion(version int) {
+	if version > registry.version {
+		registry.version = version
+	}
+}
+
+func (registry *SubDeviceRegistry) save() error {
+	if len(registry.path) == 0 {
+		return nil
+	}
+
+	data := subDeviceRegistryData{
+		Version: registry.version,
+		Devices: registry.list(),
+	}
+	tmp := registry.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(Interface2JsonString(data)), 0644); err != nil {
+		glog.Errorf("save sub device registry failed %v", err)
+		return err
+	}
+	return os.Rename(tmp, registry.path)
+}
@@ -0,0 +1,149 @@
+package iot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createPlatformEvent(eventType string, paras interface{}) fakeMessage {
+	data := Data{
+		Services: []DataEntry{
+			{
+				ServiceId: "$sub_device_manager",
+				EventType: eventType,
+				EventTime: GetEventTimeStamp(),
+				Paras:     paras,
+			},
+		},
+	}
+	return fakeMessage{
+		topic:   formatTopic(PlatformEventToDeviceTopic, deviceId),
+		payload: []byte(Interface2JsonString(data)),
+	}
+}
+
+func TestSubDeviceRegistry_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub_devices.json")
+
+	device, client := createFakeIotDevice()
+	registry, err := NewSubDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetSubDeviceRegistry(registry)
+
+	// 没有设置回调函数时平台通知不会导致panic
+	handler := device.base.handlePlatformToDeviceData()
+	handler(client, createPlatformEvent("add_sub_device_notify", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-1", NodeId: "1"}, {DeviceId: "sub-2", NodeId: "2"}},
+		Version: 3,
+	}))
+	handler(client, createPlatformEvent("delete_sub_device_notify", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-1"}},
+		Version: 4,
+	}))
+	handler(client, createPlatformEvent("sub_device_sync_response", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-2", NodeId: "2"}, {DeviceId: "sub-3", NodeId: "3"}},
+		Version: 5,
+	}))
+
+	if !device.UpdateSubDeviceState(SubDevicesStatus{
+		DeviceStatuses: []DeviceStatus{{DeviceId: "sub-2", Status: "ONLINE"}},
+	}) {
+		t.Fatalf("update sub device state failed")
+	}
+
+	loaded, err := NewSubDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Version() != 5 {
+		t.Errorf("registry version must be 5 but is %d", loaded.Version())
+	}
+	devices := loaded.List()
+	if len(devices) != 2 || devices[0].DeviceId != "sub-2" || devices[1].DeviceId != "sub-3" {
+		t.Fatalf("registry devices are wrong %s", Interface2JsonString(devices))
+	}
+	if info, _ := loaded.Get("sub-2"); info.Status != "ONLINE" {
+		t.Errorf("sub device status must be ONLINE but is %s", info.Status)
+	}
+}
+
+func TestSubDeviceRegistry_SyncRemoveDeletedDevices(t *testing.T) {
+	device, client := createFakeIotDevice()
+	registry, _ := NewSubDeviceRegistry("")
+	device.SetSubDeviceRegistry(registry)
+	var deleted []DeviceInfo
+	device.SetSubDevicesDeleteHandler(func(devices SubDeviceInfo) {
+		deleted = append(deleted, devices.Devices...)
+	})
+
+	handler := device.base.handlePlatformToDeviceData()
+	handler(client, createPlatformEvent("add_sub_device_notify", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-1", ProductId: "p"}, {DeviceId: "sub-2", ProductId: "p"}},
+		Version: 3,
+	}))
+
+	// 版本号没有变化时平台没有删除子设备
+	handler(client, createPlatformEvent("sub_device_sync_response", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-2", ProductId: "p"}},
+		Version: 3,
+	}))
+	if len(registry.List()) != 2 || len(deleted) != 0 {
+		t.Fatalf("sync without newer version must not remove sub devices %s", Interface2JsonString(registry.List()))
+	}
+
+	// 网关离线期间平台删除了sub-1
+	handler(client, createPlatformEvent("sub_device_sync_response", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-2", ProductId: "p"}},
+		Version: 5,
+	}))
+	devices := registry.List()
+	if len(devices) != 1 || devices[0].DeviceId != "sub-2" || registry.Version() != 5 {
+		t.Fatalf("sync must remove sub devices deleted on platform %s", Interface2JsonString(devices))
+	}
+	if len(deleted) != 1 || deleted[0].DeviceId != "sub-1" {
+		t.Errorf("delete handler must be called with removed sub devices %s", Interface2JsonString(deleted))
+	}
+	if _, ok := device.base.subDeviceRouter.productIds["sub-1"]; ok {
+		t.Errorf("removed sub device must be removed from router")
+	}
+}
+
+func TestBaseIotDevice_SyncSubDevicesOnConnect(t *testing.T) {
+	device, client := createFakeIotDevice()
+	registry, _ := NewSubDeviceRegistry("")
+	registry.add(SubDeviceInfo{Version: 7})
+	device.SetSubDeviceRegistry(registry)
+
+	for _, handler := range device.base.connectHandlers {
+		handler()
+	}
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("gateway must sync sub devices when connected")
+	}
+	data := &struct {
+		Services []struct {
+			EventType string `json:"event_type"`
+			Paras     struct {
+				Version int `json:"version"`
+			} `json:"paras"`
+		} `json:"services"`
+	}{}
+	if err := json.Unmarshal(messages[0].payload, data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Services[0].EventType != "sub_device_sync_request" || data.Services[0].Paras.Version != 7 {
+		t.Errorf("gateway must sync sub devices with local version,request = %s", string(messages[0].payload))
+	}
+}
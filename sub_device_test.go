@@ -0,0 +1,179 @@
+package iot
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubDevice_SendMessage(t *testing.T) {
+	device, client := createFakeIotDevice()
+
+	if !device.SubDevice("sub-1").SendMessage(Message{Content: "hello"}) {
+		t.Fatalf("sub device send message failed")
+	}
+
+	messages := client.messages()
+	message := Message{}
+	if err := json.Unmarshal(messages[0].payload, &message); err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].topic != formatTopic(MessageUpTopic, device.base.Id) || message.ObjectDeviceId != "sub-1" {
+		t.Errorf("sub device message must send by gateway with object device id")
+	}
+}
+
+func TestSubDevice_ReportPropertiesBatch(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.subDeviceBatcher.interval = 20 * time.Millisecond
+
+	wg := sync.WaitGroup{}
+	for _, id := range []string{"sub-1", "sub-2", "sub-3"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if !device.SubDevice(id).ReportProperties(DeviceProperties{
+				Services: []DevicePropertyEntry{{ServiceId: "sensor", Properties: map[string]interface{}{"value": 1}}},
+			}) {
+				t.Errorf("sub device %s report properties failed", id)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].topic != formatTopic(GatewayBatchReportSubDeviceTopic, device.base.Id) {
+		t.Fatalf("sub device properties must be reported in one batch")
+	}
+	service := DevicesService{}
+	if err := json.Unmarshal(messages[0].payload, &service); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Devices) != 3 {
+		t.Errorf("batch must contains 3 sub devices but is %d", len(service.Devices))
+	}
+}
+
+func TestSubDevice_CommandHandler(t *testing.T) {
+	device, client := createFakeIotDevice()
+	responses := make(chan CommandResponse, 2)
+	client.onPublish = func(topic string, payload []byte) {
+		response := CommandResponse{}
+		json.Unmarshal(payload, &response)
+		responses <- response
+	}
+
+	device.AddCommandHandler(func(command Command) (bool, interface{}) {
+		return true, "gateway"
+	})
+	device.SubDevice("sub-1").AddCommandHandler(func(command Command) (bool, interface{}) {
+		return true, "sub-1"
+	})
+
+	handler := device.base.createCommandMqttHandler()
+	for _, target := range []string{"sub-1", "sub-2"} {
+		handler(client, fakeMessage{
+			topic:   "$oc/devices/" + device.base.Id + "/sys/commands/request_id=" + target,
+			payload: []byte(Interface2JsonString(Command{ObjectDeviceId: target, CommandName: "reboot"})),
+		})
+		response := <-responses
+		expected := target
+		if target == "sub-2" {
+			// 没有注册handler的子设备由网关处理
+			expected = "gateway"
+		}
+		if response.Paras != expected {
+			t.Errorf("command for %s must handled by %s but is %v", target, expected, response.Paras)
+		}
+	}
+}
+
+func TestSubDevice_RouteByProduct(t *testing.T) {
+	device, client := createFakeIotDevice()
+	received := make(chan string, 4)
+
+	device.AddMessageHandler(func(message Message) bool {
+		received <- "gateway"
+		return true
+	})
+	device.SubDeviceProduct("meter").AddMessageHandler(func(message Message) bool {
+		received <- "meter"
+		return true
+	})
+	device.SubDeviceFallback().AddMessageHandler(func(message Message) bool {
+		received <- "fallback"
+		return true
+	})
+	device.SubDevice("sub-2").AddMessageHandler(func(message Message) bool {
+		received <- "sub-2"
+		return true
+	})
+	device.base.handlePlatformToDeviceData()(client, createPlatformEvent("add_sub_device_notify", SubDeviceInfo{
+		Devices: []DeviceInfo{{DeviceId: "sub-1", ProductId: "meter"}, {DeviceId: "sub-2", ProductId: "meter"}},
+	}))
+
+	handler := device.base.createMessageMqttHandler()
+	cases := map[string]string{
+		"sub-1":        "meter",
+		"sub-2":        "sub-2",
+		"unknown":      "fallback",
+		"":             "gateway",
+		device.base.Id: "gateway",
+	}
+	for target, expected := range cases {
+		handler(client, fakeMessage{
+			topic:   formatTopic(MessageDownTopic, device.base.Id),
+			payload: []byte(Interface2JsonString(Message{ObjectDeviceId: target, Content: "hello"})),
+		})
+		if actual := <-received; actual != expected {
+			t.Errorf("message for %q must handled by %s but is %s", target, expected, actual)
+		}
+	}
+}
+
+func TestSubDevice_FallbackPerHandlerKind(t *testing.T) {
+	device, client := createFakeIotDevice()
+	received := make(chan string, 2)
+
+	device.AddMessageHandler(func(message Message) bool {
+		received <- "gateway"
+		return true
+	})
+	device.SubDeviceFallback().AddMessageHandler(func(message Message) bool {
+		received <- "fallback"
+		return true
+	})
+	// 子设备只注册了命令handler，消息仍然由兜底handler处理
+	device.SubDevice("sub-1").AddCommandHandler(func(command Command) (bool, interface{}) {
+		return true, nil
+	})
+
+	device.base.createMessageMqttHandler()(client, fakeMessage{
+		topic:   formatTopic(MessageDownTopic, device.base.Id),
+		payload: []byte(Interface2JsonString(Message{ObjectDeviceId: "sub-1", Content: "hello"})),
+	})
+	if actual := <-received; actual != "fallback" {
+		t.Errorf("message for sub device without message handler must handled by fallback but is %s", actual)
+	}
+}
+
+func TestSubDevice_PropertiesSetResponseCorrelation(t *testing.T) {
+	device, client := createFakeIotDevice()
+	topics := make(chan string, 2)
+	client.onPublish = func(topic string, payload []byte) {
+		topics <- topic
+	}
+
+	device.SubDevice("sub-1").AddPropertiesSetHandler(func(request DevicePropertyDownRequest) bool {
+		return request.ObjectDeviceId == "sub-1"
+	})
+	device.base.createPropertiesSetMqttHandler()(client, fakeMessage{
+		topic:   "$oc/devices/" + device.base.Id + "/sys/properties/set/request_id=42",
+		payload: []byte(Interface2JsonString(DevicePropertyDownRequest{ObjectDeviceId: "sub-1"})),
+	})
+
+	if topic := <-topics; topic != formatTopic(PropertiesSetResponseTopic, device.base.Id)+"42" {
+		t.Errorf("properties set response must use request id of the request but topic is %s", topic)
+	}
+}
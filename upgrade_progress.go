@@ -0,0 +1,139 @@
+package iot
+
+import (
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpgradeProgressInterval = time.Second
+	upgradeFinalReportRetries      = 3
+)
+
+// 软固件升级过程中上报升级状态，升级处理函数可以多次调用
+type UpgradeProgressReporter interface {
+	// 升级类型，0为软件升级，1为固件升级
+	UpgradeType() byte
+
+	// 上报升级进度、描述和结果码。距离上次上报不足最小上报间隔时只在间隔结束后上报最新的状态
+	Report(progress UpgradeProgress)
+}
+
+type upgradeProgressReporter struct {
+	device      *baseIotDevice
+	upgradeType byte
+	interval    time.Duration
+
+	lock     sync.Mutex
+	last     time.Time
+	pending  *UpgradeProgress
+	timer    *time.Timer
+	finished bool
+
+	// 保证上报按顺序进行，最终状态上报后不再上报中间状态
+	sendLock sync.Mutex
+}
+
+func newUpgradeProgressReporter(device *baseIotDevice, upgradeType byte) *upgradeProgressReporter {
+	interval := device.upgradeProgressInterval
+	if interval <= 0 {
+		interval = defaultUpgradeProgressInterval
+	}
+
+	return &upgradeProgressReporter{
+		device:      device,
+		upgradeType: upgradeType,
+		interval:    interval,
+	}
+}
+
+func (reporter *upgradeProgressReporter) UpgradeType() byte {
+	return reporter.upgradeType
+}
+
+func (reporter *upgradeProgressReporter) Report(progress UpgradeProgress) {
+	reporter.lock.Lock()
+	if reporter.finished {
+		reporter.lock.Unlock()
+		return
+	}
+
+	wait := reporter.interval - time.Since(reporter.last)
+	if wait <= 0 {
+		reporter.take()
+		reporter.lock.Unlock()
+		reporter.publish(progress)
+		return
+	}
+
+	reporter.pending = &progress
+	if reporter.timer == nil {
+		reporter.timer = time.AfterFunc(wait, reporter.flush)
+	}
+	reporter.lock.Unlock()
+}
+
+// 间隔结束后上报最新的升级状态
+func (reporter *upgradeProgressReporter) flush() {
+	reporter.lock.Lock()
+	reporter.timer = nil
+	if reporter.finished || reporter.pending == nil {
+		reporter.lock.Unlock()
+		return
+	}
+	progress := *reporter.pending
+	reporter.take()
+	reporter.lock.Unlock()
+
+	reporter.publish(progress)
+}
+
+// 在持有lock时调用，记录本次上报的时间
+func (reporter *upgradeProgressReporter) take() {
+	reporter.pending = nil
+	reporter.last = time.Now()
+}
+
+// 不持有lock上报，上报等待平台响应时不阻塞Report
+func (reporter *upgradeProgressReporter) publish(progress UpgradeProgress) {
+	reporter.sendLock.Lock()
+	defer reporter.sendLock.Unlock()
+	reporter.lock.Lock()
+	finished := reporter.finished
+	reporter.lock.Unlock()
+	if finished {
+		return
+	}
+
+	if err := reporter.device.reportUpgradeProgress(progress); err != nil {
+		glog.Warningf("device %s report upgrade progress failed %v", reporter.device.Id, err)
+	}
+}
+
+// 上报最终的升级状态，不受上报间隔限制，未上报的中间状态被丢弃，上报失败时重试
+func (reporter *upgradeProgressReporter) finish(progress UpgradeProgress) error {
+	reporter.discard()
+
+	reporter.sendLock.Lock()
+	defer reporter.sendLock.Unlock()
+	err := reporter.device.reportUpgradeProgress(progress)
+	for i := 1; i < upgradeFinalReportRetries && err != nil; i++ {
+		glog.Warningf("device %s report final upgrade progress failed %v,retry %d", reporter.device.Id, err, i)
+		time.Sleep(reporter.interval)
+		err = reporter.device.reportUpgradeProgress(progress)
+	}
+	return err
+}
+
+// 不再上报中间状态，未上报的中间状态被丢弃
+func (reporter *upgradeProgressReporter) discard() {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	reporter.finished = true
+	reporter.pending = nil
+	if reporter.timer != nil {
+		reporter.timer.Stop()
+		reporter.timer = nil
+	}
+}
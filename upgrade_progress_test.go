@@ -0,0 +1,122 @@
+package iot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpgradeProgressReporter_RateLimit(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.upgradeProgressInterval = 50 * time.Millisecond
+	finished := make(chan struct{})
+	device.SetDeviceUpgradeProgressHandler(func(upgradeType byte, info UpgradeInfo, reporter UpgradeProgressReporter) UpgradeProgress {
+		defer close(finished)
+		if reporter.UpgradeType() != 1 {
+			t.Errorf("reporter must be created for firmware upgrade")
+		}
+		for _, progress := range []int{10, 20, 30} {
+			reporter.Report(UpgradeProgress{Progress: progress, Description: "installing"})
+		}
+		time.Sleep(80 * time.Millisecond)
+		reporter.Report(UpgradeProgress{Progress: 40, Description: "installing"})
+		return UpgradeProgress{Progress: 100, Version: info.Version}
+	})
+
+	device.base.upgradeDevice(1, &UpgradeInfo{Version: "v2.0"})
+	<-finished
+	progresses := waitUpgradeResult(t, client)
+
+	var reported []int
+	for _, progress := range progresses {
+		reported = append(reported, progress.Progress)
+	}
+	// 间隔内的20被30覆盖，40被最终状态覆盖
+	if len(reported) != 3 || reported[0] != 10 || reported[1] != 30 || reported[2] != 100 {
+		t.Errorf("progress must be rate limited and final status delivered but reported %v", reported)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if len(upgradeProgresses(client)) != 3 {
+		t.Errorf("pending progress must be dropped after final status")
+	}
+}
+
+func TestUpgradeProgressReporter_Software(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.SetDeviceUpgradeProgressHandler(func(upgradeType byte, info UpgradeInfo, reporter UpgradeProgressReporter) UpgradeProgress {
+		if reporter.UpgradeType() != 0 {
+			t.Errorf("reporter must be created for software upgrade")
+		}
+		return UpgradeProgress{ResultCode: UpgradeCodeLatestVersion, Description: "already latest version"}
+	})
+
+	device.base.upgradeDevice(0, &UpgradeInfo{Version: "v1.0"})
+	progresses := waitUpgradeResult(t, client)
+	if len(progresses) != 1 || progresses[0].ResultCode != UpgradeCodeLatestVersion {
+		t.Errorf("final status must be reported %+v", progresses)
+	}
+}
+
+func TestUpgradeProgressReporter_ReportDuringPublish(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.upgradeProgressInterval = 20 * time.Millisecond
+	reporter := newUpgradeProgressReporter(&device.base, 1)
+
+	// 间隔结束后上报的进度等待平台响应
+	publishing := make(chan struct{})
+	release := make(chan struct{})
+	client.onPublish = func(topic string, payload []byte) {
+		if len(upgradeProgresses(client)) == 2 {
+			close(publishing)
+			<-release
+		}
+	}
+	reporter.Report(UpgradeProgress{Progress: 10})
+	reporter.Report(UpgradeProgress{Progress: 20})
+	<-publishing
+
+	reported := make(chan struct{})
+	go func() {
+		reporter.Report(UpgradeProgress{Progress: 30})
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Errorf("report must not wait for publishing progress")
+	}
+	close(release)
+
+	if err := reporter.finish(UpgradeProgress{Progress: 100}); err != nil {
+		t.Fatal(err)
+	}
+	progresses := upgradeProgresses(client)
+	if last := progresses[len(progresses)-1]; last.Progress != 100 {
+		t.Errorf("final status must be reported last %+v", progresses)
+	}
+}
+
+func TestUpgradeProgressReporter_FinishRetries(t *testing.T) {
+	device, client := createFakeIotDevice()
+	device.base.upgradeProgressInterval = 100 * time.Millisecond
+	attempts := 0
+	client.lock.Lock()
+	client.publishErr = func(topic string, payload []byte) error {
+		attempts++
+		return &DeviceError{errorMsg: "connection lost"}
+	}
+	client.lock.Unlock()
+
+	reporter := newUpgradeProgressReporter(&device.base, 1)
+	start := time.Now()
+	if reporter.finish(UpgradeProgress{Progress: 100}) == nil {
+		t.Fatal("final status must fail when publish failed")
+	}
+	if attempts != upgradeFinalReportRetries {
+		t.Errorf("final status must be reported %d times but is %d", upgradeFinalReportRetries, attempts)
+	}
+	// 只在两次上报之间等待
+	if elapsed := time.Since(start); elapsed >= time.Duration(upgradeFinalReportRetries)*device.base.upgradeProgressInterval {
+		t.Errorf("final status must not wait after last attempt,elapsed %v", elapsed)
+	}
+}